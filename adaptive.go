@@ -0,0 +1,88 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	defaultAIMDDecrease = 0.5
+	defaultAIMDIncrease = 0.1
+	defaultAIMDMin      = 0.01
+)
+
+// WithAIMD sets how Report adapts the token rate of a key, additive
+// increase and multiplicative decrease: every failure multiplies the rate
+// factor of the key by decrease, and every success adds increase to it,
+// up to 1, the configured token rate. The factor never drops below
+// minFactor,
+// so a key keeps refilling, slowly enough to probe for recovery. Defaults
+// to a decrease of 0.5, an increase of 0.1 and a minFactor of 0.01,
+// halving the rate on every failure and recovering it in 10 successes.
+//
+// decrease and minFactor must be greater than 0 and less than 1, and
+// increase greater than 0 and at most 1, New fails otherwise.
+func WithAIMD(decrease, increase, minFactor float64) Option {
+	return func(cfg *config) {
+		cfg.aimdDecrease = decrease
+		cfg.aimdIncrease = increase
+		cfg.aimdMin = minFactor
+	}
+}
+
+// validateAIMD checks the parameters passed to WithAIMD. Comparisons are
+// negated, so that NaN fails too.
+func validateAIMD(cfg config) error {
+	if !(cfg.aimdDecrease > 0 && cfg.aimdDecrease < 1) {
+		return errors.New("aimd decrease should be between 0 and 1")
+	}
+	if !(cfg.aimdIncrease > 0 && cfg.aimdIncrease <= 1) {
+		return errors.New("aimd increase should be between 0 and 1")
+	}
+	if !(cfg.aimdMin > 0 && cfg.aimdMin < 1) {
+		return errors.New("aimd min factor should be between 0 and 1")
+	}
+	return nil
+}
+
+// Report adapts the token rate of key to the outcome of a request it was
+// allowed, e.g. whether a flaky downstream answered or failed: a failure
+// lowers the rate multiplicatively and a success raises it additively
+// back towards the configured token rate, see WithAIMD. Allow then
+// refills key at the adapted rate, turning the rate limiter into a
+// lightweight adaptive concurrency control.
+//
+// Tokens refilled before the report are kept, the new rate only applies
+// from then on. The burst size is not adapted. The rate factor is stored
+// alongside the bucket, so it is forgotten once the key is evicted. A
+// report for an unknown or evicted key is ignored.
+func (r *rateLimiter[K]) Report(key K, ok bool) {
+	if r.cfg.disabled {
+		return
+	}
+	_, _ = r.store.update(context.Background(), key, func(b *Bucket, found bool) bool {
+		if !found {
+			return false
+		}
+		r.sync(b, found, r.limitFor(b), r.cfg.clock.Now())
+
+		factor := b.RateFactor
+		if factor == 0 {
+			factor = 1
+		}
+		if ok {
+			factor = min(1, factor+r.cfg.aimdIncrease)
+		} else {
+			factor = max(r.cfg.aimdMin, factor*r.cfg.aimdDecrease)
+		}
+		if factor == 1 {
+			// back to the configured rate
+			factor = 0
+		}
+		if factor == b.RateFactor {
+			return false
+		}
+		b.RateFactor = factor
+		return true
+	})
+}
@@ -0,0 +1,69 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(10, 1, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 100*time.Millisecond {
+		t.Fatalf("expected retry after of 100ms at the configured rate, got %v", retryAfter)
+	}
+
+	// every failure halves the rate
+	rateLimiter.Report("key", false)
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 200*time.Millisecond {
+		t.Errorf("expected retry after of 200ms at half the rate, got %v", retryAfter)
+	}
+	rateLimiter.Report("key", false)
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 400*time.Millisecond {
+		t.Errorf("expected retry after of 400ms at a quarter of the rate, got %v", retryAfter)
+	}
+
+	clock.Advance(400 * time.Millisecond)
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected request to be allowed at the adapted rate, got rejected")
+	}
+
+	// successes raise the rate back, but not beyond the configured one
+	for range 20 {
+		rateLimiter.Report("key", true)
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 100*time.Millisecond {
+		t.Errorf("expected retry after of 100ms back at the configured rate, got %v", retryAfter)
+	}
+
+	rateLimiter.Report("unknown", false)
+	if n := rateLimiter.Len(); n != 1 {
+		t.Errorf("expected report of an unknown key not to track it, got %d keys", n)
+	}
+}
+
+func TestReportMinFactor(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(10, 1, WithClock(clock), WithAIMD(0.1, 0.5, 0.05))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	for range 5 {
+		rateLimiter.Report("key", false)
+	}
+	// the rate bottoms out at 5% of 10 tokens per second
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 2*time.Second {
+		t.Errorf("expected retry after of 2s at the minimum rate, got %v", retryAfter)
+	}
+
+	rateLimiter.Report("key", true)
+	if b, _ := rateLimiter.store.load("key"); b.RateFactor != 0.55 {
+		t.Errorf("expected rate factor of 0.55 after a success, got %v", b.RateFactor)
+	}
+}
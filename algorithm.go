@@ -0,0 +1,178 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// Algorithm selects how the rate limiter accounts requests of a key.
+// Every algorithm admits burstSize requests to a new key and sustains
+// tokenRate requests per second over time, they differ in how requests
+// bunched in time are treated.
+type Algorithm int
+
+const (
+	// AlgoTokenBucket refills tokenRate tokens per second into a bucket
+	// holding up to burstSize tokens, each request consuming one. A key
+	// idle for burstSize/tokenRate seconds can send burstSize requests
+	// at once. It is the default.
+	AlgoTokenBucket Algorithm = iota
+	// AlgoSlidingWindow admits up to burstSize requests within any
+	// rolling window of burstSize/tokenRate seconds. It approximates the
+	// requests of the rolling window from the count of the current fixed
+	// window and the count of the previous one, weighted by how much of
+	// it still overlaps the rolling window, so it needs no timestamps.
+	AlgoSlidingWindow
+	// AlgoFixedWindow admits up to burstSize requests per window of
+	// burstSize/tokenRate seconds, the count resetting when a new window
+	// starts. Windows are aligned to multiples of their length since the
+	// zero time, so a window of a minute starts on every UTC minute and
+	// New(1000.0/60, 1000, WithAlgorithm(AlgoFixedWindow)) allows 1000
+	// requests per calendar minute. Unlike the sliding window, a key may
+	// send burstSize requests at the end of a window and burstSize more
+	// at the start of the next one.
+	AlgoFixedWindow
+	// AlgoLeakyBucket keeps a water level per key, raised by one for each
+	// request and leaking tokenRate units per second. A request is
+	// rejected if it would raise the level above burstSize. Used as a
+	// meter like this, it admits the same requests as the token bucket,
+	// the level being the tokens missing from a full bucket, but lets the
+	// level be reasoned about as the backlog of a queue draining at a
+	// constant rate.
+	AlgoLeakyBucket
+	// AlgoSlidingLog admits up to burstSize requests within any rolling
+	// window of burstSize/tokenRate seconds, exactly: it keeps the time
+	// of every request of the window, trading up to burstSize timestamps
+	// of memory per key for the accuracy the sliding window estimates,
+	// e.g. for compliance limits. A request is rejected while the oldest
+	// of the last burstSize requests is still within the window.
+	AlgoSlidingLog
+)
+
+// WithAlgorithm sets the algorithm accounting the requests of each key.
+// Defaults to AlgoTokenBucket.
+func WithAlgorithm(a Algorithm) Option {
+	return func(cfg *config) {
+		cfg.algorithm = a
+	}
+}
+
+// impl returns the implementation of a, nil if a is unknown.
+func (a Algorithm) impl() algorithm {
+	switch a {
+	case AlgoTokenBucket:
+		return tokenBucket{}
+	case AlgoSlidingWindow:
+		return slidingWindow{}
+	case AlgoFixedWindow:
+		return fixedWindow{}
+	case AlgoLeakyBucket:
+		return leakyBucket{}
+	case AlgoSlidingLog:
+		return slidingLog{}
+	}
+	return nil
+}
+
+// algorithm is the accounting of requests on a bucket. The rate limiter
+// deals with the cases every algorithm shares: limits with a burst size
+// of 0, infinite token rates and the retry delay of a token rate of 0.
+// Methods are called while the store gives exclusive access to b.
+type algorithm interface {
+	// init sets b up for a key without requests at t.
+	init(b *Bucket, lim *Limit, t time.Time)
+	// advance brings b up to date at t, e.g. refilling tokens.
+	advance(b *Bucket, lim *Limit, t time.Time)
+	// available returns how many tokens b has at t.
+	available(b *Bucket, lim *Limit, t time.Time) uint
+	// consume takes n tokens from b at t, n is at most available.
+	consume(b *Bucket, lim *Limit, t time.Time, n uint)
+	// refund gives back n tokens consumed from b, without exceeding
+	// burst size.
+	refund(b *Bucket, lim *Limit, n uint)
+	// retryAfter returns how long from t until b has n tokens. It is only
+	// called when fewer than n tokens are available, n is at most burst
+	// size and the token rate is positive and finite.
+	retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration
+}
+
+type tokenBucket struct{}
+
+func (tokenBucket) init(b *Bucket, lim *Limit, t time.Time) {
+	b.Tokens = lim.BurstSize
+	b.LastRefill = t
+}
+
+func (tokenBucket) advance(b *Bucket, lim *Limit, t time.Time) {
+	b.refill(lim, t)
+}
+
+func (tokenBucket) available(b *Bucket, _ *Limit, _ time.Time) uint {
+	return b.Tokens
+}
+
+func (tokenBucket) consume(b *Bucket, _ *Limit, _ time.Time, n uint) {
+	b.Tokens -= n
+}
+
+func (tokenBucket) refund(b *Bucket, lim *Limit, n uint) {
+	b.Tokens = min(b.Tokens+min(n, lim.BurstSize), lim.BurstSize)
+}
+
+func (tokenBucket) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	w := lim.every(n - b.Tokens)
+	if w == math.MaxInt64 {
+		return w
+	}
+	return b.LastRefill.Add(w).Sub(t)
+}
+
+// refill adds the tokens accumulated since LastRefill at lim's token rate,
+// up to lim's burst size.
+func (b *Bucket) refill(lim *Limit, t time.Time) {
+	// the wall clock can step backwards (NTP correction, VM migration),
+	// a negative elapsed time must not grant tokens. LastRefill is kept,
+	// so no tokens are added until the clock catches up with it again.
+	timeElapsed := max(0, t.Sub(b.LastRefill))
+
+	// tokens are added up in float64 and capped at burstSize before
+	// converting to uint, so a bucket that outlives the cleanup window
+	// cannot wrap around, however long it went without a refill.
+	added := lim.tokensIn(timeElapsed)
+	if float64(b.Tokens)+added >= float64(lim.BurstSize) {
+		// bucket is full, time spent while full does not
+		// accumulate tokens, so there is no remainder to keep.
+		// this also caps buckets filled before burstSize was lowered.
+		b.Tokens = lim.BurstSize
+		b.LastRefill = t
+	} else if newTokens := uint(added); newTokens > 0 {
+		b.Tokens += newTokens
+		// advance LastRefill only by the time it took to produce
+		// `newTokens` whole tokens. the sub-token remainder is kept
+		// for the next call instead of being discarded.
+		b.LastRefill = b.LastRefill.Add(lim.every(newTokens))
+	}
+}
+
+// window returns the window length of lim, burstSize/tokenRate seconds
+// rounded to the nanosecond.
+// ok is false if the window never ends, because the token rate is 0 or
+// the window does not fit in a time.Duration.
+func window(lim *Limit) (w time.Duration, ok bool) {
+	if lim.TokenRate == 0 {
+		return 0, false
+	}
+	if lim.Interval > 0 {
+		if w := lim.every(lim.BurstSize); w < math.MaxInt64 {
+			return max(1, w), true
+		}
+		return 0, false
+	}
+	ns := float64(lim.BurstSize) / lim.TokenRate * float64(time.Second)
+	if ns >= math.MaxInt64 {
+		return 0, false
+	}
+	// rounded, so that a rate derived from the window, like 1000.0/60,
+	// gives back the exact window.
+	return max(1, time.Duration(math.Round(ns))), true
+}
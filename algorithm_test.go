@@ -0,0 +1,340 @@
+package ratelimiter
+
+import (
+	"math"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// allAlgorithms lists every Algorithm, for the tests run against each
+// of them.
+var allAlgorithms = []Algorithm{AlgoTokenBucket, AlgoSlidingWindow, AlgoFixedWindow, AlgoLeakyBucket, AlgoSlidingLog}
+
+func TestAlgorithmBurst(t *testing.T) {
+	t.Parallel()
+
+	// one token per second and a burst size of 10, so a window of the
+	// sliding window spans 10 seconds. the token bucket admits 20 requests
+	// within the first 10 seconds, the sliding window only 10.
+	tcs := []struct {
+		name      string
+		algorithm Algorithm
+		// allowed is the number of requests allowed out of 20, sent
+		// after each step.
+		allowed []int
+	}{
+		{
+			name:      "token bucket",
+			algorithm: AlgoTokenBucket,
+			allowed:   []int{10, 5, 5, 5},
+		},
+		{
+			name:      "sliding window",
+			algorithm: AlgoSlidingWindow,
+			allowed:   []int{10, 0, 0, 5},
+		},
+		{
+			name:      "fixed window",
+			algorithm: AlgoFixedWindow,
+			allowed:   []int{10, 0, 10, 0},
+		},
+		{
+			name:      "leaky bucket",
+			algorithm: AlgoLeakyBucket,
+			allowed:   []int{10, 5, 5, 5},
+		},
+		{
+			name:      "sliding log",
+			algorithm: AlgoSlidingLog,
+			allowed:   []int{10, 0, 10, 0},
+		},
+	}
+	steps := []time.Duration{0, 5 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			clock := newFakeClock()
+			rateLimiter, _ := New(1, 10, WithClock(clock), WithAlgorithm(tc.algorithm))
+			defer rateLimiter.Close()
+
+			for i, step := range steps {
+				clock.Advance(step)
+
+				allowed := 0
+				for range 20 {
+					if rateLimiter.Allow("key") {
+						allowed++
+					}
+				}
+				if allowed != tc.allowed[i] {
+					t.Errorf("step %d: expected allowed requests: %d, got: %d", i, tc.allowed[i], allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	// a window of 10 seconds
+	rateLimiter, _ := New(1, 10, WithClock(clock), WithAlgorithm(AlgoSlidingWindow))
+	defer rateLimiter.Close()
+
+	for range 4 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+	clock.Advance(5 * time.Second)
+	for range 6 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	// the current window is full until it becomes the previous one
+	if tokens := rateLimiter.Tokens("key"); tokens != 0 {
+		t.Errorf("expected 0 tokens, got %d", tokens)
+	}
+	// at 11s, 10 * (1 - 1/10) = 9 requests are estimated in the rolling window
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 6*time.Second {
+		t.Errorf("expected retry after of %v, got %v", 6*time.Second, retryAfter)
+	}
+
+	clock.Advance(6 * time.Second)
+
+	if tokens := rateLimiter.Tokens("key"); tokens != 1 {
+		t.Errorf("expected 1 token, got %d", tokens)
+	}
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	// two windows later, no request of the previous window is left
+	clock.Advance(20 * time.Second)
+
+	if tokens := rateLimiter.Tokens("key"); tokens != 10 {
+		t.Errorf("expected 10 tokens, got %d", tokens)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	t.Parallel()
+
+	// a window of 10 seconds
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 10, WithClock(clock), WithAlgorithm(AlgoSlidingLog))
+	defer rateLimiter.Close()
+	tokenBucket, _ := New(1, 10, WithClock(clock))
+	defer tokenBucket.Close()
+
+	// one request per second fills the window
+	for i := range 10 {
+		if i > 0 {
+			clock.Advance(time.Second)
+		}
+		if !rateLimiter.Allow("key") || !tokenBucket.Allow("key") {
+			t.Fatalf("request %d: expected allowed to be true, got false", i)
+		}
+	}
+
+	// the token bucket refilled in the meantime, but 10 requests were
+	// made within the last 10 seconds
+	clock.Advance(500 * time.Millisecond)
+	if !tokenBucket.Allow("key") {
+		t.Fatal("expected token bucket to allow the 11th request, got rejected")
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected sliding log to reject the 11th request within the window, got allowed")
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 500*time.Millisecond {
+		t.Errorf("expected retry after of %v, got %v", 500*time.Millisecond, retryAfter)
+	}
+
+	// the first request leaves the window exactly 10 seconds after it
+	clock.Advance(500*time.Millisecond - time.Nanosecond)
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false before the first request left the window, got true")
+	}
+	clock.Advance(time.Nanosecond)
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true once the first request left the window, got false")
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	// memory stays bounded by the burst size
+	if b, _ := rateLimiter.store.load("key"); len(b.Log) != 10 {
+		t.Errorf("expected 10 timestamps, got %d", len(b.Log))
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range allAlgorithms {
+		clock := newFakeClock()
+		rateLimiter, _ := New(1, 10, WithClock(clock), WithAlgorithm(algorithm))
+		defer rateLimiter.Close()
+
+		if rateLimiter.AllowN("key", 11) {
+			t.Errorf("algorithm %d: expected more than burst size to be rejected, got allowed", algorithm)
+		}
+		if !rateLimiter.AllowN("key", 7) {
+			t.Errorf("algorithm %d: expected 7 tokens to be allowed, got rejected", algorithm)
+		}
+		if rateLimiter.AllowN("key", 4) {
+			t.Errorf("algorithm %d: expected 4 tokens to be rejected, got allowed", algorithm)
+		}
+		// a rejected request consumes nothing
+		if tokens := rateLimiter.Tokens("key"); tokens != 3 {
+			t.Errorf("algorithm %d: expected 3 tokens, got %d", algorithm, tokens)
+		}
+		if !rateLimiter.AllowN("key", 3) {
+			t.Errorf("algorithm %d: expected 3 tokens to be allowed, got rejected", algorithm)
+		}
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		// 3 requests per minute
+		rateLimiter, _ := New(3.0/60, 3, WithAlgorithm(AlgoFixedWindow))
+		defer rateLimiter.Close()
+
+		// move to the middle of a window, windows are aligned to whole minutes
+		time.Sleep(time.Until(time.Now().Truncate(time.Minute).Add(90 * time.Second)))
+
+		for range 3 {
+			if !rateLimiter.Allow("key") {
+				t.Fatal("expected allowed to be true, got false")
+			}
+		}
+		if rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be false, got true")
+		}
+		if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 30*time.Second {
+			t.Errorf("expected retry after of %v, got %v", 30*time.Second, retryAfter)
+		}
+
+		// one nanosecond before the window ends, the count is not reset yet
+		time.Sleep(30*time.Second - time.Nanosecond)
+		if rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be false before the window boundary, got true")
+		}
+
+		time.Sleep(time.Nanosecond)
+		for range 3 {
+			if !rateLimiter.Allow("key") {
+				t.Fatal("expected allowed to be true at the window boundary, got false")
+			}
+		}
+		if rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be false, got true")
+		}
+	})
+}
+
+func TestLeakyBucket(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	// leaks 2 requests per second, holds up to 4
+	rateLimiter, _ := New(2, 4, WithClock(clock), WithAlgorithm(AlgoLeakyBucket))
+	defer rateLimiter.Close()
+
+	for range 4 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 500*time.Millisecond {
+		t.Errorf("expected retry after of %v, got %v", 500*time.Millisecond, retryAfter)
+	}
+
+	// under sustained load, requests drain at a constant rate of one
+	// every 500ms, with the partially leaked unit carried over.
+	allowed := 0
+	for range 40 {
+		clock.Advance(100 * time.Millisecond)
+		if rateLimiter.Allow("key") {
+			allowed++
+		}
+	}
+	if allowed != 8 {
+		t.Errorf("expected allowed requests: %d, got: %d", 8, allowed)
+	}
+
+	// the level only drops to zero, an idle key does not bank capacity
+	// beyond burst size.
+	clock.Advance(time.Hour)
+	if tokens := rateLimiter.Tokens("key"); tokens != 4 {
+		t.Errorf("expected 4 tokens, got %d", tokens)
+	}
+}
+
+func TestRefillPrecision(t *testing.T) {
+	t.Parallel()
+
+	// polled far more often than tokens are produced, every refill adds
+	// a fraction of a token. the fractions are carried over in
+	// LastRefill, so no token is lost however low or odd the rate. the
+	// burst size leaves room for more than one token, a full bucket
+	// rightly dropping the fraction it cannot hold.
+	tcs := []struct {
+		name     string
+		rate     float64
+		poll     time.Duration
+		duration time.Duration
+		expected int
+		// retryAfter is the least RetryAfter expected once done.
+		retryAfter time.Duration
+	}{
+		{name: "one every 10 seconds", rate: 0.1, poll: 100 * time.Millisecond, duration: 1000 * time.Second, expected: 100},
+		{name: "one per day", rate: 1.0 / 86400, poll: time.Second, duration: 10 * 24 * time.Hour, expected: 10},
+		{name: "odd rate", rate: 7.3, poll: time.Millisecond, duration: 100 * time.Second, expected: 730},
+		{name: "thirds", rate: 3, poll: 7 * time.Millisecond, duration: 1001 * time.Second, expected: 3003},
+		{name: "one in longer than a duration", rate: 1e-12, poll: time.Hour, duration: 24 * time.Hour, expected: 0, retryAfter: math.MaxInt64},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			clock := newFakeClock()
+			rateLimiter, _ := New(tc.rate, 10, WithClock(clock), WithIdleTimeout(30*24*time.Hour), WithoutBackgroundCleanup())
+			defer rateLimiter.Close()
+
+			// spend the initial burst
+			rateLimiter.AllowN("key", 10)
+
+			allowed := 0
+			for elapsed := time.Duration(0); elapsed < tc.duration; elapsed += tc.poll {
+				clock.Advance(tc.poll)
+				if rateLimiter.Allow("key") {
+					allowed++
+				}
+			}
+			if allowed != tc.expected {
+				t.Errorf("expected %d requests allowed, got %d", tc.expected, allowed)
+			}
+			if retryAfter := rateLimiter.RetryAfter("key"); retryAfter < tc.retryAfter {
+				t.Errorf("expected retry after of at least %v, got %v", tc.retryAfter, retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package ratelimiter
+
+import "time"
+
+// Clock is the source of time used by the rate limiter for refilling
+// buckets and for evicting idle keys.
+//
+// Now should not go backwards. The system clock guarantees this through
+// the monotonic reading of time.Now, but a custom Clock, and bucket times
+// that went through a Store or Snapshot, have no monotonic reading and are
+// compared by wall clock instead, so they follow its steps. The rate
+// limiter tolerates them: a step backwards grants no tokens until the
+// clock is back at the last refill, and a step forward refills buckets at
+// most up to burstSize and may evict keys as idle early.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,248 @@
+// Package compat offers the API of golang.org/x/time/rate on top of the
+// rate limiter, keyed, to replace a hand maintained
+// map[string]*rate.Limiter with little code churn: rate.NewLimiter(r, b)
+// becomes compat.NewLimiter(r, b), and every method takes the key first.
+//
+// The behaviour differs from x/time/rate in a few ways:
+//   - Buckets are refilled lazily in whole tokens, the fraction of a token
+//     is kept for the next refill but never spent, so Tokens reports
+//     whole tokens only.
+//   - Methods always read the clock, there are no variants taking a time.
+//   - A Reservation cannot go into debt. Reserve takes a token only if one
+//     is available right away, see Reservation.
+//   - Inf with a burst of 0 allows nothing, and keys idle for the idle
+//     timeout are evicted and start over with a full bucket.
+package compat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+)
+
+// Limit is the maximum frequency of events, in events per second.
+type Limit float64
+
+// Inf is the infinite rate limit, it allows all events while burst is
+// positive.
+const Inf = Limit(math.MaxFloat64)
+
+// InfDuration is the duration returned by Delay when a Reservation can
+// never be honoured.
+const InfDuration = time.Duration(math.MaxInt64)
+
+// ErrWaitTimeout is returned by WaitMax when the event would be allowed
+// later than the maximum wait.
+var ErrWaitTimeout = errors.New("rate: wait would exceed the maximum wait")
+
+// Every converts a minimum time interval between events to a Limit.
+func Every(interval time.Duration) Limit {
+	if interval <= 0 {
+		return Inf
+	}
+	return 1 / Limit(interval.Seconds())
+}
+
+// keyedLimiter holds the buckets of a Limiter, one per key.
+type keyedLimiter interface {
+	AllowN(key string, n uint) bool
+	Refund(key string, n uint)
+	RetryAfter(key string) time.Duration
+	Tokens(key string) uint
+	Close()
+}
+
+// Limiter controls how frequently events are allowed to happen, for
+// every key on its own.
+type Limiter struct {
+	r     keyedLimiter
+	limit Limit
+	burst int
+	// done is closed by Close, waking every goroutine sleeping in WaitN.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLimiter returns a Limiter allowing events up to rate r, with bursts
+// of at most b tokens, for every key. opts configure the underlying rate
+// limiter, e.g. its idle timeout. Unlike rate.NewLimiter it returns an
+// error for a negative r or b. Close must be called once the Limiter is no
+// longer needed.
+func NewLimiter(r Limit, b int, opts ...ratelimiter.Option) (*Limiter, error) {
+	if b < 0 {
+		return nil, errors.New("burst should not be negative")
+	}
+	tokenRate := float64(r)
+	if r == Inf {
+		tokenRate = math.Inf(1)
+	}
+	rl, err := ratelimiter.New(tokenRate, uint(b), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Limiter{r: rl, limit: r, burst: b, done: make(chan struct{})}, nil
+}
+
+// Limit returns the maximum overall event rate.
+func (lim *Limiter) Limit() Limit {
+	return lim.limit
+}
+
+// Burst returns the maximum burst size.
+func (lim *Limiter) Burst() int {
+	return lim.burst
+}
+
+// Tokens returns the number of whole tokens available for key now.
+func (lim *Limiter) Tokens(key string) float64 {
+	return float64(lim.r.Tokens(key))
+}
+
+// Allow reports whether an event for key may happen now.
+func (lim *Limiter) Allow(key string) bool {
+	return lim.AllowN(key, 1)
+}
+
+// AllowN reports whether n events for key may happen now.
+func (lim *Limiter) AllowN(key string, n int) bool {
+	if n < 0 {
+		return false
+	}
+	return lim.r.AllowN(key, uint(n))
+}
+
+// Wait blocks until an event for key is allowed, see WaitN.
+func (lim *Limiter) Wait(ctx context.Context, key string) error {
+	return lim.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n events for key are allowed. It returns an error if
+// n exceeds the burst, if ctx is done, or if the expected wait exceeds the
+// deadline of ctx. Once the Limiter is closed it returns
+// ratelimiter.ErrClosed, waking up waiters right away. Unlike
+// x/time/rate, waiting does not reserve the tokens: WaitN retries once
+// the next token is expected, so with concurrent waiters on one key it
+// may wait more than once.
+func (lim *Limiter) WaitN(ctx context.Context, key string, n int) error {
+	return lim.wait(ctx, key, n, time.Time{})
+}
+
+// WaitMax is like Wait, but gives up with ErrWaitTimeout, without
+// sleeping, as soon as the event is expected to be allowed later than
+// maxWait from now, e.g. to wait at most 2 seconds and reject otherwise
+// without deriving a context with a timeout. ctx still cancels the wait,
+// its errors telling a cancelled caller from one that would have waited
+// too long. It is not part of x/time/rate.
+func (lim *Limiter) WaitMax(ctx context.Context, key string, maxWait time.Duration) error {
+	return lim.wait(ctx, key, 1, time.Now().Add(maxWait))
+}
+
+// wait is WaitN, failing with ErrWaitTimeout once the event is expected
+// after deadline, unless deadline is zero.
+func (lim *Limiter) wait(ctx context.Context, key string, n int, deadline time.Time) error {
+	if n < 0 || n > lim.burst || lim.burst == 0 {
+		return fmt.Errorf("rate: Wait(n=%d) exceeds limiter's burst %d", n, lim.burst)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-lim.done:
+			return ratelimiter.ErrClosed
+		default:
+		}
+		if lim.r.AllowN(key, uint(n)) {
+			return nil
+		}
+
+		wait := max(lim.r.RetryAfter(key), time.Millisecond)
+		if !deadline.IsZero() && time.Until(deadline) < wait {
+			return ErrWaitTimeout
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("rate: Wait(n=%d) would exceed context deadline", n)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-lim.done:
+			timer.Stop()
+			return ratelimiter.ErrClosed
+		case <-timer.C:
+		}
+	}
+}
+
+// Reservation holds the outcome of Reserve. Unlike x/time/rate, it never
+// puts the limiter into debt: OK is true only if the tokens were taken
+// right away, with a Delay of 0. Otherwise no token is held, Delay is how
+// long until they are expected to be available, and the caller must try
+// again after waiting, e.g. with Allow.
+type Reservation struct {
+	lim      *Limiter
+	key      string
+	n        int
+	ok       bool
+	delay    time.Duration
+	canceled atomic.Bool
+}
+
+// Reserve is shorthand for ReserveN(key, 1).
+func (lim *Limiter) Reserve(key string) *Reservation {
+	return lim.ReserveN(key, 1)
+}
+
+// ReserveN takes n tokens for key if they are available now. See
+// Reservation for how it differs from x/time/rate.
+func (lim *Limiter) ReserveN(key string, n int) *Reservation {
+	res := &Reservation{lim: lim, key: key, n: n}
+	switch {
+	case n < 0 || n > lim.burst:
+		res.delay = InfDuration
+	case lim.r.AllowN(key, uint(n)):
+		res.ok = true
+	default:
+		res.delay = lim.r.RetryAfter(key)
+	}
+	return res
+}
+
+// OK reports whether the tokens were taken.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns 0 if the tokens were taken, otherwise how long until they
+// are expected to be available, InfDuration if never.
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+// Cancel gives the tokens of the reservation back, if they were taken.
+// Calling it more than once does nothing.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.canceled.Swap(true) {
+		return
+	}
+	r.lim.r.Refund(r.key, uint(r.n))
+}
+
+// Close stops the cleanup goroutine of the underlying rate limiter, and
+// makes goroutines sleeping in WaitN return ratelimiter.ErrClosed instead
+// of waiting for their next token or their context. Calling it more than
+// once does nothing.
+func (lim *Limiter) Close() {
+	lim.closeOnce.Do(func() {
+		lim.r.Close()
+		close(lim.done)
+	})
+}
@@ -0,0 +1,191 @@
+package compat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+)
+
+func TestEvery(t *testing.T) {
+	t.Parallel()
+
+	if l := Every(100 * time.Millisecond); l != 10 {
+		t.Errorf("expected limit 10, got %v", l)
+	}
+	if l := Every(0); l != Inf {
+		t.Errorf("expected limit Inf, got %v", l)
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewLimiter(1, -1); err == nil {
+		t.Error("expected error for a negative burst, but got nil error")
+	}
+
+	lim, err := NewLimiter(Every(time.Hour), 2)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer lim.Close()
+
+	if lim.Limit() != Every(time.Hour) || lim.Burst() != 2 {
+		t.Errorf("expected limit %v and burst 2, got %v and %d", Every(time.Hour), lim.Limit(), lim.Burst())
+	}
+	if !lim.Allow("a") || !lim.Allow("a") {
+		t.Fatal("expected burst to be allowed, got false")
+	}
+	if lim.Allow("a") {
+		t.Error("expected request over the burst to be rejected, got allowed")
+	}
+	// keys are limited on their own
+	if !lim.AllowN("b", 2) {
+		t.Error("expected another key to be allowed, got rejected")
+	}
+	if tokens := lim.Tokens("b"); tokens != 0 {
+		t.Errorf("expected 0 tokens, got %v", tokens)
+	}
+
+	inf, _ := NewLimiter(Inf, 1)
+	defer inf.Close()
+	for range 10 {
+		if !inf.Allow("a") {
+			t.Fatal("expected Inf to allow, got rejected")
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	t.Parallel()
+
+	lim, _ := NewLimiter(100, 1)
+	defer lim.Close()
+
+	ctx := context.Background()
+	start := time.Now()
+	for range 3 {
+		if err := lim.Wait(ctx, "key"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("expected waits of about 10ms each, got %v in total", elapsed)
+	}
+
+	if err := lim.WaitN(ctx, "key", 2); err == nil {
+		t.Error("expected error for n over the burst, but got nil error")
+	}
+
+	slow, _ := NewLimiter(Every(time.Hour), 1)
+	defer slow.Close()
+	slow.Allow("key")
+
+	deadline, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := slow.Wait(deadline, "key"); err == nil {
+		t.Error("expected error for a wait past the deadline, but got nil error")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := slow.Wait(canceled, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestLimiterWaitMax(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		lim, _ := NewLimiter(Every(time.Second), 1)
+		defer lim.Close()
+
+		lim.Allow("key")
+
+		start := time.Now()
+		if err := lim.WaitMax(t.Context(), "key", 500*time.Millisecond); !errors.Is(err, ErrWaitTimeout) {
+			t.Errorf("expected error %v, got %v", ErrWaitTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Errorf("expected to fail without waiting, got %v", elapsed)
+		}
+
+		if err := lim.WaitMax(t.Context(), "key", 2*time.Second); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Errorf("expected to wait for the next token for 1s, got %v", elapsed)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		if err := lim.WaitMax(ctx, "key", time.Hour); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected error %v, got %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestLimiterWaitClose(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		lim, _ := NewLimiter(Every(time.Hour), 1)
+		lim.Allow("key")
+
+		errs := make(chan error, 5)
+		for range 5 {
+			go func() {
+				errs <- lim.Wait(context.Background(), "key")
+			}()
+		}
+		// every waiter is asleep until the next token, an hour away
+		synctest.Wait()
+
+		start := time.Now()
+		lim.Close()
+		for range 5 {
+			if err := <-errs; !errors.Is(err, ratelimiter.ErrClosed) {
+				t.Errorf("expected error %v, got %v", ratelimiter.ErrClosed, err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Errorf("expected waiters to return right away, got %v", elapsed)
+		}
+
+		if err := lim.Wait(context.Background(), "key"); !errors.Is(err, ratelimiter.ErrClosed) {
+			t.Errorf("expected error %v after close, got %v", ratelimiter.ErrClosed, err)
+		}
+		lim.Close()
+	})
+}
+
+func TestLimiterReserve(t *testing.T) {
+	t.Parallel()
+
+	lim, _ := NewLimiter(Every(time.Second), 1, ratelimiter.WithIdleTimeout(time.Hour))
+	defer lim.Close()
+
+	r := lim.Reserve("key")
+	if !r.OK() || r.Delay() != 0 {
+		t.Fatalf("expected reservation with no delay, got %v and %v", r.OK(), r.Delay())
+	}
+
+	next := lim.Reserve("key")
+	if next.OK() {
+		t.Error("expected reservation without a token not to be OK, got OK")
+	}
+	if next.Delay() <= 0 || next.Delay() > time.Second {
+		t.Errorf("expected delay of up to 1s, got %v", next.Delay())
+	}
+
+	r.Cancel()
+	r.Cancel()
+	if tokens := lim.Tokens("key"); tokens != 1 {
+		t.Errorf("expected 1 token after cancel, got %v", tokens)
+	}
+
+	if r := lim.ReserveN("key", 2); r.OK() || r.Delay() != InfDuration {
+		t.Errorf("expected reservation over the burst to never be OK, got %v and %v", r.OK(), r.Delay())
+	}
+}
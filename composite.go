@@ -0,0 +1,54 @@
+package ratelimiter
+
+import "strconv"
+
+// AllowMulti is like Allow for the key made of parts, e.g. a user ID, a
+// route and a method limited together. Every part is prefixed with its
+// length, so that no two lists of parts make the same key whatever they
+// contain: ("a", "bc") and ("ab", "c") have buckets of their own, which a
+// strings.Join with a separator cannot guarantee. Keys passed to Allow
+// directly could collide with composite ones though: use either for a
+// rate limiter, not both. Like AllowBytes, no string is allocated for a
+// key already tracked. AllowMulti panics if the key type is not string.
+func (r *rateLimiter[K]) AllowMulti(parts ...string) bool {
+	rs := stringKeyed(r, "AllowMulti")
+	var buf [64]byte
+	return rs.AllowBytes(appendCompositeKey(buf[:0], parts))
+}
+
+// TokensMulti is like Tokens for the key made of parts, see AllowMulti.
+func (r *rateLimiter[K]) TokensMulti(parts ...string) uint {
+	return stringKeyed(r, "TokensMulti").Tokens(compositeKey(parts))
+}
+
+// RemoveMulti is like Remove for the key made of parts, see AllowMulti.
+func (r *rateLimiter[K]) RemoveMulti(parts ...string) bool {
+	return stringKeyed(r, "RemoveMulti").Remove(compositeKey(parts))
+}
+
+// stringKeyed returns r as a rate limiter of string keys for method,
+// panicking if its keys are of another type.
+func stringKeyed[K comparable](r *rateLimiter[K], method string) *rateLimiter[string] {
+	rs, ok := any(r).(*rateLimiter[string])
+	if !ok {
+		panic("ratelimiter: " + method + " needs string keys")
+	}
+	return rs
+}
+
+// compositeKey returns the key made of parts, see appendCompositeKey.
+func compositeKey(parts []string) string {
+	return string(appendCompositeKey(nil, parts))
+}
+
+// appendCompositeKey appends the key made of parts to b, the decimal
+// length of every part followed by a colon and the part, the encoding
+// Namespace uses for its prefix.
+func appendCompositeKey(b []byte, parts []string) []byte {
+	for _, part := range parts {
+		b = strconv.AppendInt(b, int64(len(part)), 10)
+		b = append(b, ':')
+		b = append(b, part...)
+	}
+	return b
+}
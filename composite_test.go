@@ -0,0 +1,58 @@
+package ratelimiter
+
+import "testing"
+
+func TestAllowMulti(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	if !rateLimiter.AllowMulti("alice", "/orders", "POST") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if rateLimiter.AllowMulti("alice", "/orders", "POST") {
+		t.Fatal("expected second request to be rejected, got allowed")
+	}
+	if !rateLimiter.AllowMulti("alice", "/orders", "GET") {
+		t.Error("expected another method to have its own bucket, got rejected")
+	}
+
+	// parts joining into the same string are still different keys
+	if !rateLimiter.AllowMulti("a", "bc") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if !rateLimiter.AllowMulti("ab", "c") {
+		t.Error("expected parts split differently to have their own bucket, got rejected")
+	}
+	if !rateLimiter.AllowMulti("a:b", "c") || !rateLimiter.AllowMulti("a", "b:c") {
+		t.Error("expected parts containing the separator to have their own bucket, got rejected")
+	}
+
+	if tokens := rateLimiter.TokensMulti("a", "bc"); tokens != 0 {
+		t.Errorf("expected 0 tokens, got %d", tokens)
+	}
+	if !rateLimiter.RemoveMulti("a", "bc") {
+		t.Error("expected key to be removed, but it wasn't")
+	}
+	if tokens := rateLimiter.TokensMulti("a", "bc"); tokens != 1 {
+		t.Errorf("expected removed key to report a full bucket, got %d", tokens)
+	}
+	if tokens := rateLimiter.TokensMulti("ab", "c"); tokens != 0 {
+		t.Errorf("expected other key to keep its bucket, got %d tokens", tokens)
+	}
+}
+
+func TestAllowMultiKeyType(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := NewKeyed[int](0, 1)
+	defer rateLimiter.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected AllowMulti to panic for int keys, but it didn't")
+		}
+	}()
+	rateLimiter.AllowMulti("a", "b")
+}
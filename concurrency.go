@@ -0,0 +1,172 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+// concurrencyLimiter caps the requests in flight per key, see
+// NewConcurrency.
+type concurrencyLimiter struct {
+	// r keeps the number of requests in flight of every key in the
+	// Tokens of its bucket, and evicts idle keys like any rate limiter.
+	// The Count of a bucket holds its generation, drawn from generations
+	// when the key is created, so that a release of a key evicted and
+	// created again since is told apart.
+	r           *rateLimiter[string]
+	maxInFlight uint
+	generations atomic.Uint64
+}
+
+// NewConcurrency returns a limiter allowing at most maxInFlight requests
+// of a key to run at once, e.g. to cap the slow uploads of a user however
+// spread out in time they are. Unlike New, a slot is not refilled over
+// time but given back once the request is done, see Acquire.
+//
+// Keys live in the same sharded maps as the ones of New, and are evicted
+// by the cleanup goroutine once they have no request in flight and have
+// been idle for the idle timeout. A key with requests in flight is never
+// evicted as idle, however long they run. WithMaxKeys may still evict
+// it, which frees its slots: releasing them later does not free slots of
+// the key created again. Options about token rates, like WithAlgorithm
+// or WithInitialTokens, have no effect, and WithStore is not supported,
+// as the count of requests in flight is local to the process.
+func NewConcurrency(maxInFlight uint, opts ...Option) (*concurrencyLimiter, error) {
+	r, err := New(0, maxInFlight, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if r.cfg.store != nil {
+		r.Close()
+		return nil, errors.New("concurrency limits do not support a store")
+	}
+	// the burst size as validated, e.g. raised to 1 by WithZeroBurst
+	return &concurrencyLimiter{r: r, maxInFlight: r.limit.Load().BurstSize}, nil
+}
+
+// Acquire takes a slot of key, reporting whether one was free. When ok is
+// true, release must be called once the request is done to give the slot
+// back. It is safe to call more than once, only the first call counts.
+// When ok is false, release does nothing.
+//
+// Acquire is counted as Allowed or Rejected in Stats, like Allow. Once
+// the limiter is closed, or when a WithNonBlocking limiter finds the shard
+// of key busy, it fails without being counted.
+func (c *concurrencyLimiter) Acquire(key string) (release func(), ok bool) {
+	r := c.r
+	if r.closed.Load() {
+		return func() {}, false
+	}
+	if r.cfg.disabled {
+		r.counters.allowed.Add(1)
+		return func() {}, true
+	}
+
+	update := r.store.update
+	if r.cfg.nonBlocking {
+		update = r.store.tryUpdate
+	}
+	var gen uint
+	created, err := update(context.Background(), key, func(b *Bucket, loaded bool) bool {
+		if b.Tokens >= c.maxInFlight || !loaded && r.draining.Load() {
+			return false
+		}
+		t := r.cfg.clock.Now()
+		if !loaded {
+			b.CreatedAt = t
+			b.Count = uint(c.generations.Add(1))
+		}
+		gen = b.Count
+		if t.After(b.LastActivity) {
+			b.LastActivity = t
+		}
+		b.Tokens++
+		// the expiry of a key with requests in flight is pushed out of
+		// reach, so that sweeps leave it alone.
+		b.IdleTimeout = math.MaxInt64
+		ok = true
+		return true
+	})
+	if err != nil {
+		// the sharded maps only fail with ErrBusy
+		r.counters.busy.Add(1)
+		return func() {}, false
+	}
+	if created {
+		r.added(key)
+	}
+	if !ok {
+		r.counters.rejected.Add(1)
+		if r.onReject != nil {
+			r.onReject(key)
+		}
+		return func() {}, false
+	}
+	r.counters.allowed.Add(1)
+
+	var released atomic.Bool
+	return func() {
+		if released.Swap(true) {
+			return
+		}
+		c.release(key, gen)
+	}, true
+}
+
+// release gives a slot of key back, taken from the bucket of generation
+// gen. The key becomes evictable once it has no request in flight, the
+// idle timeout running from then on.
+func (c *concurrencyLimiter) release(key string, gen uint) {
+	r := c.r
+	// a release must not be lost on a busy shard, so it always waits
+	// for the lock, even WithNonBlocking.
+	r.store.update(context.Background(), key, func(b *Bucket, loaded bool) bool {
+		if !loaded || b.Count != gen || b.Tokens == 0 {
+			// evicted under WithMaxKeys, or removed, in the meantime.
+			// the slot went with the bucket it was taken from.
+			return false
+		}
+		b.Tokens--
+		if t := r.cfg.clock.Now(); t.After(b.LastActivity) {
+			b.LastActivity = t
+		}
+		if b.Tokens == 0 {
+			b.IdleTimeout = 0
+		}
+		return true
+	})
+}
+
+// InFlight returns the number of requests of key holding a slot.
+func (c *concurrencyLimiter) InFlight(key string) uint {
+	b, ok := c.r.store.load(key)
+	if !ok {
+		return 0
+	}
+	return b.Tokens
+}
+
+// Flush evicts the keys without requests in flight idle for at least the
+// idle timeout right away, see the Flush of the rate limiter.
+func (c *concurrencyLimiter) Flush() int {
+	return c.r.Flush()
+}
+
+// Len returns the number of keys tracked, with or without requests in
+// flight.
+func (c *concurrencyLimiter) Len() int {
+	return c.r.Len()
+}
+
+// Stats returns the counters of the limiter, see Stats.
+func (c *concurrencyLimiter) Stats() Stats {
+	return c.r.Stats()
+}
+
+// Close stops the cleanup goroutine. Slots taken before Close can still
+// be released.
+func (c *concurrencyLimiter) Close() {
+	c.r.Close()
+}
@@ -0,0 +1,179 @@
+package ratelimiter
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrency(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := NewConcurrency(2)
+	defer limiter.Close()
+
+	release1, ok := limiter.Acquire("key")
+	if !ok {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	release2, ok := limiter.Acquire("key")
+	if !ok {
+		t.Fatal("expected second request to be allowed, got rejected")
+	}
+	if _, ok := limiter.Acquire("key"); ok {
+		t.Fatal("expected third request to be rejected, got allowed")
+	}
+	if _, ok := limiter.Acquire("other"); !ok {
+		t.Error("expected another key to have its own slots, got rejected")
+	}
+	if n := limiter.InFlight("key"); n != 2 {
+		t.Errorf("expected 2 requests in flight, got %d", n)
+	}
+
+	release1()
+	// releasing twice gives back a single slot
+	release1()
+	if n := limiter.InFlight("key"); n != 1 {
+		t.Errorf("expected 1 request in flight, got %d", n)
+	}
+	if _, ok := limiter.Acquire("key"); !ok {
+		t.Error("expected released slot to be free, got rejected")
+	}
+	if _, ok := limiter.Acquire("key"); ok {
+		t.Error("expected a double release not to free another slot, got allowed")
+	}
+	release2()
+
+	expected := Stats{Allowed: 4, Rejected: 2, Keys: 2}
+	if stats := limiter.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestConcurrencyEviction(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	limiter, _ := NewConcurrency(1, WithClock(clock), WithIdleTimeout(time.Minute))
+	defer limiter.Close()
+
+	release, _ := limiter.Acquire("busy")
+	releaseIdle, _ := limiter.Acquire("idle")
+	releaseIdle()
+
+	clock.Advance(time.Hour)
+	if evicted := limiter.Flush(); evicted != 1 {
+		t.Errorf("expected only the key without requests in flight to be evicted, got %d keys", evicted)
+	}
+	if n := limiter.InFlight("busy"); n != 1 {
+		t.Errorf("expected request in flight to keep its slot, got %d in flight", n)
+	}
+
+	// the idle timeout runs from the release
+	release()
+	clock.Advance(30 * time.Second)
+	if evicted := limiter.Flush(); evicted != 0 {
+		t.Errorf("expected no key to be evicted, got %d", evicted)
+	}
+	clock.Advance(30 * time.Second)
+	if evicted := limiter.Flush(); evicted != 1 {
+		t.Errorf("expected released key to be evicted, got %d keys", evicted)
+	}
+	if n := limiter.Len(); n != 0 {
+		t.Errorf("expected no key left, got %d", n)
+	}
+}
+
+func TestConcurrencyConcurrentSafety(t *testing.T) {
+	t.Parallel()
+
+	const maxInFlight = 4
+	limiter, _ := NewConcurrency(maxInFlight)
+	defer limiter.Close()
+
+	var (
+		wg              sync.WaitGroup
+		inFlight, peak  atomic.Int64
+		allowed, denied atomic.Int64
+	)
+	for range 16 {
+		wg.Go(func() {
+			for range 1000 {
+				release, ok := limiter.Acquire("key")
+				if !ok {
+					denied.Add(1)
+					continue
+				}
+				allowed.Add(1)
+				n := inFlight.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				inFlight.Add(-1)
+				release()
+			}
+		})
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > maxInFlight {
+		t.Errorf("expected at most %d requests in flight, got %d", maxInFlight, p)
+	}
+	if n := limiter.InFlight("key"); n != 0 {
+		t.Errorf("expected every slot to be released, got %d in flight", n)
+	}
+	if total := allowed.Load() + denied.Load(); total != 16000 {
+		t.Errorf("expected 16000 requests, got %d", total)
+	}
+}
+
+func TestConcurrencyReleaseAfterEviction(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := NewConcurrency(1, WithMaxKeys(1))
+	defer limiter.Close()
+
+	releaseOld, _ := limiter.Acquire("a")
+	// "b" evicts "a", and "a" evicts "b" in turn, starting over
+	limiter.Acquire("b")
+	if _, ok := limiter.Acquire("a"); !ok {
+		t.Fatal("expected evicted key to be allowed again, got rejected")
+	}
+
+	releaseOld()
+	if n := limiter.InFlight("a"); n != 1 {
+		t.Errorf("expected a release of the evicted bucket not to free a slot, got %d in flight", n)
+	}
+	if _, ok := limiter.Acquire("a"); ok {
+		t.Error("expected more than maxInFlight requests to be rejected, got allowed")
+	}
+}
+
+func TestConcurrencyZeroBurst(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := NewConcurrency(0, WithZeroBurst(ZeroBurstMinimal))
+	defer limiter.Close()
+
+	if _, ok := limiter.Acquire("key"); !ok {
+		t.Fatal("expected a minimal zero burst to allow one request, got rejected")
+	}
+	if _, ok := limiter.Acquire("key"); ok {
+		t.Error("expected second request to be rejected, got allowed")
+	}
+}
+
+func TestNewConcurrencyWithStore(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewConcurrency(1, WithStore(NewSyncMapStore())); err == nil {
+		t.Error("expected an error for a store, got nil")
+	}
+	if _, err := NewConcurrency(1, WithCleanupInterval(-1)); err == nil {
+		t.Error("expected an error for invalid options, got nil")
+	}
+}
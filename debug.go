@@ -0,0 +1,49 @@
+package ratelimiter
+
+import "time"
+
+// KeyState is the state of a key as reported by Debug.
+type KeyState struct {
+	// Tokens is the number of tokens available, refills included.
+	Tokens uint
+	// LastRefill is when tokens were last added to the bucket.
+	LastRefill time.Time
+	// LastActivity is the time of the last allowed request.
+	LastActivity time.Time
+	// CreatedAt is when the first request of the key was made.
+	CreatedAt time.Time
+	// RetryAfter is how long until a token is available, 0 if one is.
+	RetryAfter time.Duration
+}
+
+// Debug returns the state of every tracked key, e.g. for an admin
+// endpoint dumping the rate limiter during an incident. Every key is
+// brought up to the same instant, read once from the clock, without
+// consuming tokens or tracking keys that are not already tracked.
+//
+// Debug is meant for diagnostics, not hot paths: it materializes a map
+// of every tracked key, costing memory and time proportional to Len,
+// which can be large under a flood of unique keys. Check Len first, or
+// bound the key count with WithMaxKeys, before exposing it. Use ForEach
+// to walk the keys without building a map.
+//
+// Shards are read one at a time, so a request racing with Debug may or
+// may not be reflected in the state of its key.
+func (r *rateLimiter[K]) Debug() map[K]KeyState {
+	states := make(map[K]KeyState, max(0, r.Len()))
+	t := r.cfg.clock.Now()
+	r.store.rangeFunc(func(key K, b Bucket) bool {
+		// b is a copy, bringing it up to date does not change the stored bucket
+		lim := r.limitFor(&b)
+		r.sync(&b, true, lim, t)
+		states[key] = KeyState{
+			Tokens:       r.algo.available(&b, lim, t),
+			LastRefill:   b.LastRefill,
+			LastActivity: b.LastActivity,
+			CreatedAt:    b.CreatedAt,
+			RetryAfter:   r.retryAfter(&b, lim, t, 1),
+		}
+		return true
+	})
+	return states
+}
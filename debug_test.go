@@ -0,0 +1,47 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebug(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	start := clock.Now()
+	rateLimiter.Allow("a")
+	rateLimiter.Allow("b")
+	rateLimiter.Allow("b")
+	clock.Advance(500 * time.Millisecond)
+
+	states := rateLimiter.Debug()
+	if len(states) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(states))
+	}
+	a := states["a"]
+	if a.Tokens != 1 || a.RetryAfter != 0 {
+		t.Errorf("expected 1 token available now, got %d tokens and retry after %v", a.Tokens, a.RetryAfter)
+	}
+	if !a.LastActivity.Equal(start) || !a.LastRefill.Equal(start) {
+		t.Errorf("expected last activity and refill at %v, got %v and %v", start, a.LastActivity, a.LastRefill)
+	}
+	b := states["b"]
+	if b.Tokens != 0 || b.RetryAfter != 500*time.Millisecond {
+		t.Errorf("expected no token for another 500ms, got %d tokens and retry after %v", b.Tokens, b.RetryAfter)
+	}
+
+	// reading the state consumes nothing and tracks no new key
+	if _, ok := states["c"]; ok {
+		t.Error("expected unknown key to be absent, got present")
+	}
+	if n := rateLimiter.Len(); n != 2 {
+		t.Errorf("expected 2 keys tracked, got %d", n)
+	}
+	if tokens := rateLimiter.Tokens("a"); tokens != 1 {
+		t.Errorf("expected debug not to consume tokens, got %d tokens", tokens)
+	}
+}
@@ -0,0 +1,55 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// fixedWindow keeps the start of the current window in LastRefill and the
+// requests made in it in Count.
+type fixedWindow struct{}
+
+func (fixedWindow) init(b *Bucket, lim *Limit, t time.Time) {
+	b.LastRefill = t
+	if w, ok := window(lim); ok {
+		b.LastRefill = t.Truncate(w)
+	}
+	b.Count = 0
+}
+
+func (fixedWindow) advance(b *Bucket, lim *Limit, t time.Time) {
+	w, ok := window(lim)
+	// a clock stepping backwards stays in the current window.
+	if !ok || t.Sub(b.LastRefill) < w {
+		return
+	}
+	b.LastRefill = t.Truncate(w)
+	b.Count = 0
+}
+
+func (fixedWindow) available(b *Bucket, lim *Limit, _ time.Time) uint {
+	if b.Count >= lim.BurstSize {
+		return 0
+	}
+	return lim.BurstSize - b.Count
+}
+
+func (fixedWindow) consume(b *Bucket, _ *Limit, _ time.Time, n uint) {
+	b.Count += n
+}
+
+// refund takes n requests off the current window. If the window has
+// moved on since they were made, requests of the new window are taken off
+// instead.
+func (fixedWindow) refund(b *Bucket, _ *Limit, n uint) {
+	b.Count -= min(n, b.Count)
+}
+
+func (fixedWindow) retryAfter(b *Bucket, lim *Limit, t time.Time, _ uint) time.Duration {
+	w, ok := window(lim)
+	if !ok {
+		return math.MaxInt64
+	}
+	// the whole burst size is available again in the next window
+	return b.LastRefill.Add(w).Sub(t)
+}
@@ -0,0 +1,106 @@
+package ratelimiter
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// globalLimiter is a single bucket shared by every caller, see NewGlobal.
+type globalLimiter struct {
+	mu    sync.Mutex
+	cfg   config
+	algo  algorithm
+	limit Limit
+	b     Bucket
+}
+
+// NewGlobal returns a rate limiter with a single bucket, shared by every
+// caller regardless of who they are, e.g. to protect one resource as a
+// whole. It runs the same algorithms as New, but without keys there is no
+// map to look buckets up in and no cleanup goroutine, so there is nothing
+// to close.
+//
+// As the bucket is never evicted, with a tokenRate of 0 only burstSize
+// requests are ever allowed, or the tokens of WithInitialTokens. Options
+// about keys, like WithMaxKeys or WithStore, have no effect.
+func NewGlobal(tokenRate float64, burstSize uint, opts ...Option) (*globalLimiter, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	burstSize = cfg.burst(burstSize)
+	if err := validate(tokenRate, burstSize, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.initialTokens != nil && *cfg.initialTokens > burstSize {
+		return nil, errors.New("initial tokens should not exceed burst size")
+	}
+
+	g := &globalLimiter{
+		cfg:   cfg,
+		algo:  cfg.algorithm.impl(),
+		limit: Limit{TokenRate: tokenRate, BurstSize: burstSize},
+	}
+	t := cfg.clock.Now()
+	g.algo.init(&g.b, &g.limit, t)
+	if cfg.initialTokens != nil && !math.IsInf(tokenRate, 1) {
+		// start with what WithInitialTokens leaves of a full bucket
+		available := g.algo.available(&g.b, &g.limit, t)
+		g.algo.consume(&g.b, &g.limit, t, available-min(*cfg.initialTokens, available))
+	}
+	return g, nil
+}
+
+// Allow reports whether a request may proceed, consuming one token.
+func (g *globalLimiter) Allow() bool {
+	return g.AllowN(1)
+}
+
+// AllowN is like Allow, but consumes n tokens at once. Either all n are
+// consumed or none is.
+func (g *globalLimiter) AllowN(n uint) bool {
+	if g.cfg.disabled {
+		return true
+	}
+	if g.limit.BurstSize == 0 || n > g.limit.BurstSize {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t := g.cfg.clock.Now()
+	g.sync(t)
+	if g.algo.available(&g.b, &g.limit, t) < n {
+		return false
+	}
+	g.algo.consume(&g.b, &g.limit, t, n)
+	g.b.LastActivity = t
+	return true
+}
+
+// Tokens returns the number of tokens currently available, including the
+// ones refilled since the last request. No token is consumed.
+func (g *globalLimiter) Tokens() uint {
+	if g.cfg.disabled {
+		return g.limit.BurstSize
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t := g.cfg.clock.Now()
+	g.sync(t)
+	return g.algo.available(&g.b, &g.limit, t)
+}
+
+// sync brings the bucket up to date at t. The caller must hold g.mu.
+func (g *globalLimiter) sync(t time.Time) {
+	if math.IsInf(g.limit.TokenRate, 1) {
+		g.algo.init(&g.b, &g.limit, t)
+		return
+	}
+	g.algo.advance(&g.b, &g.limit, t)
+}
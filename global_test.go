@@ -0,0 +1,133 @@
+package ratelimiter
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewGlobal(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewGlobal(-1, 1); err == nil {
+		t.Error("expected error for a negative token rate, but got nil error")
+	}
+
+	clock := newFakeClock()
+	g, err := NewGlobal(2, 2, WithClock(clock)) // one token every 500ms
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !g.Allow() || !g.Allow() {
+		t.Fatal("expected burst to be allowed, got false")
+	}
+	if g.Allow() {
+		t.Error("expected request over the burst to be rejected, got allowed")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if tokens := g.Tokens(); tokens != 1 {
+		t.Errorf("expected 1 token, got %d", tokens)
+	}
+	if !g.Allow() {
+		t.Error("expected request after refill to be allowed, got rejected")
+	}
+	if g.AllowN(3) {
+		t.Error("expected request over burstSize to be rejected, got allowed")
+	}
+}
+
+func TestNewGlobalInitialTokens(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewGlobal(1, 2, WithInitialTokens(3)); err == nil {
+		t.Error("expected error for initial tokens over the burst size, but got nil error")
+	}
+
+	clock := newFakeClock()
+	g, _ := NewGlobal(1, 5, WithClock(clock), WithInitialTokens(1))
+	if tokens := g.Tokens(); tokens != 1 {
+		t.Errorf("expected 1 initial token, got %d", tokens)
+	}
+	if !g.Allow() {
+		t.Fatal("expected initial token to be allowed, got rejected")
+	}
+	if g.Allow() {
+		t.Error("expected request past the initial tokens to be rejected, got allowed")
+	}
+
+	clock.Advance(time.Second)
+	if !g.Allow() {
+		t.Error("expected request after refill to be allowed, got rejected")
+	}
+}
+
+func TestNewGlobalLimits(t *testing.T) {
+	t.Parallel()
+
+	noCapacity, _ := NewGlobal(1, 0)
+	if noCapacity.Allow() {
+		t.Error("expected zero burst to reject, got allowed")
+	}
+
+	unlimited, _ := NewGlobal(math.Inf(1), 1)
+	for range 10 {
+		if !unlimited.Allow() {
+			t.Fatal("expected infinite rate to allow, got rejected")
+		}
+	}
+
+	disabled, _ := NewGlobal(0, 0, WithDisabled(true))
+	if !disabled.Allow() {
+		t.Error("expected disabled limiter to allow, got rejected")
+	}
+
+	for _, algorithm := range allAlgorithms {
+		g, _ := NewGlobal(0, 3, WithAlgorithm(algorithm))
+		allowed := 0
+		for range 5 {
+			if g.Allow() {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("algorithm %d: expected 3 requests allowed, got %d", algorithm, allowed)
+		}
+	}
+}
+
+func TestNewGlobalConcurrentSafety(t *testing.T) {
+	t.Parallel()
+
+	g, _ := NewGlobal(0, 100)
+
+	var (
+		wg      sync.WaitGroup
+		allowed atomic.Int64
+	)
+	for range 20 {
+		wg.Go(func() {
+			for range 10 {
+				if g.Allow() {
+					allowed.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n != 100 {
+		t.Errorf("expected 100 requests allowed, got %d", n)
+	}
+}
+
+func BenchmarkGlobalAllow(b *testing.B) {
+	g, _ := NewGlobal(1000, 10000)
+
+	for b.Loop() {
+		g.Allow()
+	}
+}
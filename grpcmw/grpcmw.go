@@ -0,0 +1,57 @@
+// Package grpcmw rate limits the unary calls of a gRPC server. Install the
+// interceptor when creating the server:
+//
+//	limiter, _ := ratelimiter.New(10, 20)
+//	srv := grpc.NewServer(grpc.UnaryInterceptor(
+//		grpcmw.UnaryServerInterceptor(limiter, nil)))
+//
+// Calls are keyed by the IP address of the peer unless another key
+// function is given, and rejected calls fail with codes.ResourceExhausted.
+package grpcmw
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter decides whether a call for a key may proceed, e.g. the rate
+// limiter returned by ratelimiter.New.
+type Limiter interface {
+	Allow(key string) bool
+}
+
+// PeerKey returns the IP address of the client from the peer stored in
+// ctx, or an empty string if there is none.
+func PeerKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// UnaryServerInterceptor returns an interceptor that calls l.Allow with
+// the key returned by keyFn, and fails the call with
+// codes.ResourceExhausted when it is not allowed. keyFn can pull a tenant
+// ID from incoming metadata, when nil PeerKey is used.
+func UnaryServerInterceptor(l Limiter, keyFn func(context.Context) string) grpc.UnaryServerInterceptor {
+	if keyFn == nil {
+		keyFn = PeerKey
+	}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !l.Allow(keyFn(ctx)) {
+			return nil, status.Errorf(codes.ResourceExhausted, "%s is rate limited", info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
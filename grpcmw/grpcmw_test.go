@@ -0,0 +1,73 @@
+package grpcmw
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	const burstSize = 3
+
+	limiter, _ := ratelimiter.New(0, burstSize)
+	defer limiter.Close()
+
+	tenantKey := func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if tenant := md.Get("tenant"); len(tenant) > 0 {
+			return tenant[0]
+		}
+		return ""
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor(limiter, tenantKey)))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("not expected error but got %v", err)
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "tenant", "acme")
+
+	for range burstSize {
+		if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatalf("expected call to be allowed, got %v", err)
+		}
+	}
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("expected code %v, got %v", codes.ResourceExhausted, code)
+	}
+
+	// other tenants have their own bucket
+	other := metadata.AppendToOutgoingContext(t.Context(), "tenant", "globex")
+	if _, err := client.Check(other, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("expected call of other tenant to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package ratelimiter
+
+// Hierarchy limits requests on two levels, e.g. users within an
+// organization: every child key has its own bucket in the child limiter,
+// and the child keys of a parent key share its bucket in the parent
+// limiter.
+type Hierarchy[P, C comparable] struct {
+	parent *rateLimiter[P]
+	child  *rateLimiter[C]
+}
+
+// NewHierarchy returns a Hierarchy allowing a request only if both parent
+// and child allow it.
+func NewHierarchy[P, C comparable](parent *rateLimiter[P], child *rateLimiter[C]) *Hierarchy[P, C] {
+	return &Hierarchy[P, C]{parent: parent, child: child}
+}
+
+// Allow reports whether a request of childKey within parentKey may
+// proceed, taking a token from both buckets or from neither.
+//
+// The child is asked first, so a throttled child does not spend the
+// tokens its siblings share. If the parent then rejects the request, the
+// token taken from the child is given back with Refund. The limiters are
+// not locked together, so until the refund concurrent requests of the
+// child see its token as consumed, and a token refilled in the meantime
+// cannot be given back. Both limiters count the request in their Stats,
+// the child as allowed even though its token is refunded.
+func (h *Hierarchy[P, C]) Allow(parentKey P, childKey C) bool {
+	if !h.child.Allow(childKey) {
+		return false
+	}
+	if !h.parent.Allow(parentKey) {
+		h.child.Refund(childKey, 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package ratelimiter
+
+import "testing"
+
+func TestHierarchy(t *testing.T) {
+	t.Parallel()
+
+	org, _ := New(0, 3)
+	defer org.Close()
+	user, _ := New(0, 2)
+	defer user.Close()
+
+	h := NewHierarchy(org, user)
+
+	for range 2 {
+		if !h.Allow("acme", "alice") {
+			t.Fatal("expected request within both limits to be allowed, got rejected")
+		}
+	}
+	// alice is out of tokens, the organization keeps its last one
+	if h.Allow("acme", "alice") {
+		t.Fatal("expected request over the user limit to be rejected, got allowed")
+	}
+	if tokens := org.Tokens("acme"); tokens != 1 {
+		t.Errorf("expected organization to keep 1 token, got %d", tokens)
+	}
+
+	if !h.Allow("acme", "bob") {
+		t.Fatal("expected request of another user to be allowed, got rejected")
+	}
+	// the organization is out of tokens, the token of bob is refunded
+	if h.Allow("acme", "bob") {
+		t.Fatal("expected request over the organization limit to be rejected, got allowed")
+	}
+	if tokens := user.Tokens("bob"); tokens != 1 {
+		t.Errorf("expected refunded user to have 1 token, got %d", tokens)
+	}
+
+	if !h.Allow("globex", "bob") {
+		t.Error("expected request in another organization to be allowed, got rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// leakyBucket keeps the water level in Count and the time of the last
+// leak in LastRefill.
+type leakyBucket struct{}
+
+func (leakyBucket) init(b *Bucket, _ *Limit, t time.Time) {
+	b.Count = 0
+	b.LastRefill = t
+}
+
+func (leakyBucket) advance(b *Bucket, lim *Limit, t time.Time) {
+	// a clock stepping backwards leaks nothing
+	leaked := lim.tokensIn(max(0, t.Sub(b.LastRefill)))
+	if leaked >= float64(b.Count) {
+		// bucket is empty, time spent while empty does not count
+		// towards the next leak.
+		b.Count = 0
+		b.LastRefill = t
+	} else if units := uint(leaked); units > 0 {
+		b.Count -= units
+		// as with refill, the time of a partially leaked unit is kept
+		// for the next call.
+		b.LastRefill = b.LastRefill.Add(lim.every(units))
+	}
+}
+
+func (leakyBucket) available(b *Bucket, lim *Limit, _ time.Time) uint {
+	if b.Count >= lim.BurstSize {
+		return 0
+	}
+	return lim.BurstSize - b.Count
+}
+
+func (leakyBucket) consume(b *Bucket, _ *Limit, _ time.Time, n uint) {
+	b.Count += n
+}
+
+func (leakyBucket) refund(b *Bucket, _ *Limit, n uint) {
+	b.Count -= min(n, b.Count)
+}
+
+func (leakyBucket) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	// the level has to drop to burstSize-n
+	units := b.Count - (lim.BurstSize - n)
+	w := lim.every(units)
+	if w == math.MaxInt64 {
+		return w
+	}
+	return b.LastRefill.Add(w).Sub(t)
+}
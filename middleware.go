@@ -0,0 +1,228 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MiddlewareOption configures the handler returned by Middleware.
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	// reject serves rejected requests, set by WithRejectHandler or
+	// WithRejectFunc
+	reject func(w http.ResponseWriter, req *http.Request, retryAfter time.Duration)
+	costFn func(*http.Request) uint
+	// allowlist is parsed from the CIDRs passed to WithAllowlist
+	allowlist []netip.Prefix
+	clientIP  func(*http.Request) string
+}
+
+// WithRejectHandler sets the handler serving rejected requests, to
+// customize the status, headers or body of the response. By default
+// rejected requests get a plain text 429 Too Many Requests.
+func WithRejectHandler(h http.Handler) MiddlewareOption {
+	return func(cfg *middlewareConfig) {
+		cfg.reject = func(w http.ResponseWriter, req *http.Request, _ time.Duration) {
+			h.ServeHTTP(w, req)
+		}
+	}
+}
+
+// WithRejectFunc is like WithRejectHandler, but fn is also given how long
+// until the tokens of the request are available, as computed for its
+// Retry-After header, e.g. to render it in a JSON body or to pick a 503
+// for some routes. retryAfter is math.MaxInt64 if the request can never
+// be allowed. The last of WithRejectHandler and WithRejectFunc wins.
+func WithRejectFunc(fn func(w http.ResponseWriter, req *http.Request, retryAfter time.Duration)) MiddlewareOption {
+	return func(cfg *middlewareConfig) {
+		cfg.reject = fn
+	}
+}
+
+// WithCostFunc sets the number of tokens a request consumes to the value
+// returned by fn, e.g. proportional to the size of its payload. By default
+// every request costs one token. A cost of 0 lets the request through
+// without consuming a token, and a cost above the burst size is always
+// rejected.
+func WithCostFunc(fn func(*http.Request) uint) MiddlewareOption {
+	return func(cfg *middlewareConfig) {
+		cfg.costFn = fn
+	}
+}
+
+// WithAllowlist lets requests from the networks in cidrs through without
+// rate limiting them, e.g. internal services or health checkers. cidrs are
+// parsed once, a bare IP address standing for itself. The client IP is
+// taken with clientIP, IPKey when nil. It returns an error if a CIDR is
+// malformed, like ForwardedIPKey. A client IP that does not parse never
+// matches.
+func WithAllowlist(cidrs []string, clientIP func(*http.Request) string) (MiddlewareOption, error) {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return func(cfg *middlewareConfig) {
+		cfg.allowlist = prefixes
+		cfg.clientIP = clientIP
+	}, nil
+}
+
+// IPKey returns the client IP of req taken from RemoteAddr, dropping the
+// port. If RemoteAddr is not a host:port pair it is returned as is.
+func IPKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedIPKey returns a key function taking the client IP from the
+// X-Forwarded-For header of requests that come through one of the proxies
+// in trustedProxies, CIDRs or bare IP addresses. The header is read from
+// the right, skipping the trusted proxies, so a client cannot pick its
+// key by sending a forged header. Requests from other peers, or without
+// the header, are keyed by IPKey. It returns an error if a CIDR is
+// malformed.
+func ForwardedIPKey(trustedProxies []string) (func(*http.Request) string, error) {
+	trusted, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) string {
+		ip := IPKey(req)
+		if !containsIP(trusted, ip) {
+			return ip
+		}
+		// the header may be repeated, later values were appended by
+		// later proxies.
+		hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !containsIP(trusted, ip) {
+				break
+			}
+		}
+		return ip
+	}, nil
+}
+
+// parsePrefixes parses cidrs, a bare IP address standing for a network of
+// itself only.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsIP reports whether ip is in one of prefixes. IPv4 addresses
+// mapped into IPv6 match IPv4 prefixes, and IPv6 zones are ignored.
+func containsIP(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns an HTTP middleware that calls AllowN with the key
+// extracted by keyFn and the cost set by WithCostFunc, and rejects the
+// request with 429 Too Many Requests when it is not allowed. When keyFn
+// is nil, IPKey is used, which is only possible for string keys:
+// Middleware panics if keyFn is nil and K is not string.
+//
+// Rejected responses carry a Retry-After header with the number of
+// seconds until the tokens of the request are available, along with
+// X-RateLimit-Limit and X-RateLimit-Remaining headers. They are set
+// before the handler of WithRejectHandler or WithRejectFunc runs, so it
+// may override them.
+//
+// Requests the rate limiter fails to decide, e.g. once it is closed, when
+// the request context is done, or on ErrBusy WithNonBlocking, get a 503
+// Service Unavailable without those headers, and are not passed to the
+// reject handler.
+//
+// An empty key is not special cased, all requests with an empty key, or
+// the zero value of K, share a single bucket.
+func (r *rateLimiter[K]) Middleware(keyFn func(*http.Request) K, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	if keyFn == nil {
+		ipKey, ok := any(IPKey).(func(*http.Request) K)
+		if !ok {
+			panic("ratelimiter: Middleware needs a keyFn for keys other than string")
+		}
+		keyFn = ipKey
+	}
+
+	cfg := middlewareConfig{
+		reject: func(w http.ResponseWriter, _ *http.Request, _ time.Duration) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.clientIP == nil {
+		cfg.clientIP = IPKey
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if len(cfg.allowlist) > 0 && containsIP(cfg.allowlist, cfg.clientIP(req)) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			key := keyFn(req)
+			var cost uint = 1
+			if cfg.costFn != nil {
+				cost = cfg.costFn(req)
+			}
+			res, err := r.allow(req.Context(), key, request{n: cost})
+			if err != nil {
+				// no decision was made, there is no limit to report
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if !res.Allowed {
+				h := w.Header()
+				h.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(res.RetryAfter.Seconds())), 10))
+				h.Set("X-RateLimit-Limit", strconv.FormatUint(uint64(res.Limit), 10))
+				h.Set("X-RateLimit-Remaining", strconv.FormatUint(uint64(res.Remaining), 10))
+				cfg.reject(w, req, res.RetryAfter)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
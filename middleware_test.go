@@ -0,0 +1,435 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimiter.Middleware(nil)(next)
+
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		status     int
+	}{
+		{
+			name:       "first request of client",
+			remoteAddr: "10.0.0.1:1234",
+			status:     http.StatusOK,
+		},
+		{
+			name:       "second request from another port",
+			remoteAddr: "10.0.0.1:5678",
+			status:     http.StatusOK,
+		},
+		{
+			name:       "third request exceeds burst",
+			remoteAddr: "10.0.0.1:1234",
+			status:     http.StatusTooManyRequests,
+		},
+		{
+			name:       "other client has its own bucket",
+			remoteAddr: "[2001:db8::1]:1234",
+			status:     http.StatusOK,
+		},
+	}
+
+	for _, tc := range tcs {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+}
+
+func TestMiddlewareError(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	rateLimiter.Close()
+
+	rejected := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimiter.Middleware(nil, WithRejectFunc(func(w http.ResponseWriter, _ *http.Request, _ time.Duration) {
+		rejected = true
+	}))(next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d for a closed rate limiter, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	for _, name := range []string{"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining"} {
+		if v := rec.Header().Get(name); v != "" {
+			t.Errorf("expected no %s header, got %q", name, v)
+		}
+	}
+	if rejected {
+		t.Error("expected reject func not to be called, but it was")
+	}
+}
+
+func TestMiddlewareRejectHandler(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	reject := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":"slow down"}`))
+	})
+	keyFn := func(req *http.Request) string {
+		return req.Header.Get("X-API-Key")
+	}
+	handler := rateLimiter.Middleware(keyFn, WithRejectHandler(reject))(next)
+
+	for i, status := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", "key")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != status {
+			t.Errorf("request %d: expected status %d, got %d", i, status, rec.Code)
+		}
+	}
+}
+
+func TestMiddlewareRejectFunc(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(0.5, 1, WithClock(clock)) // one token every 2 seconds
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	var retryAfters []time.Duration
+	reject := func(w http.ResponseWriter, _ *http.Request, retryAfter time.Duration) {
+		retryAfters = append(retryAfters, retryAfter)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"retry_after_ms":%d}`, retryAfter.Milliseconds())
+	}
+	handler := rateLimiter.Middleware(nil, WithRejectFunc(reject))(next)
+
+	var rec *httptest.ResponseRecorder
+	for range 2 {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		clock.Advance(500 * time.Millisecond)
+	}
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if len(retryAfters) != 1 || retryAfters[0] != 1500*time.Millisecond {
+		t.Errorf("expected reject func to get a retry after of 1.5s, got %v", retryAfters)
+	}
+	if body := rec.Body.String(); body != `{"retry_after_ms":1500}` {
+		t.Errorf("expected custom body, got %q", body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected header Retry-After to be %q, got %q", "2", got)
+	}
+}
+
+func TestMiddlewareHeaders(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0.5, 3) // one token every 2 seconds
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimiter.Middleware(nil)(next)
+
+	var rec *httptest.ResponseRecorder
+	for range 4 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+	}
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	headers := map[string]string{
+		"Retry-After":           "2",
+		"X-RateLimit-Limit":     "3",
+		"X-RateLimit-Remaining": "0",
+	}
+	for name, value := range headers {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("expected header %s to be %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestMiddlewareCostFunc(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 10)
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimiter.Middleware(nil, WithCostFunc(func(req *http.Request) uint {
+		return uint(req.ContentLength)
+	}))(next)
+
+	tcs := []struct {
+		name       string
+		body       string
+		status     int
+		retryAfter string
+	}{
+		{
+			name:   "request costing 6 tokens",
+			body:   "abcdef",
+			status: http.StatusOK,
+		},
+		{
+			name:       "request costing more than the 4 tokens left",
+			body:       "abcdef",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "2",
+		},
+		{
+			name:   "request costing 0 tokens",
+			body:   "",
+			status: http.StatusOK,
+		},
+		{
+			name:   "request costing the 4 tokens left",
+			body:   "abcd",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tcs {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("%s: expected Retry-After %q, got %q", tc.name, tc.retryAfter, got)
+		}
+	}
+}
+
+func TestMiddlewareKeyed(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := NewKeyed[int](0, 1)
+	defer rateLimiter.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected nil keyFn with int keys to panic, but it didn't")
+			}
+		}()
+		rateLimiter.Middleware(nil)
+	}()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := rateLimiter.Middleware(func(req *http.Request) int {
+		return len(req.URL.Path)
+	})(next)
+
+	for _, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a", nil))
+		if rec.Code != status {
+			t.Errorf("expected status %d, got %d", status, rec.Code)
+		}
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		remoteAddr string
+		key        string
+	}{
+		{remoteAddr: "192.0.2.1:1234", key: "192.0.2.1"},
+		{remoteAddr: "[2001:db8::1]:443", key: "2001:db8::1"},
+		{remoteAddr: "malformed", key: "malformed"},
+		{remoteAddr: "", key: ""},
+	}
+
+	for _, tc := range tcs {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if key := IPKey(req); key != tc.key {
+			t.Errorf("expected key %q for remote addr %q, got %q", tc.key, tc.remoteAddr, key)
+		}
+	}
+}
+
+func TestForwardedIPKey(t *testing.T) {
+	t.Parallel()
+
+	if _, err := ForwardedIPKey([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected error for a malformed CIDR, but got nil error")
+	}
+
+	keyFn, err := ForwardedIPKey([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		key        string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "198.51.100.1:1234",
+			forwarded:  []string{"203.0.113.7"},
+			key:        "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{"203.0.113.7"},
+			key:        "203.0.113.7",
+		},
+		{
+			name:       "forged entry before the client",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{"1.1.1.1, 203.0.113.7, 10.9.9.9"},
+			key:        "203.0.113.7",
+		},
+		{
+			name:       "repeated header",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"203.0.113.7", "10.9.9.9"},
+			key:        "203.0.113.7",
+		},
+		{
+			name:       "ipv6 proxy",
+			remoteAddr: "[2001:db8::1]:443",
+			forwarded:  []string{"2001:db9::7"},
+			key:        "2001:db9::7",
+		},
+		{
+			name:       "empty header",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{""},
+			key:        "10.1.2.3",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  []string{"10.0.0.1"},
+			key:        "10.0.0.1",
+		},
+		{
+			name:       "malformed remote addr",
+			remoteAddr: "malformed",
+			forwarded:  []string{"203.0.113.7"},
+			key:        "malformed",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if key := keyFn(req); key != tc.key {
+				t.Errorf("expected key %q, got %q", tc.key, key)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAllowlist(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	allowlist, err := WithAllowlist([]string{"10.0.0.0/8", "2001:db8::/32"}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	handler := rateLimiter.Middleware(nil, allowlist)(next)
+
+	tcs := []struct {
+		remoteAddr string
+		statuses   []int
+	}{
+		{remoteAddr: "10.1.2.3:1234", statuses: []int{http.StatusOK, http.StatusOK}},
+		{remoteAddr: "[::ffff:10.1.2.3]:1234", statuses: []int{http.StatusOK, http.StatusOK}},
+		{remoteAddr: "[2001:db8::1]:443", statuses: []int{http.StatusOK, http.StatusOK}},
+		{remoteAddr: "198.51.100.1:1234", statuses: []int{http.StatusOK, http.StatusTooManyRequests}},
+		{remoteAddr: "malformed", statuses: []int{http.StatusOK, http.StatusTooManyRequests}},
+	}
+
+	for _, tc := range tcs {
+		for _, status := range tc.statuses {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != status {
+				t.Errorf("expected status %d for %q, got %d", status, tc.remoteAddr, rec.Code)
+			}
+		}
+	}
+	if n := rateLimiter.Len(); n != 2 {
+		t.Errorf("expected allowlisted clients not to be tracked, got %d keys", n)
+	}
+
+	if _, err := WithAllowlist([]string{"not a cidr"}, nil); err == nil {
+		t.Error("expected error for a malformed CIDR, but got nil error")
+	}
+}
@@ -0,0 +1,56 @@
+package ratelimiter
+
+// MultiLimiter combines rate limiters, allowing a request if all of them
+// do, see All, or if any of them does, see Any.
+type MultiLimiter[K comparable] struct {
+	limiters []*rateLimiter[K]
+	all      bool
+}
+
+// All returns a MultiLimiter allowing a request only if every limiter
+// allows it, e.g. to enforce a per second and a per day limit together.
+//
+// Limiters are asked in order and the first rejection stops the request:
+// the tokens already taken from the earlier limiters are given back with
+// Refund, and later limiters are not asked. Limiters are not locked
+// together, so until the refund concurrent requests see those tokens as
+// consumed, and a token refilled in the meantime cannot be given back.
+// Every limiter asked counts the request in its Stats, an earlier limiter
+// as allowed even though its token is refunded.
+func All[K comparable](limiters ...*rateLimiter[K]) *MultiLimiter[K] {
+	return &MultiLimiter[K]{limiters: limiters, all: true}
+}
+
+// Any returns a MultiLimiter allowing a request if one of the limiters
+// allows it, e.g. to fall back on a shared pool once a dedicated quota is
+// spent.
+//
+// Limiters are asked in order and the first one allowing the request
+// stops it, so a token is taken from that limiter only. The limiters
+// asked before count the request as rejected in their Stats.
+func Any[K comparable](limiters ...*rateLimiter[K]) *MultiLimiter[K] {
+	return &MultiLimiter[K]{limiters: limiters}
+}
+
+// Allow reports whether a request for key may proceed. All without
+// limiters allows every request and Any without limiters none.
+func (m *MultiLimiter[K]) Allow(key K) bool {
+	if !m.all {
+		for _, r := range m.limiters {
+			if r.Allow(key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, r := range m.limiters {
+		if !r.Allow(key) {
+			for _, allowed := range m.limiters[:i] {
+				allowed.Refund(key, 1)
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package ratelimiter
+
+import "testing"
+
+func TestMultiLimiterAll(t *testing.T) {
+	t.Parallel()
+
+	perSecond, _ := New(0, 3)
+	defer perSecond.Close()
+	perDay, _ := New(0, 1)
+	defer perDay.Close()
+
+	m := All(perSecond, perDay)
+
+	if !m.Allow("key") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if m.Allow("key") {
+		t.Fatal("expected request over the daily limit to be rejected, got allowed")
+	}
+	// the token taken from perSecond by the rejected request is refunded
+	if tokens := perSecond.Tokens("key"); tokens != 2 {
+		t.Errorf("expected 2 tokens after refund, got %d", tokens)
+	}
+
+	if !All[string]().Allow("key") {
+		t.Error("expected All without limiters to allow, got rejected")
+	}
+}
+
+func TestMultiLimiterAny(t *testing.T) {
+	t.Parallel()
+
+	dedicated, _ := New(0, 1)
+	defer dedicated.Close()
+	shared, _ := New(0, 1)
+	defer shared.Close()
+
+	m := Any(dedicated, shared)
+
+	if !m.Allow("key") {
+		t.Fatal("expected request on the dedicated quota to be allowed, got rejected")
+	}
+	if tokens := shared.Tokens("key"); tokens != 1 {
+		t.Errorf("expected shared pool to be untouched, got %d tokens", tokens)
+	}
+	if !m.Allow("key") {
+		t.Fatal("expected request on the shared pool to be allowed, got rejected")
+	}
+	if m.Allow("key") {
+		t.Error("expected request to be rejected once both are spent, got allowed")
+	}
+
+	if Any[string]().Allow("key") {
+		t.Error("expected Any without limiters to reject, got allowed")
+	}
+}
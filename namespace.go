@@ -0,0 +1,64 @@
+package ratelimiter
+
+import (
+	"strconv"
+	"time"
+)
+
+// Scoped is a view of a rate limiter whose keys are put in a namespace,
+// see Namespace.
+type Scoped struct {
+	r *rateLimiter[string]
+	// ns is the encoded prefix put in front of every key.
+	ns string
+}
+
+// Namespace returns a view of the rate limiter keeping its keys apart
+// from the keys of other namespaces, e.g. one per tenant of a shared
+// rate limiter. Views share the buckets, limits, cleanup goroutine and
+// Stats of the rate limiter, they only rewrite keys.
+//
+// Keys are prefixed with the length of prefix and prefix itself, so no
+// key can reach into another namespace whatever it contains. Keys passed
+// to the rate limiter directly are not namespaced though, and could
+// collide with namespaced ones: use either, not both. Namespace panics if
+// the key type is not string.
+func (r *rateLimiter[K]) Namespace(prefix string) *Scoped {
+	rs, ok := any(r).(*rateLimiter[string])
+	if !ok {
+		panic("ratelimiter: Namespace needs string keys")
+	}
+	return &Scoped{r: rs, ns: strconv.Itoa(len(prefix)) + ":" + prefix}
+}
+
+// key returns the key of the rate limiter standing for key.
+func (s *Scoped) key(key string) string {
+	return s.ns + key
+}
+
+// Allow is like the Allow of the rate limiter, for key in the namespace.
+func (s *Scoped) Allow(key string) bool {
+	return s.r.Allow(s.key(key))
+}
+
+// AllowN is like the AllowN of the rate limiter, for key in the namespace.
+func (s *Scoped) AllowN(key string, n uint) bool {
+	return s.r.AllowN(s.key(key), n)
+}
+
+// Tokens is like the Tokens of the rate limiter, for key in the namespace.
+func (s *Scoped) Tokens(key string) uint {
+	return s.r.Tokens(s.key(key))
+}
+
+// RetryAfter is like the RetryAfter of the rate limiter, for key in the
+// namespace.
+func (s *Scoped) RetryAfter(key string) time.Duration {
+	return s.r.RetryAfter(s.key(key))
+}
+
+// Remove is like the Remove of the rate limiter, for key in the
+// namespace.
+func (s *Scoped) Remove(key string) bool {
+	return s.r.Remove(s.key(key))
+}
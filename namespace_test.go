@@ -0,0 +1,39 @@
+package ratelimiter
+
+import "testing"
+
+func TestNamespace(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	acme := rateLimiter.Namespace("acme")
+	globex := rateLimiter.Namespace("globex")
+
+	if !acme.Allow("alice") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if acme.Allow("alice") {
+		t.Fatal("expected second request to be rejected, got allowed")
+	}
+	if !globex.Allow("alice") {
+		t.Error("expected the same key in another namespace to have its own bucket, got rejected")
+	}
+
+	// a key cannot reach into another namespace through a separator
+	a, ab := rateLimiter.Namespace("a"), rateLimiter.Namespace("a:b")
+	if !ab.Allow("c") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if !a.Allow("b:c") {
+		t.Error("expected key containing the separator to stay in its namespace, got rejected")
+	}
+
+	if n := rateLimiter.Len(); n != 4 {
+		t.Errorf("expected namespaces to share the rate limiter, got %d keys", n)
+	}
+	if !acme.Remove("alice") || !acme.Allow("alice") {
+		t.Error("expected removed key to be allowed again, got rejected")
+	}
+}
@@ -0,0 +1,290 @@
+package ratelimiter
+
+import "time"
+
+const (
+	defaultCleanupInterval = 5 * time.Minute
+	defaultIdleTimeout     = time.Hour
+)
+
+type config struct {
+	clock           Clock
+	cleanupInterval time.Duration
+	// cleanupWorkers is set by WithCleanupWorkers, 0 means the default
+	cleanupWorkers  int
+	idleTimeout     time.Duration
+	shards          int
+	nonBlocking     bool
+	noCleanup       bool
+	maxKeys         int
+	initialCapacity int
+	store           Store
+	maxRetries      int
+	queueDepth      int
+	disabled        bool
+	algorithm       Algorithm
+	// onEvict is the func(key K) passed to WithOnEvict
+	onEvict any
+	// onReject is the func(key K) passed to WithOnReject
+	onReject any
+	// onContention is the func(key K) passed to WithOnContention
+	onContention any
+	// hasher is the hash passed to WithHasher, nil means maphash
+	hasher func(key string) uint64
+	// tier is the burst tier of NewTiered, nil for other rate limiters
+	tier *Limit
+	// initialTokens is set by WithInitialTokens, nil means new keys
+	// start with a full bucket
+	initialTokens *uint
+	zeroBurst     ZeroBurst
+	// refillInterval is set by WithRefillInterval, nil means the token
+	// rate passed to New applies
+	refillInterval *time.Duration
+	// retryBackoff is set by WithRetryBackoff, nil means compare and
+	// swap updates retry immediately
+	retryBackoff *time.Duration
+	// jitter is the fraction passed to WithJitter
+	jitter float64
+	// aimdDecrease, aimdIncrease and aimdMin are the parameters passed
+	// to WithAIMD
+	aimdDecrease float64
+	aimdIncrease float64
+	aimdMin      float64
+}
+
+// Option configures a rate limiter created by New.
+type Option func(*config)
+
+func defaultConfig() config {
+	return config{
+		clock:           realClock{},
+		cleanupInterval: defaultCleanupInterval,
+		idleTimeout:     defaultIdleTimeout,
+		shards:          defaultShards,
+		maxRetries:      defaultCASRetries,
+		aimdDecrease:    defaultAIMDDecrease,
+		aimdIncrease:    defaultAIMDIncrease,
+		aimdMin:         defaultAIMDMin,
+	}
+}
+
+// WithClock makes the rate limiter read time from c instead of the
+// system clock. This is useful for deterministic simulations and tests.
+// See Clock for how the rate limiter copes with a clock that steps.
+func WithClock(c Clock) Option {
+	return func(cfg *config) {
+		if c != nil {
+			cfg.clock = c
+		}
+	}
+}
+
+// WithCleanupInterval sets how often the background goroutine scans for
+// idle keys. Defaults to 5 minutes.
+func WithCleanupInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.cleanupInterval = d
+	}
+}
+
+// WithCleanupWorkers sets how many goroutines sweep the shards for idle
+// keys, in the background and in Flush, each locking one shard at a time,
+// so that sweeping millions of keys does not fall behind on a single core.
+// Defaults to the smaller of the shard count and GOMAXPROCS at the time
+// New is called. It has no effect with WithStore.
+func WithCleanupWorkers(n int) Option {
+	return func(cfg *config) {
+		cfg.cleanupWorkers = n
+	}
+}
+
+// WithoutBackgroundCleanup makes New not start the cleanup goroutine,
+// e.g. for short lived programs or leak checking tests. Idle keys are
+// then only evicted by calling Flush, which is up to the caller, and
+// Close only stops the rate limiter from allowing requests.
+func WithoutBackgroundCleanup() Option {
+	return func(cfg *config) {
+		cfg.noCleanup = true
+	}
+}
+
+// WithIdleTimeout sets how long a key may go without an allowed request
+// before it is evicted. Defaults to 1 hour. Keys passed to AllowWithTTL
+// use their own idle timeout instead.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.idleTimeout = d
+	}
+}
+
+// WithShards sets the number of shards the key space is split into.
+// Each shard has its own lock, so more shards means less contention
+// between goroutines working on different keys. n must be a power of
+// two, New fails otherwise: the shard of a key is picked by masking the
+// low bits of its hash. Defaults to 256.
+func WithShards(n int) Option {
+	return func(cfg *config) {
+		cfg.shards = n
+	}
+}
+
+// WithHasher sets the hash picking the shard of a key, e.g. one tuned to
+// keys sharing a long common prefix, in place of the default seeded
+// maphash. Only the low bits of the hash select the shard, log2 of the
+// shard count of them, so they must be evenly distributed over the keys:
+// keys crowding into a few shards contend for their locks again. hash
+// must be deterministic. It is only supported when K is string, New
+// fails otherwise, and has no effect with WithStore.
+func WithHasher(hash func(key string) uint64) Option {
+	return func(cfg *config) {
+		cfg.hasher = hash
+	}
+}
+
+// WithNonBlocking makes requests give up rather than wait when the shard
+// of their key is locked by another request, e.g. on latency critical
+// paths that prefer dropping a request to queueing behind a hot shard.
+// Such requests are denied: Allow and its variants return false, AllowCtx
+// and AllowE return ErrBusy. They are counted in Stats as Busy, not as
+// Rejected. Requests for different keys of the same shard contend too,
+// see WithShards. Refund, Report and Restore still wait for the lock. It
+// has no effect with WithStore, whose updates never wait for a lock.
+// Defaults to false.
+func WithNonBlocking(nonBlocking bool) Option {
+	return func(cfg *config) {
+		cfg.nonBlocking = nonBlocking
+	}
+}
+
+// WithMaxKeys caps the number of keys tracked at once. When a new key
+// arrives and the cap is reached, the key closest to expiring is evicted
+// to make room, bounding memory even when a client floods the limiter with
+// unique keys. Unless AllowWithTTL is used, that is the least recently
+// active key. Zero, the default, means no cap.
+func WithMaxKeys(n int) Option {
+	return func(cfg *config) {
+		cfg.maxKeys = n
+	}
+}
+
+// WithInitialCapacity preallocates room for n keys, spread evenly over
+// the shards, so that a cold start under a traffic spike does not grow
+// the maps key by key. It is only a hint: more keys are still tracked,
+// and fewer leave the memory allocated. It has no effect on a Store
+// passed to WithStore. Defaults to 0.
+func WithInitialCapacity(n int) Option {
+	return func(cfg *config) {
+		cfg.initialCapacity = n
+	}
+}
+
+// WithDisabled turns the rate limiter into one that allows every request
+// when disabled is true, e.g. for local development or trusted traffic.
+// Allow returns true without tracking keys and no cleanup goroutine is
+// started, also when burstSize is 0.
+func WithDisabled(disabled bool) Option {
+	return func(cfg *config) {
+		cfg.disabled = disabled
+	}
+}
+
+// WithOnEvict sets fn to be called with every key evicted, because it was
+// idle for the idle timeout or to make room under WithMaxKeys, e.g. to
+// record how long keys stay active. Explicit Remove and Reset calls do
+// not call fn. K must be the key type of the rate limiter, New fails
+// otherwise.
+//
+// fn is called after the key is deleted and outside of any lock, so it
+// may call back into the rate limiter. It runs on the goroutine doing
+// the eviction: the cleanup goroutine, a caller of Flush, or the Allow
+// call inserting a key over WithMaxKeys, which it delays. Slow work
+// should be handed off to another goroutine.
+func WithOnEvict[K comparable](fn func(key K)) Option {
+	return func(cfg *config) {
+		cfg.onEvict = fn
+	}
+}
+
+// WithOnReject sets fn to be called with the key of every request the
+// rate limiter denies, e.g. to log throttling events. Together with
+// WithOnEvict it covers the lifecycle of a key. K must be the key type of
+// the rate limiter, New fails otherwise.
+//
+// fn is called synchronously on the goroutine of the denied request,
+// outside of any lock, so it adds to the latency of every rejection and
+// must be kept cheap: sample, or hand off to another goroutine, rather
+// than write a log line for every call under a flood. Requests failing
+// with an error, e.g. on a closed rate limiter, do not call fn.
+func WithOnReject[K comparable](fn func(key K)) Option {
+	return func(cfg *config) {
+		cfg.onReject = fn
+	}
+}
+
+// WithInitialTokens makes new keys start with n tokens instead of a full
+// bucket of burstSize tokens, so that a fresh client has to earn its
+// burst over time, e.g. to slow down abuse from newly seen keys. n must
+// not exceed burstSize, New fails otherwise. A key whose first request is
+// rejected is tracked from then on and refills like any other key.
+func WithInitialTokens(n uint) Option {
+	return func(cfg *config) {
+		cfg.initialTokens = &n
+	}
+}
+
+// WithRefillInterval adds one token every d to the buckets, in place of
+// the token rate passed to New, like NewEvery. d must be positive, New
+// fails otherwise.
+func WithRefillInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.refillInterval = &d
+	}
+}
+
+// WithJitter adds a random delay of up to fraction of the base delay to
+// the retry after reported by RetryAfter and AllowResult, and sent in the
+// Retry-After header by Middleware, e.g. 0.2 for up to 20% more. Clients
+// rejected at the same instant then spread their retries instead of all
+// coming back together. Token accounting is unaffected: the jitter only
+// delays clients honouring the advice, it grants no one an earlier token.
+// fraction must be between 0 and 1, New fails otherwise. Defaults to 0.
+func WithJitter(fraction float64) Option {
+	return func(cfg *config) {
+		cfg.jitter = fraction
+	}
+}
+
+// ZeroBurst selects what a burst size of 0 means, see WithZeroBurst.
+type ZeroBurst int
+
+const (
+	// ZeroBurstReject makes a burst size of 0 reject every request,
+	// whatever the token rate. It is the default.
+	ZeroBurstReject ZeroBurst = iota
+	// ZeroBurstMinimal makes a burst size of 0 stand for a burst size of
+	// 1: no bursting, but requests are still allowed at the token rate.
+	ZeroBurstMinimal
+	// ZeroBurstInvalid makes a burst size of 0 fail validation, so that
+	// New, SetBurst and AllowWithLimit catch a burst size left unset.
+	ZeroBurstInvalid
+)
+
+// WithZeroBurst sets what a burst size of 0 passed to New, SetBurst or
+// AllowWithLimit means. By default, ZeroBurstReject, every request is
+// rejected even with a positive token rate, which is rarely what a
+// limiter configured from a zero value wants: pick ZeroBurstMinimal to
+// allow requests at the token rate, or ZeroBurstInvalid to fail loudly.
+func WithZeroBurst(z ZeroBurst) Option {
+	return func(cfg *config) {
+		cfg.zeroBurst = z
+	}
+}
+
+// burst returns the burst size standing for burstSize, 1 for a burst
+// size of 0 under ZeroBurstMinimal.
+func (cfg config) burst(burstSize uint) uint {
+	if burstSize == 0 && cfg.zeroBurst == ZeroBurstMinimal {
+		return 1
+	}
+	return burstSize
+}
@@ -0,0 +1,66 @@
+// Package otel records the decisions of a rate limiter as events on
+// OpenTelemetry spans. Call Allow in place of the rate limiter, with the
+// context carrying the span of the request:
+//
+//	ok, err := otel.Allow(ctx, limiter, key)
+//
+// The events tell allowed requests from rejected ones and carry the key
+// and the state of its bucket, so that a trace shows why a request was
+// turned away.
+package otel
+
+import (
+	"context"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event names recorded on the span.
+const (
+	EventAllowed  = "rate_limit.allowed"
+	EventRejected = "rate_limit.rejected"
+)
+
+// Limiter makes the decisions Allow records, e.g. the rate limiter
+// returned by ratelimiter.New.
+type Limiter interface {
+	AllowResultCtx(ctx context.Context, key string) (ratelimiter.Result, error)
+}
+
+// Allow reports whether a request for key may proceed, like
+// l.AllowResultCtx(ctx, key), and records the decision as an EventAllowed
+// or EventRejected event on the span of ctx, with the key, the tokens
+// remaining and the burst size as attributes. Without a recording span in
+// ctx, it is a plain call to l.
+//
+// An error of l, e.g. ErrClosed or a canceled ctx, is not a decision: it
+// is returned along with false, and recorded on the span as an error
+// rather than as EventRejected.
+func Allow(ctx context.Context, l Limiter, key string) (bool, error) {
+	res, err := l.AllowResultCtx(ctx, key)
+
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return res.Allowed, err
+	}
+	if err != nil {
+		span.RecordError(err, trace.WithAttributes(attribute.String("rate_limit.key", key)))
+		return false, err
+	}
+
+	name := EventRejected
+	attrs := []attribute.KeyValue{
+		attribute.String("rate_limit.key", key),
+		attribute.Int64("rate_limit.remaining", int64(res.Remaining)),
+		attribute.Int64("rate_limit.limit", int64(res.Limit)),
+	}
+	if res.Allowed {
+		name = EventAllowed
+	} else {
+		attrs = append(attrs, attribute.Int64("rate_limit.retry_after_ms", res.RetryAfter.Milliseconds()))
+	}
+	span.AddEvent(name, trace.WithAttributes(attrs...))
+	return res.Allowed, nil
+}
@@ -0,0 +1,99 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := ratelimiter.New(0, 1)
+	defer limiter.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "request")
+
+	if allowed, err := Allow(ctx, limiter, "key"); err != nil || !allowed {
+		t.Errorf("expected allowed to be true, got %t and %v", allowed, err)
+	}
+	if allowed, err := Allow(ctx, limiter, "key"); err != nil || allowed {
+		t.Errorf("expected allowed to be false, got %t and %v", allowed, err)
+	}
+	span.End()
+
+	events := recorder.Ended()[0].Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Name != EventAllowed || events[1].Name != EventRejected {
+		t.Errorf("expected events %q and %q, got %q and %q", EventAllowed, EventRejected, events[0].Name, events[1].Name)
+	}
+
+	attrs := attribute.NewSet(events[0].Attributes...)
+	if v, _ := attrs.Value("rate_limit.key"); v.AsString() != "key" {
+		t.Errorf("expected key attribute %q, got %q", "key", v.AsString())
+	}
+	if v, _ := attrs.Value("rate_limit.remaining"); v.AsInt64() != 0 {
+		t.Errorf("expected remaining attribute 0, got %d", v.AsInt64())
+	}
+	rejected := attribute.NewSet(events[1].Attributes...)
+	if _, ok := rejected.Value("rate_limit.retry_after_ms"); !ok {
+		t.Error("expected retry after attribute on the rejected event, got none")
+	}
+}
+
+func TestAllowWithoutSpan(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := ratelimiter.New(0, 1)
+	defer limiter.Close()
+
+	if allowed, err := Allow(context.Background(), limiter, "key"); err != nil || !allowed {
+		t.Errorf("expected allowed to be true, got %t and %v", allowed, err)
+	}
+	if allowed, err := Allow(context.Background(), limiter, "key"); err != nil || allowed {
+		t.Errorf("expected allowed to be false, got %t and %v", allowed, err)
+	}
+}
+
+func TestAllowError(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := ratelimiter.New(0, 1)
+	limiter.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "request")
+
+	if allowed, err := Allow(ctx, limiter, "key"); !errors.Is(err, ratelimiter.ErrClosed) || allowed {
+		t.Errorf("expected false and error %v, got %t and %v", ratelimiter.ErrClosed, allowed, err)
+	}
+
+	open, _ := ratelimiter.New(0, 1)
+	defer open.Close()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Allow(canceled, open, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	span.End()
+
+	events := recorder.Ended()[0].Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.Name == EventAllowed || event.Name == EventRejected {
+			t.Errorf("expected errors not to be recorded as decisions, got event %q", event.Name)
+		}
+	}
+}
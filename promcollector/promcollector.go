@@ -0,0 +1,65 @@
+// Package promcollector exports the counters of a rate limiter as
+// Prometheus metrics, read from its Stats on every scrape. Register one
+// Collector per rate limiter:
+//
+//	prometheus.MustRegister(promcollector.New(limiter, nil))
+//
+// The allowed, rejected and evicted counts are exported as counters, the
+// keys tracked as a gauge.
+package promcollector
+
+import (
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limiter reports the counters to export, see ratelimiter.Stats. Both
+// New and NewConcurrency of the ratelimiter package return one.
+type Limiter interface {
+	Stats() ratelimiter.Stats
+}
+
+// Collector is a prometheus.Collector reporting the Stats of a rate
+// limiter on every scrape.
+type Collector struct {
+	l Limiter
+
+	allowed    *prometheus.Desc
+	rejected   *prometheus.Desc
+	evicted    *prometheus.Desc
+	activeKeys *prometheus.Desc
+}
+
+// New returns a Collector for l. labels are added to every metric, e.g.
+// to tell several rate limiters registered with the same registerer
+// apart, and may be nil.
+func New(l Limiter, labels prometheus.Labels) *Collector {
+	return &Collector{
+		l: l,
+		allowed: prometheus.NewDesc("ratelimiter_allowed_total",
+			"Requests let through by the rate limiter.", nil, labels),
+		rejected: prometheus.NewDesc("ratelimiter_rejected_total",
+			"Requests denied by the rate limiter.", nil, labels),
+		evicted: prometheus.NewDesc("ratelimiter_evicted_total",
+			"Keys evicted for being idle or to stay within the max keys.", nil, labels),
+		activeKeys: prometheus.NewDesc("ratelimiter_active_keys",
+			"Keys currently tracked by the rate limiter.", nil, labels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.allowed
+	ch <- c.rejected
+	ch <- c.evicted
+	ch <- c.activeKeys
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.l.Stats()
+	ch <- prometheus.MustNewConstMetric(c.allowed, prometheus.CounterValue, float64(stats.Allowed))
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(stats.Rejected))
+	ch <- prometheus.MustNewConstMetric(c.evicted, prometheus.CounterValue, float64(stats.Evicted))
+	ch <- prometheus.MustNewConstMetric(c.activeKeys, prometheus.GaugeValue, float64(stats.Keys))
+}
@@ -0,0 +1,65 @@
+package promcollector
+
+import (
+	"strings"
+	"testing"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := ratelimiter.New(0, 2)
+	defer limiter.Close()
+
+	for range 3 {
+		limiter.Allow("a")
+	}
+	limiter.Allow("b")
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(New(limiter, prometheus.Labels{"limiter": "api"})); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `
+# HELP ratelimiter_active_keys Keys currently tracked by the rate limiter.
+# TYPE ratelimiter_active_keys gauge
+ratelimiter_active_keys{limiter="api"} 2
+# HELP ratelimiter_allowed_total Requests let through by the rate limiter.
+# TYPE ratelimiter_allowed_total counter
+ratelimiter_allowed_total{limiter="api"} 3
+# HELP ratelimiter_evicted_total Keys evicted for being idle or to stay within the max keys.
+# TYPE ratelimiter_evicted_total counter
+ratelimiter_evicted_total{limiter="api"} 0
+# HELP ratelimiter_rejected_total Requests denied by the rate limiter.
+# TYPE ratelimiter_rejected_total counter
+ratelimiter_rejected_total{limiter="api"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Errorf("not expected error but got %v", err)
+	}
+}
+
+func TestCollectorMustRegister(t *testing.T) {
+	t.Parallel()
+
+	api, _ := ratelimiter.New(1, 1)
+	defer api.Close()
+	login, _ := ratelimiter.New(1, 1)
+	defer login.Close()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("expected collectors to register, got panic %v", r)
+		}
+	}()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		New(api, prometheus.Labels{"limiter": "api"}),
+		New(login, prometheus.Labels{"limiter": "login"}),
+	)
+}
@@ -0,0 +1,180 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"time"
+)
+
+// ErrQueueFull is returned by AllowOrQueue when the key has no token left
+// and WithQueueDepth requests are already waiting for it.
+var ErrQueueFull = errors.New("queue is full")
+
+// WithQueueDepth caps the number of AllowOrQueue requests waiting for a
+// token of a single key. Defaults to 0, AllowOrQueue then never waits and
+// returns ErrQueueFull when the key has no token left.
+func WithQueueDepth(n int) Option {
+	return func(cfg *config) {
+		cfg.queueDepth = n
+	}
+}
+
+// waitQueue is the FIFO of AllowOrQueue requests waiting for a key. Only
+// its head polls the bucket, the waiters behind it block on their ready
+// channel until they become the head.
+type waitQueue struct {
+	waiters []*waiter
+}
+
+type waiter struct {
+	// ready is signalled once the waiter is the head of its queue. It
+	// is buffered, so that the waiter promoting it never blocks.
+	ready chan struct{}
+}
+
+// AllowOrQueue takes a token from key like AllowE, but when none is left
+// it waits in line for one instead of failing right away. Requests of a
+// key waiting in AllowOrQueue are served in the order they arrived as
+// tokens refill, instead of the lottery of callers polling Allow in a
+// loop. At most WithQueueDepth requests wait for a key, further ones fail
+// with ErrQueueFull and are counted as Rejected.
+//
+// A token is granted right away, without waiting in line, only if no
+// request of the key is waiting already. Requests of other methods, e.g.
+// Allow, do not queue, and may still take a refilled token ahead of the
+// waiters.
+//
+// It returns nil once the token is taken, ctx.Err() if ctx is done
+// first, which removes the request from the queue, and ErrClosed once
+// the rate limiter is closed, waking up every waiter. Like AllowE, it
+// returns ErrNoCapacity when the key can never be allowed and an error
+// matching ErrContention when a Store update gave up.
+//
+// Waiting is timed by the system clock, a clock passed to WithClock only
+// tells how long to wait.
+func (r *rateLimiter[K]) AllowOrQueue(ctx context.Context, key K) error {
+	if r.closed.Load() {
+		return ErrClosed
+	}
+	if r.cfg.disabled {
+		r.counters.allowed.Add(1)
+		return nil
+	}
+
+	r.queueMu.Lock()
+	_, waiting := r.queues[key]
+	r.queueMu.Unlock()
+	if !waiting {
+		res, err := r.take(ctx, key, request{n: 1})
+		switch {
+		case err != nil:
+			return err
+		case res.Allowed:
+			r.counters.allowed.Add(1)
+			return nil
+		case res.RetryAfter == math.MaxInt64:
+			r.reject(key)
+			return ErrNoCapacity
+		}
+	}
+
+	w, err := r.enqueue(key)
+	if err != nil {
+		r.reject(key)
+		return err
+	}
+	defer r.dequeue(key, w)
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return ErrClosed
+	}
+
+	for {
+		res, err := r.take(ctx, key, request{n: 1})
+		switch {
+		case err != nil:
+			return err
+		case res.Allowed:
+			r.counters.allowed.Add(1)
+			return nil
+		case res.RetryAfter == math.MaxInt64:
+			r.reject(key)
+			return ErrNoCapacity
+		}
+
+		timer := time.NewTimer(res.RetryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-r.done:
+			timer.Stop()
+			return ErrClosed
+		}
+	}
+}
+
+// enqueue appends a waiter to the queue of key, creating the queue if
+// needed. The waiter is ready right away if the queue was empty.
+func (r *rateLimiter[K]) enqueue(key K) (*waiter, error) {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+
+	q := r.queues[key]
+	if q == nil {
+		if r.cfg.queueDepth == 0 {
+			return nil, ErrQueueFull
+		}
+		q = &waitQueue{}
+		if r.queues == nil {
+			r.queues = make(map[K]*waitQueue)
+		}
+		r.queues[key] = q
+	}
+	if len(q.waiters) >= r.cfg.queueDepth {
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{ready: make(chan struct{}, 1)}
+	q.waiters = append(q.waiters, w)
+	if len(q.waiters) == 1 {
+		w.ready <- struct{}{}
+	}
+	r.queued.Add(1)
+	return w, nil
+}
+
+// dequeue removes w from the queue of key, making the next waiter the
+// head if w was. The queue is dropped once empty, so that keys waited on
+// once do not hold memory.
+func (r *rateLimiter[K]) dequeue(key K, w *waiter) {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+
+	q := r.queues[key]
+	i := slices.Index(q.waiters, w)
+	q.waiters = slices.Delete(q.waiters, i, i+1)
+	r.queued.Add(-1)
+
+	switch {
+	case len(q.waiters) == 0:
+		delete(r.queues, key)
+	case i == 0:
+		q.waiters[0].ready <- struct{}{}
+	}
+}
+
+// reject counts a request of key denied by AllowOrQueue.
+func (r *rateLimiter[K]) reject(key K) {
+	r.counters.rejected.Add(1)
+	if r.onReject != nil {
+		r.onReject(key)
+	}
+}
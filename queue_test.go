@@ -0,0 +1,152 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestAllowOrQueue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(1, 1, WithQueueDepth(2))
+		defer rateLimiter.Close()
+
+		if err := rateLimiter.AllowOrQueue(t.Context(), "key"); err != nil {
+			t.Fatalf("expected request with a free token to be allowed, got %v", err)
+		}
+
+		start := time.Now()
+		served := make(chan int, 2)
+		for i := range 2 {
+			go func() {
+				if err := rateLimiter.AllowOrQueue(t.Context(), "key"); err != nil {
+					t.Errorf("expected waiter %d to be allowed, got %v", i, err)
+				}
+				served <- i
+			}()
+			// queue the waiters in order
+			synctest.Wait()
+		}
+
+		if stats := rateLimiter.Stats(); stats.Queued != 2 {
+			t.Errorf("expected 2 queued requests, got %d", stats.Queued)
+		}
+		if err := rateLimiter.AllowOrQueue(t.Context(), "key"); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("expected error %v, got %v", ErrQueueFull, err)
+		}
+
+		for i := range 2 {
+			if got := <-served; got != i {
+				t.Errorf("expected waiter %d to be served, got %d", i, got)
+			}
+			if elapsed, expected := time.Since(start), time.Duration(i+1)*time.Second; elapsed != expected {
+				t.Errorf("expected waiter %d to be served after %v, got %v", i, expected, elapsed)
+			}
+		}
+
+		expected := Stats{Allowed: 3, Rejected: 1, Keys: 1}
+		if stats := rateLimiter.Stats(); stats != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, stats)
+		}
+		if n := len(rateLimiter.queues); n != 0 {
+			t.Errorf("expected empty queues to be dropped, got %d", n)
+		}
+	})
+}
+
+func TestAllowOrQueueCancel(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(1, 1, WithQueueDepth(3))
+		defer rateLimiter.Close()
+
+		rateLimiter.Allow("key")
+
+		start := time.Now()
+		ctxs := make([]context.CancelFunc, 3)
+		errs := make([]chan error, 3)
+		for i := range 3 {
+			ctx, cancel := context.WithCancel(t.Context())
+			ctxs[i], errs[i] = cancel, make(chan error, 1)
+			go func() {
+				errs[i] <- rateLimiter.AllowOrQueue(ctx, "key")
+			}()
+			synctest.Wait()
+		}
+
+		// cancelling the head and a waiter behind it leaves the last
+		// one at the head
+		ctxs[0]()
+		ctxs[1]()
+		for i := range 2 {
+			if err := <-errs[i]; !errors.Is(err, context.Canceled) {
+				t.Errorf("expected error %v for waiter %d, got %v", context.Canceled, i, err)
+			}
+		}
+		if stats := rateLimiter.Stats(); stats.Queued != 1 {
+			t.Errorf("expected 1 queued request, got %d", stats.Queued)
+		}
+
+		if err := <-errs[2]; err != nil {
+			t.Errorf("expected last waiter to be allowed, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Errorf("expected last waiter to be served after 1s, got %v", elapsed)
+		}
+		ctxs[2]()
+
+		if stats := rateLimiter.Stats(); stats.Queued != 0 {
+			t.Errorf("expected no queued request, got %d", stats.Queued)
+		}
+		if n := len(rateLimiter.queues); n != 0 {
+			t.Errorf("expected empty queues to be dropped, got %d", n)
+		}
+	})
+}
+
+func TestAllowOrQueueClose(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(1, 1, WithQueueDepth(1))
+
+		rateLimiter.Allow("key")
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- rateLimiter.AllowOrQueue(t.Context(), "key")
+		}()
+		synctest.Wait()
+
+		rateLimiter.Close()
+		if err := <-errc; !errors.Is(err, ErrClosed) {
+			t.Errorf("expected error %v, got %v", ErrClosed, err)
+		}
+		if err := rateLimiter.AllowOrQueue(t.Context(), "key"); !errors.Is(err, ErrClosed) {
+			t.Errorf("expected error %v, got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestAllowOrQueueWithoutWaiting(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 1)
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	if err := rateLimiter.AllowOrQueue(t.Context(), "key"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected error %v without queue depth, got %v", ErrQueueFull, err)
+	}
+
+	noCapacity, _ := New(1, 0, WithQueueDepth(1))
+	defer noCapacity.Close()
+
+	if err := noCapacity.AllowOrQueue(t.Context(), "key"); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected error %v, got %v", ErrNoCapacity, err)
+	}
+
+	expected := Stats{Rejected: 1}
+	if stats := noCapacity.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
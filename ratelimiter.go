@@ -1,68 +1,296 @@
 package ratelimiter
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math"
+	"math/rand/v2"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxCASRetries = 100
+// Limit is a token rate and burst size pair. Once published, a Limit is
+// never mutated: SetRate, SetBurst and Reconfigure swap in a new one so
+// Allow always sees TokenRate and BurstSize consistent with each other.
+type Limit struct {
+	TokenRate float64
+	BurstSize uint
+	// Interval is the time between two tokens of limits set up with
+	// NewEvery or WithRefillInterval, TokenRate being derived from it.
+	// Durations computed from the limit, like RetryAfter, are then exact
+	// multiples of Interval rather than rounded from TokenRate. 0 means
+	// the limit is only expressed by TokenRate.
+	Interval time.Duration
+}
+
+// every returns how long lim takes to produce n tokens, or math.MaxInt64
+// if that does not fit in a time.Duration.
+func (lim *Limit) every(n uint) time.Duration {
+	if lim.Interval > 0 {
+		if n > uint(math.MaxInt64/lim.Interval) {
+			return math.MaxInt64
+		}
+		return time.Duration(n) * lim.Interval
+	}
+	// a tiny rate can take longer than a time.Duration holds, which the
+	// conversion would wrap around.
+	ns := float64(n) / lim.TokenRate * float64(time.Second)
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
 
-var now = time.Now
+// tokensIn returns how many tokens lim produces in d. Only whole tokens
+// are counted for limits with an Interval, so that the count is exact.
+func (lim *Limit) tokensIn(d time.Duration) float64 {
+	if lim.Interval > 0 {
+		return float64(d / lim.Interval)
+	}
+	return lim.TokenRate * d.Seconds()
+}
 
-type bucket struct {
-	tokens       uint
-	lastRefill   time.Time
-	lastActivity time.Time
+// Limiter is the part of a rate limiter keyed by strings that request
+// handlers usually need. Accepting a Limiter rather than the rate limiter
+// returned by New lets callers inject a fake in tests, or swap in another
+// implementation like the Redis backed one of the redislimiter package.
+type Limiter interface {
+	Allow(key string) bool
+	AllowN(key string, n uint) bool
+	AllowCtx(ctx context.Context, key string) (bool, error)
+	Close()
 }
 
-type rateLimiter struct {
-	tokenRate float64
-	burstSize uint
+var _ Limiter = (*rateLimiter[string])(nil)
+
+// ErrClosed is returned by AllowCtx once the rate limiter is closed.
+var ErrClosed = errors.New("rate limiter is closed")
+
+var (
+	// ErrRateLimited is returned by AllowE when the bucket of the key has
+	// no token left, the normal outcome of throttling.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNoCapacity is returned by AllowE when the burst size applying to
+	// the key is 0, so that no request can ever be allowed, or when a new
+	// key is turned away by Drain.
+	ErrNoCapacity = errors.New("no capacity")
+)
+
+// Errors returned by New, and by methods changing the limits, when the
+// token rate is out of bounds. They are wrapped with the offending values,
+// test for them with errors.Is.
+var (
+	// ErrNegativeRate means the token rate is below 0.
+	ErrNegativeRate = errors.New("token rate should not be negative")
+	// ErrRateOverflow means the token rate would fill more tokens than
+	// a uint holds before an idle key is evicted: lower the token rate,
+	// or the idle timeout or cleanup interval.
+	ErrRateOverflow = errors.New("token rate overflows over the idle timeout")
+	// ErrBurstRateOverflow means the tokens filled before an idle key is
+	// evicted, added to the burst size, would not fit in a uint: lower
+	// the token rate or the burst size.
+	ErrBurstRateOverflow = errors.New("token rate overflows with the burst size")
+)
+
+type rateLimiter[K comparable] struct {
+	limit atomic.Pointer[Limit]
+	// mu serializes SetRate, SetBurst and Reconfigure, so validation
+	// and the update of limit happen together.
+	mu  sync.Mutex
+	cfg config
+
+	store store[K]
+	algo  algorithm
+	// keys is the number of buckets in the store.
+	keys         atomic.Int64
+	counters     counters
+	onEvict      func(key K)
+	onReject     func(key K)
+	onContention func(key K)
+	done         chan struct{}
+	// closeOnce makes Close idempotent, closing done twice panics.
+	closeOnce sync.Once
+	// stopped is closed once the cleanup goroutine returned, or right
+	// away if there is none.
+	stopped chan struct{}
+	closed  atomic.Bool
+	// draining makes requests of keys not tracked yet be rejected.
+	draining atomic.Bool
+	// takers holds the *taker[K] of take
+	takers sync.Pool
 
-	m    sync.Map
-	done chan struct{}
+	// queueMu guards queues, the AllowOrQueue waiters of every key with
+	// at least one waiting. queued is the number of waiters in total.
+	queueMu sync.Mutex
+	queues  map[K]*waitQueue
+	queued  atomic.Int64
 }
 
-// When burstSize = 0, then all requests will be rejected
+// When burstSize = 0, then all requests will be rejected, even with a
+// positive tokenRate. See WithZeroBurst to allow them at tokenRate instead.
 // When tokenRate = 0, then for every unique key, only "burstSize" number of requests
 // will be let through for one session(~1 hour).
-func New(tokenRate float64, burstSize uint) (*rateLimiter, error) {
+// When tokenRate = +Inf, buckets are always full, so every request is let
+// through unless burstSize = 0. See WithDisabled to allow all requests
+// without tracking keys.
+//
+// Keys are strings, see NewKeyed for keys of other types.
+func New(tokenRate float64, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return NewKeyed[string](tokenRate, burstSize, opts...)
+}
+
+// PerSecond is like New, with a token rate of n tokens per second.
+func PerSecond(n, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return NewWithInterval(time.Second, n, burstSize, opts...)
+}
+
+// PerMinute is like New, with a token rate of n tokens per minute.
+func PerMinute(n, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return NewWithInterval(time.Minute, n, burstSize, opts...)
+}
+
+// PerHour is like New, with a token rate of n tokens per hour.
+func PerHour(n, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return NewWithInterval(time.Hour, n, burstSize, opts...)
+}
+
+// NewEvery is like New, with one token every interval, e.g.
+// NewEvery(time.Minute, 1) allows a request per minute. Unlike
+// New(1.0/60, 1), the interval is kept along with the token rate, so
+// refills and retry delays are exact multiples of it. interval must be
+// positive.
+func NewEvery(interval time.Duration, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return New(0, burstSize, append(opts, WithRefillInterval(interval))...)
+}
+
+// NewWithInterval is like New, with a token rate of tokens per interval,
+// e.g. NewWithInterval(time.Minute, 1, 1) refills one token per minute.
+// interval must be positive.
+func NewWithInterval(interval time.Duration, tokens, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	if interval <= 0 {
+		return nil, errors.New("interval should be positive")
+	}
+	return New(float64(tokens)/interval.Seconds(), burstSize, opts...)
+}
+
+// NewKeyed is like New, but keys are of type K. Structured keys, like a
+// struct of a user and an endpoint ID, can be used as is instead of
+// formatting them into a string on every call. WithStore is only
+// supported when K is string, as a Store is keyed by string.
+func NewKeyed[K comparable](tokenRate float64, burstSize uint, opts ...Option) (*rateLimiter[K], error) {
+
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 
-	// (tokenRate * 5000 + burstSize) <= 2 ^ (arch size)
-	// 5000 seconds is time elapsed, if key were to remain until that time(taking worst case)
+	burstSize = cfg.burst(burstSize)
+	if cfg.tier != nil {
+		cfg.tier.BurstSize = cfg.burst(cfg.tier.BurstSize)
+	}
+	var interval time.Duration
+	if cfg.refillInterval != nil {
+		interval = *cfg.refillInterval
+		if interval <= 0 {
+			return nil, errors.New("refill interval should be positive")
+		}
+		tokenRate = 1 / interval.Seconds()
+	}
+
+	// (tokenRate * maxElapsed + burstSize) <= 2 ^ (arch size)
+	// maxElapsed is the time elapsed, if key were to remain until it is
+	// evicted(taking worst case)
 
-	if err := validate(tokenRate, burstSize); err != nil {
+	if err := validate(tokenRate, burstSize, cfg); err != nil {
 		return nil, err
 	}
 
-	r := &rateLimiter{
-		tokenRate: tokenRate,
-		burstSize: burstSize,
+	if cfg.initialTokens != nil && *cfg.initialTokens > burstSize {
+		return nil, errors.New("initial tokens should not exceed burst size")
+	}
+
+	r := &rateLimiter[K]{
+		cfg:     cfg,
+		algo:    cfg.algorithm.impl(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	r.takers.New = func() any {
+		tk := &taker[K]{r: r}
+		tk.update = tk.apply
+		return tk
+	}
+	if cfg.tier != nil {
+		r.algo = tiered{burst: *cfg.tier}
+	}
+	if cfg.onEvict != nil {
+		// WithOnEvict stores fn as any, as Option is not generic
+		onEvict, ok := cfg.onEvict.(func(key K))
+		if !ok {
+			return nil, errors.New("on evict callback key type does not match the limiter key type")
+		}
+		r.onEvict = onEvict
+	}
+	if cfg.onReject != nil {
+		onReject, ok := cfg.onReject.(func(key K))
+		if !ok {
+			return nil, errors.New("on reject callback key type does not match the limiter key type")
+		}
+		r.onReject = onReject
+	}
+	if cfg.onContention != nil {
+		onContention, ok := cfg.onContention.(func(key K))
+		if !ok {
+			return nil, errors.New("on contention callback key type does not match the limiter key type")
+		}
+		r.onContention = onContention
+	}
+	if cfg.store != nil {
+		// casStore only implements store[string]
+		s, ok := any(casStore{s: cfg.store, retries: cfg.maxRetries, idleTimeout: cfg.idleTimeout, backoff: cfg.retryBackoff}).(store[K])
+		if !ok {
+			return nil, errors.New("store requires string keys")
+		}
+		r.store = s
+	} else {
+		m := newShardedMap[K](cfg.shards, cfg.idleTimeout, cfg.initialCapacity)
+		m.sweepers = cfg.cleanupWorkers
+		if m.sweepers == 0 {
+			m.sweepers = min(cfg.shards, runtime.GOMAXPROCS(0))
+		}
+		if cfg.hasher != nil {
+			// WithHasher only takes string keys, as Option is not generic
+			hash, ok := any(cfg.hasher).(func(key K) uint64)
+			if !ok {
+				return nil, errors.New("hasher requires string keys")
+			}
+			m.hash = hash
+		}
+		r.store = m
+	}
+	r.limit.Store(&Limit{TokenRate: tokenRate, BurstSize: burstSize, Interval: interval})
 
-		m:    sync.Map{},
-		done: make(chan struct{}),
+	if cfg.disabled || cfg.noCleanup {
+		// nothing is ever stored, or the caller cleans up with Flush
+		close(r.stopped)
+		return r, nil
 	}
 
 	go func() {
-		// this goroutine will iterate over map every 5 minutes and
-		// delete those keys which have lastactivity older than equal
-		// to 1 hour.
-		ticker := time.NewTicker(5 * time.Minute)
+		defer close(r.stopped)
+		// this goroutine will iterate over map every cleanupInterval
+		// (5 minutes by default) and delete those keys which have
+		// lastactivity older than equal to idleTimeout (1 hour by default).
+		ticker := time.NewTicker(r.cfg.cleanupInterval)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				r.m.Range(func(key, val any) bool {
-					buck := val.(bucket)
-					t := now()
-					if t.Sub(buck.lastActivity) >= time.Hour {
-						r.m.Delete(key)
-					}
-					return true
-				})
+				r.Flush()
 			case <-r.done:
 				return
 			}
@@ -72,96 +300,870 @@ func New(tokenRate float64, burstSize uint) (*rateLimiter, error) {
 	return r, nil
 }
 
-func (r *rateLimiter) Allow(key string) bool {
-	if r.burstSize == 0 {
-		// no capacity, reject all request
+// Allow reports whether a request for key is allowed, consuming a token
+// of its bucket if so.
+//
+// Updates of a key are serialized, by the shard lock or by the compare
+// and swap of a Store, and each reads the clock once it has exclusive
+// access to the bucket, so concurrent requests cannot spend a token
+// twice. With AlgoTokenBucket or AlgoLeakyBucket, the requests allowed
+// for a key over any period d never exceed burstSize + floor(tokenRate *
+// d), however many goroutines call Allow, as long as the limits are not
+// changed during d and the clock does not step forward.
+func (r *rateLimiter[K]) Allow(key K) bool {
+	res, _ := r.allow(context.Background(), key, request{n: 1})
+	return res.Allowed
+}
+
+// AllowBytes is like Allow for the string made of the bytes of key, e.g.
+// a key built in a reused scratch buffer with strconv.AppendInt instead
+// of fmt.Sprintf. For a key already tracked by the built in sharded maps
+// no string is allocated: the key stored in the map is used instead. key
+// is not retained. AllowBytes panics if the key type is not string.
+func (r *rateLimiter[K]) AllowBytes(key []byte) bool {
+	rs, ok := any(r).(*rateLimiter[string])
+	if !ok {
+		panic("ratelimiter: AllowBytes needs string keys")
+	}
+	return rs.Allow(internKey(rs.store, key))
+}
+
+// AllowAt is like Allow, but refills and consumes as if the request was
+// made at t instead of reading the clock, e.g. for tests travelling in
+// time without a Clock. A t earlier than the last refill of key grants no
+// tokens, the same way a clock stepping backwards does. A zero t reads
+// the clock like Allow.
+func (r *rateLimiter[K]) AllowAt(key K, t time.Time) bool {
+	res, _ := r.allow(context.Background(), key, request{n: 1, at: t})
+	return res.Allowed
+}
+
+// AllowCtx is like Allow, but gives up with ctx.Err() if ctx is done
+// before the decision is made, e.g. while retrying compare and swaps on a
+// contended key of a Store. It returns ErrRetriesExhausted if the retry
+// limit is exhausted, ErrBusy if the shard of the key is locked by
+// another request WithNonBlocking, and ErrClosed once the rate limiter is
+// closed, so that contention can be told apart from a deny. On a clean
+// allow or deny the error is nil.
+func (r *rateLimiter[K]) AllowCtx(ctx context.Context, key K) (bool, error) {
+	res, err := r.allow(ctx, key, request{n: 1})
+	return res.Allowed, err
+}
+
+// AllowE is like Allow, but tells why a request is not allowed. It
+// returns nil when the request is allowed, ErrRateLimited when the key
+// ran out of tokens, ErrNoCapacity when it can never be allowed, and an
+// error matching ErrContention when a Store update gave up, e.g. to alert
+// on contention but not on normal throttling. It returns ErrClosed once
+// the rate limiter is closed.
+func (r *rateLimiter[K]) AllowE(key K) error {
+	res, err := r.allow(context.Background(), key, request{n: 1})
+	switch {
+	case err != nil:
+		return err
+	case res.Allowed:
+		return nil
+	case res.RetryAfter == math.MaxInt64:
+		return ErrNoCapacity
+	}
+	return ErrRateLimited
+}
+
+// AllowWithLimit is like Allow, but uses tokenRate and burstSize for key
+// instead of the limits the rate limiter was created with. The limit is
+// stored alongside the bucket, so later Allow calls for key keep using it
+// until the key is evicted. If the limit differs from the stored one, the
+// next refill uses the new rate and caps tokens to the new burst size.
+// It returns false if tokenRate and burstSize fail validation.
+func (r *rateLimiter[K]) AllowWithLimit(key K, tokenRate float64, burstSize uint) bool {
+	burstSize = r.cfg.burst(burstSize)
+	if err := validate(tokenRate, burstSize, r.cfg); err != nil {
 		return false
 	}
-	for range maxCASRetries {
-		t := now()
-		val, ok := r.m.Load(key)
-		if !ok {
-			// Try to be the first to create this key
-			b := bucket{
-				tokens:       r.burstSize - 1, // -1 is to consume one token for current request
-				lastRefill:   t,
-				lastActivity: t,
+	res, _ := r.allow(context.Background(), key, request{n: 1, limit: &Limit{TokenRate: tokenRate, BurstSize: burstSize}})
+	return res.Allowed
+}
+
+// AllowWithTTL is like Allow, but evicts key once it has been idle for ttl
+// instead of the idle timeout the rate limiter was created with, e.g. to
+// keep the buckets of premium tenants longer while anonymous keys expire
+// fast. The idle timeout is stored alongside the bucket, so later Allow
+// calls for key keep it until the key is evicted. Eviction still happens
+// on the cleanup interval, so a ttl shorter than it is only honoured up
+// to one cleanup interval late. It returns false if ttl is not positive.
+func (r *rateLimiter[K]) AllowWithTTL(key K, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	res, _ := r.allow(context.Background(), key, request{n: 1, idleTimeout: ttl})
+	return res.Allowed
+}
+
+// AllowN is like Allow, but consumes n tokens at once, e.g. to weigh a
+// request by its cost. Either all n are consumed or none is, so a request
+// for more than burstSize tokens is never allowed. A request for 0 tokens
+// is allowed without consuming any, unless burstSize is 0.
+func (r *rateLimiter[K]) AllowN(key K, n uint) bool {
+	res, _ := r.allow(context.Background(), key, request{n: n})
+	return res.Allowed
+}
+
+// AllowAll allows a request only if every key has a token available, e.g.
+// to enforce a per user and a per organization limit together. Either one
+// token is consumed from each key or none is. A key passed twice needs
+// two tokens. Stats count the call as a single request.
+//
+// Keys are not locked together: tokens are consumed one key after the
+// other, and if a key has no token left, the tokens already consumed are
+// refunded. Until then, concurrent requests on the earlier keys see them
+// as consumed, so they may be rejected even though AllowAll ends up
+// rejected too. A refund does not refill a bucket beyond burstSize, and
+// is skipped for a key evicted in the meantime.
+func (r *rateLimiter[K]) AllowAll(keys ...K) bool {
+	return r.allowAll(keys)
+}
+
+// allowAll is AllowAll, also backing Begin.
+func (r *rateLimiter[K]) allowAll(keys []K) bool {
+	if r.closed.Load() {
+		return false
+	}
+	if r.cfg.disabled {
+		r.counters.allowed.Add(1)
+		return true
+	}
+	ctx := context.Background()
+	for i, key := range keys {
+		res, err := r.take(ctx, key, request{n: 1})
+		if err != nil || !res.Allowed {
+			for _, k := range keys[:i] {
+				r.refund(ctx, k, 1)
 			}
-			actual, loaded := r.m.LoadOrStore(key, b)
-			if !loaded {
-				// this means, this was the first time `key` is inserted
-				return true
+			r.counters.rejected.Add(1)
+			if r.onReject != nil {
+				r.onReject(key)
 			}
-			// some other goroutine created entry with `key`
-			val = actual
+			return false
 		}
+	}
+	r.counters.allowed.Add(1)
+	return true
+}
 
-		// flow will reach here when key is not inserted for
-		// the first time. we will need to update the value
-		t = now()
+// Refund gives back up to n tokens to key, e.g. when the request they
+// were consumed for turned out to be a cache hit or failed validation
+// early. It is safe to call concurrently with Allow, the refund is applied
+// under the same lock or compare and swap as any other update.
+//
+// Refunding never fills a bucket beyond burstSize: tokens over capacity
+// are dropped rather than reported as an error. A token that refilled in
+// the meantime cannot be recovered either, so refunding to a bucket that
+// is already full again does nothing. With window algorithms, requests
+// of a window that has moved on are taken off the current window. An
+// unknown or evicted key is left alone.
+func (r *rateLimiter[K]) Refund(key K, n uint) {
+	if r.cfg.disabled || n == 0 {
+		return
+	}
+	r.refund(context.Background(), key, n)
+}
+
+// AllowBatch is like calling Allow for every key in turn, e.g. to split
+// a batch of events into accepted and rejected ones in one call. The
+// result at index i is the decision for keys[i]. Unlike AllowAll every
+// key is decided on its own, and a key passed twice sees the token taken
+// by its earlier occurrence. Stats count each key as a request.
+func (r *rateLimiter[K]) AllowBatch(keys []K) []bool {
+	allowed := make([]bool, len(keys))
+	ctx := context.Background()
+	for i, key := range keys {
+		res, _ := r.allow(ctx, key, request{n: 1})
+		allowed[i] = res.Allowed
+	}
+	return allowed
+}
 
-		buck, ok := val.(bucket)
+// refund gives back n tokens consumed from key.
+func (r *rateLimiter[K]) refund(ctx context.Context, key K, n uint) {
+	_, _ = r.store.update(ctx, key, func(b *Bucket, ok bool) bool {
 		if !ok {
-			panic("val should be of bucket type")
+			return false
 		}
+		lim := r.limitFor(b)
+		r.sync(b, ok, lim, r.cfg.clock.Now())
+		r.algo.refund(b, lim, n)
+		return true
+	})
+}
 
-		// first, fill the bucket with desired token rate
-		timeElapsed := t.Sub(buck.lastRefill)
+// request is what a call of the Allow family asks of take.
+type request struct {
+	// n is the number of tokens to consume.
+	n uint
+	// limit is the per key limit passed to AllowWithLimit, nil to keep
+	// the one stored for the key.
+	limit *Limit
+	// idleTimeout is the per key idle timeout passed to AllowWithTTL, 0
+	// to keep the one stored for the key.
+	idleTimeout time.Duration
+	// at is the time passed to AllowAt, zero to read the clock.
+	at time.Time
+}
 
-		newTokens := min(r.burstSize, uint(r.tokenRate*timeElapsed.Seconds())+buck.tokens)
-		if buck.tokens != newTokens {
-			buck.tokens = newTokens
-			buck.lastRefill = t
+// allow consumes req.n tokens for key. Requests failing with an error are
+// neither counted as allowed nor rejected.
+func (r *rateLimiter[K]) allow(ctx context.Context, key K, req request) (Result, error) {
+	if r.closed.Load() {
+		// deny rather than grow a store no goroutine cleans up anymore
+		return Result{}, ErrClosed
+	}
+	if r.cfg.disabled {
+		r.counters.allowed.Add(1)
+		lim := r.limit.Load()
+		return Result{Allowed: true, Remaining: lim.BurstSize, Limit: lim.BurstSize}, nil
+	}
+	res, err := r.take(ctx, key, req)
+	if err != nil {
+		return Result{}, err
+	}
+	if res.Allowed {
+		r.counters.allowed.Add(1)
+	} else {
+		r.counters.rejected.Add(1)
+		if r.onReject != nil {
+			r.onReject(key)
 		}
+	}
+	return res, nil
+}
 
-		if buck.tokens > 0 {
-			// lastactivity updation is not outside of this `if` block
-			// because a malicious attacker can keep the
-			// rate limited key active and hence prevent it
-			// from cleanup.
-			buck.lastActivity = t
-			// consume a token
-			buck.tokens -= 1
-			if swapped := r.m.CompareAndSwap(key, val, buck); swapped {
-				return true
+// taker carries a request of take through store.update. Takers are
+// pooled along with their update func, bound once, so that a request on
+// a tracked key does not allocate.
+type taker[K comparable] struct {
+	r      *rateLimiter[K]
+	req    request
+	res    Result
+	update func(b *Bucket, ok bool) bool
+}
+
+func (r *rateLimiter[K]) take(ctx context.Context, key K, req request) (Result, error) {
+	tk := r.takers.Get().(*taker[K])
+	tk.req = req
+	update := r.store.update
+	if r.cfg.nonBlocking {
+		update = r.store.tryUpdate
+	}
+	created, err := update(ctx, key, tk.update)
+	res := tk.res
+	*tk = taker[K]{r: r, update: tk.update}
+	r.takers.Put(tk)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRetriesExhausted):
+			r.counters.retriesExhausted.Add(1)
+			if r.onContention != nil {
+				r.onContention(key)
 			}
-			// some other goroutine modified the entry with that key
-			// retry again
-			continue
+		case errors.Is(err, ErrBusy):
+			r.counters.busy.Add(1)
 		}
-		// flow will reach here when there are no tokens left
+		return Result{}, err
+	}
+	if created {
+		r.added(key)
+	}
+	return res, nil
+}
+
+// apply takes the tokens of the request from b, the bucket of its key.
+func (tk *taker[K]) apply(b *Bucket, ok bool) bool {
+	r, n := tk.r, tk.req.n
+
+	// time is read while the store gives exclusive access to the
+	// bucket, so updates of a key always observe non decreasing time.
+	t := tk.req.at
+	if t.IsZero() {
+		t = r.cfg.clock.Now()
+	}
+
+	if !ok {
+		// a Store update losing the race to create the key retries
+		// with the bucket of the winner, keeping its time.
+		b.CreatedAt = t
+	}
+	limitChanged := ok && tk.req.limit != nil && (b.Limit == nil || *b.Limit != *tk.req.limit)
+	if !ok || limitChanged {
+		b.Limit = tk.req.limit
+	}
+	ttlChanged := ok && tk.req.idleTimeout > 0 && b.IdleTimeout != tk.req.idleTimeout
+	if !ok || ttlChanged {
+		b.IdleTimeout = tk.req.idleTimeout
+	}
+
+	lim := r.limitFor(b)
+	if lim.BurstSize == 0 || n > lim.BurstSize || !ok && r.draining.Load() {
+		// no capacity for n tokens, or no new keys admitted
+		// while draining, reject the request. A burst of 0 never
+		// reaches consume, which would take from an empty bucket.
+		tk.res = Result{RetryAfter: math.MaxInt64, Limit: lim.BurstSize}
 		return false
 	}
-	// retry limit exhausted
-	return false
+
+	r.sync(b, ok, lim, t)
+
+	if r.algo.available(b, lim, t) >= n {
+		// lastactivity updation is not outside of this `if` block
+		// because a malicious attacker can keep the
+		// rate limited key active and hence prevent it
+		// from cleanup. it never moves backwards, so a time
+		// earlier than the last request cannot make a key idle.
+		if t.After(b.LastActivity) {
+			b.LastActivity = t
+		}
+		r.algo.consume(b, lim, t, n)
+		tk.res = r.result(true, b, lim, t, n)
+		return true
+	}
+	// flow will reach here when there are not enough tokens left.
+	// persist a new per key limit or idle timeout even though the
+	// request is rejected, so that later Allow calls use it.
+	tk.res = r.result(false, b, lim, t, n)
+	if !ok {
+		// a key starting with fewer tokens than requested is kept,
+		// so that it earns tokens from now on instead of starting
+		// over on every request.
+		b.LastActivity = t
+		return true
+	}
+	return limitChanged || ttlChanged
+}
+
+// added accounts for key being added to the store, evicting the least
+// recently active key if that takes the store over WithMaxKeys.
+func (r *rateLimiter[K]) added(key K) {
+	r.keys.Add(1)
+	if r.cfg.maxKeys > 0 && r.keys.Load() > int64(r.cfg.maxKeys) {
+		if evicted, ok := r.store.evictOldest(key); ok {
+			r.keys.Add(-1)
+			r.counters.evicted.Add(1)
+			if r.onEvict != nil {
+				r.onEvict(evicted)
+			}
+		}
+	}
+}
+
+// sync brings b up to date at t. A bucket of a new key, or one under an
+// infinite token rate, starts over as if no request was made.
+func (r *rateLimiter[K]) sync(b *Bucket, ok bool, lim *Limit, t time.Time) {
+	inf := math.IsInf(lim.TokenRate, 1)
+	if ok && !inf {
+		r.algo.advance(b, lim, t)
+		return
+	}
+	r.algo.init(b, lim, t)
+	if !ok && !inf && r.cfg.initialTokens != nil {
+		// start with what WithInitialTokens leaves of a full bucket
+		available := r.algo.available(b, lim, t)
+		r.algo.consume(b, lim, t, available-min(*r.cfg.initialTokens, available))
+	}
+}
+
+// limitFor returns the limit applying to b, either its own per key
+// limit or the limiter wide one, with the token rate scaled by Report.
+func (r *rateLimiter[K]) limitFor(b *Bucket) *Limit {
+	lim := b.Limit
+	if lim == nil {
+		lim = r.limit.Load()
+	}
+	if b.RateFactor == 0 {
+		return lim
+	}
+	// a scaled rate is no longer a whole number of intervals
+	return &Limit{TokenRate: lim.TokenRate * b.RateFactor, BurstSize: lim.BurstSize}
+}
+
+// Tokens returns the number of tokens currently available for key,
+// including the ones refilled since its last request. An unknown key
+// reports a full bucket. No token is consumed.
+func (r *rateLimiter[K]) Tokens(key K) uint {
+	tokens, _, _ := r.peek(key)
+	return tokens
+}
+
+// CreatedAt returns when the first request of key was made, as opposed
+// to its last allowed request, e.g. to measure how long keys stay
+// active. ok is false if key is not tracked. A key evicted or removed
+// and seen again reports the time it was seen again.
+func (r *rateLimiter[K]) CreatedAt(key K) (t time.Time, ok bool) {
+	b, ok := r.store.load(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return b.CreatedAt, true
+}
+
+// Has reports whether key is tracked, without creating its bucket or
+// refilling it, e.g. to check that a key was evicted. A key idle for
+// longer than its idle timeout is tracked until the next sweep evicts it.
+func (r *rateLimiter[K]) Has(key K) bool {
+	_, ok := r.store.load(key)
+	return ok
+}
+
+// RetryAfter returns how long until a request for key would be allowed.
+// It is 0 when a token is available, otherwise the time left until the
+// next token is refilled, accounting for the partial refill since the
+// last one.
+//
+// When tokenRate is 0 buckets never refill, the key can only be allowed
+// again once it is evicted, so RetryAfter returns the time left until
+// the key has been idle for its idle timeout. The actual eviction may
+// happen up to one cleanup interval later. When burstSize is 0 no
+// request is ever allowed and RetryAfter returns the maximum duration.
+// Other delays are lengthened by WithJitter, if set.
+func (r *rateLimiter[K]) RetryAfter(key K) time.Duration {
+	_, retryAfter, _ := r.peek(key)
+	return r.jitter(retryAfter)
+}
+
+// jitter adds a random delay of up to WithJitter's fraction of d to d.
+// Neither 0, nothing to wait for, nor the maximum duration, never, are
+// changed.
+func (r *rateLimiter[K]) jitter(d time.Duration) time.Duration {
+	if r.cfg.jitter == 0 || d <= 0 || d == math.MaxInt64 {
+		return d
+	}
+	extra := time.Duration(rand.Float64() * r.cfg.jitter * float64(d))
+	if extra > math.MaxInt64-d {
+		return math.MaxInt64
+	}
+	return d + extra
+}
+
+// TimeToFull returns how long until the bucket of key is fully refilled,
+// accounting for the partial refill since its last request. It is 0 for
+// a full or unknown bucket. No token is consumed.
+//
+// When tokenRate is 0 buckets never refill, so like RetryAfter it returns
+// the time left until the key has been idle for its idle timeout and is
+// evicted, after which the key starts over with a full bucket. For
+// NewTiered, it is the time until both buckets are full.
+func (r *rateLimiter[K]) TimeToFull(key K) time.Duration {
+	if r.cfg.disabled {
+		return 0
+	}
+
+	b, ok := r.store.load(key)
+	t := r.cfg.clock.Now()
+	lim := r.limitFor(&b)
+	r.sync(&b, ok, lim, t)
+
+	if a, ok := r.algo.(tiered); ok {
+		// the tiers refill on their own, what is available only tells
+		// about the tier with fewer tokens
+		var wait time.Duration
+		switch {
+		case b.Tokens >= lim.BurstSize:
+		case lim.TokenRate == 0:
+			wait = max(0, b.expiry(r.cfg.idleTimeout).Sub(t))
+		default:
+			wait = max(0, tokenBucket{}.retryAfter(&b, lim, t, lim.BurstSize))
+		}
+		return max(wait, a.burstTimeToFull(&b, t))
+	}
+
+	// full is what a brand new bucket has available
+	var fresh Bucket
+	r.algo.init(&fresh, lim, t)
+	full := r.algo.available(&fresh, lim, t)
+	if r.algo.available(&b, lim, t) >= full {
+		return 0
+	}
+	return r.retryAfter(&b, lim, t, full)
+}
+
+// peek returns the tokens available for key, how long until a request
+// would be allowed and the limit applying to key, all from one read of
+// the bucket. It does not consume a token nor create the bucket.
+func (r *rateLimiter[K]) peek(key K) (uint, time.Duration, Limit) {
+	if r.cfg.disabled {
+		lim := r.limit.Load()
+		return lim.BurstSize, 0, *lim
+	}
+
+	// b is a copy, peeking does not change the stored bucket
+	b, ok := r.store.load(key)
+	t := r.cfg.clock.Now()
+	lim := r.limitFor(&b)
+	r.sync(&b, ok, lim, t)
+	return r.algo.available(&b, lim, t), r.retryAfter(&b, lim, t, 1), *lim
+}
+
+// retryAfter returns how long until b, brought up to date at t, has n
+// tokens available.
+func (r *rateLimiter[K]) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	switch {
+	case lim.BurstSize == 0 || n > lim.BurstSize:
+		return math.MaxInt64
+	case r.algo.available(b, lim, t) >= n:
+		return 0
+	case lim.TokenRate == 0:
+		return max(0, b.expiry(r.cfg.idleTimeout).Sub(t))
+	}
+	return max(0, r.algo.retryAfter(b, lim, t, n))
+}
+
+// Flush evicts the keys idle for at least the idle timeout right away,
+// the same way the cleanup goroutine does every cleanup interval, and
+// returns how many keys were evicted. It is safe to call concurrently
+// with the cleanup goroutine and with Allow. Like the sweeps of the
+// cleanup goroutine, it is reported in Stats.
+func (r *rateLimiter[K]) Flush() int {
+	start := time.Now()
+	t := r.cfg.clock.Now()
+	// keys are collected to call onEvict once the store no longer
+	// holds any lock. Shards may be swept concurrently.
+	var (
+		mu   sync.Mutex
+		keys []K
+	)
+	evicted, scanned := r.store.deleteIdle(t, func(key K) {
+		if r.onEvict != nil {
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+		}
+	})
+	r.keys.Add(-int64(evicted))
+	r.counters.evicted.Add(uint64(evicted))
+	r.counters.sweeps.Add(1)
+	r.counters.lastSweepScanned.Store(uint64(scanned))
+	// the duration of the sweep itself, the clock of WithClock may be
+	// a simulation
+	r.counters.lastSweepDuration.Store(int64(time.Since(start)))
+	for _, key := range keys {
+		r.onEvict(key)
+	}
+	return evicted
+}
+
+// Reset restores the bucket for key to full, as if key was never seen.
+// The next Allow(key) is treated as the first request for a brand new
+// key, so it is allowed and leaves burstSize-1 tokens in the bucket.
+// It is safe to call concurrently with Allow and does nothing if key
+// is not present.
+func (r *rateLimiter[K]) Reset(key K) {
+	r.Remove(key)
+}
+
+// Remove drops the bucket for key without waiting for the cleanup
+// goroutine to evict it. It reports whether key was present.
+// It is safe to call concurrently with Allow.
+func (r *rateLimiter[K]) Remove(key K) bool {
+	ok := r.store.delete(key)
+	if ok {
+		r.keys.Add(-1)
+	}
+	return ok
 }
 
-func (r *rateLimiter) Close() {
-	close(r.done)
+// ForEach calls fn for every tracked key with the tokens it has now,
+// refills included, and the time of its last allowed request, until fn
+// returns false. No token is consumed. It is safe to call concurrently
+// with Allow, but is not a consistent snapshot of all keys: keys are not
+// read all at once, so a key may have changed, been added or been evicted
+// by the time fn sees it. fn is called without holding any lock, so it
+// may call back into the rate limiter.
+func (r *rateLimiter[K]) ForEach(fn func(key K, tokens uint, lastActivity time.Time) bool) {
+	t := r.cfg.clock.Now()
+	r.store.rangeFunc(func(key K, b Bucket) bool {
+		// b is a copy, bringing it up to date does not change the stored bucket
+		lim := r.limitFor(&b)
+		r.sync(&b, true, lim, t)
+		return fn(key, r.algo.available(&b, lim, t), b.LastActivity)
+	})
 }
 
-func validate(tokenRate float64, burstSize uint) error {
+// Clear drops the buckets of every key, e.g. to reset all quotas at once.
+// The rate limiter stays usable and keeps its limits and Stats counters.
+// It is safe to call concurrently with Allow: a request racing with Clear
+// either lands before its key is dropped, or creates the key afresh.
+// Keys dropped by Clear are not counted as evicted.
+func (r *rateLimiter[K]) Clear() {
+	deleted := r.store.deleteFunc(func(K, *Bucket) bool {
+		return true
+	})
+	r.keys.Add(-int64(deleted))
+}
+
+// DeleteFunc drops the buckets of every key for which pred returns true,
+// e.g. the keys of a tenant prefix during an incident, and returns how
+// many were dropped. Like Clear, it is safe to call concurrently with
+// Allow, and keys dropped are not counted as evicted. pred may be called
+// while a shard lock is held, so it must not call back into the rate
+// limiter.
+func (r *rateLimiter[K]) DeleteFunc(pred func(key K) bool) int {
+	deleted := r.store.deleteFunc(func(key K, _ *Bucket) bool {
+		return pred(key)
+	})
+	r.keys.Add(-int64(deleted))
+	return deleted
+}
+
+// Len returns the number of keys currently tracked. It reads a counter
+// maintained on insert and eviction, so it is cheap enough to poll from a
+// metrics endpoint.
+func (r *rateLimiter[K]) Len() int {
+	return int(r.keys.Load())
+}
+
+// Config is the configuration a rate limiter currently runs with.
+type Config struct {
+	TokenRate float64
+	BurstSize uint
+	// RefillInterval is the interval of NewEvery or WithRefillInterval,
+	// 0 when the token rate was given as such.
+	RefillInterval time.Duration
+	// CleanupInterval is 0 when created WithoutBackgroundCleanup.
+	CleanupInterval time.Duration
+	IdleTimeout     time.Duration
+}
+
+// Config returns the current configuration. TokenRate and BurstSize are
+// read together, so they are consistent with each other even while
+// SetRate, SetBurst or Reconfigure run concurrently. Per key limits set through
+// AllowWithLimit are not reflected.
+func (r *rateLimiter[K]) Config() Config {
+	lim := r.limit.Load()
+	c := Config{
+		TokenRate:       lim.TokenRate,
+		BurstSize:       lim.BurstSize,
+		RefillInterval:  lim.Interval,
+		CleanupInterval: r.cfg.cleanupInterval,
+		IdleTimeout:     r.cfg.idleTimeout,
+	}
+	if r.cfg.noCleanup {
+		c.CleanupInterval = 0
+	}
+	return c
+}
+
+// SetRate changes the token rate of every bucket at runtime. The new
+// rate applies from the next refill of each key, replacing the interval
+// of NewEvery or WithRefillInterval, if any. It returns an error,
+// leaving the current rate untouched, if tokenRate fails validation.
+func (r *rateLimiter[K]) SetRate(tokenRate float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lim := r.limit.Load()
+	if err := validate(tokenRate, lim.BurstSize, r.cfg); err != nil {
+		return err
+	}
+	r.limit.Store(&Limit{TokenRate: tokenRate, BurstSize: lim.BurstSize})
+	return nil
+}
+
+// SetBurst changes the burst size of every bucket at runtime. Buckets
+// holding more than burstSize tokens are capped on their next refill.
+// It returns an error, leaving the current burst size untouched, if
+// burstSize fails validation.
+func (r *rateLimiter[K]) SetBurst(burstSize uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	burstSize = r.cfg.burst(burstSize)
+	lim := r.limit.Load()
+	if err := validate(lim.TokenRate, burstSize, r.cfg); err != nil {
+		return err
+	}
+	r.limit.Store(&Limit{TokenRate: lim.TokenRate, BurstSize: burstSize, Interval: lim.Interval})
+	return nil
+}
+
+// Reconfigure changes both the token rate and the burst size at runtime,
+// replacing the interval of NewEvery or WithRefillInterval like SetRate.
+// They are swapped in together, so a concurrent request sees either the
+// old or the new pair, never the new rate with the old burst size as it
+// could between SetRate and SetBurst. Buckets holding more than burstSize
+// tokens are capped on their next refill, which every request and every
+// read like Tokens or Debug runs first, so a lower burst size applies
+// right away to idle keys as well, without a pass over every key. It
+// returns an error, leaving the current configuration untouched, if
+// either value fails validation.
+func (r *rateLimiter[K]) Reconfigure(tokenRate float64, burstSize uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	burstSize = r.cfg.burst(burstSize)
+	if err := validate(tokenRate, burstSize, r.cfg); err != nil {
+		return err
+	}
+	r.limit.Store(&Limit{TokenRate: tokenRate, BurstSize: burstSize})
+	return nil
+}
+
+// Drain stops admitting keys not tracked yet, e.g. during a graceful
+// shutdown or to shed load: their requests are rejected, with a
+// RetryAfter of the maximum duration, while tracked keys keep spending
+// and refilling their tokens as usual. Keys evicted while draining are
+// new again. Undrain admits new keys again.
+func (r *rateLimiter[K]) Drain() {
+	r.draining.Store(true)
+}
+
+// Undrain undoes Drain.
+func (r *rateLimiter[K]) Undrain() {
+	r.draining.Store(false)
+}
+
+// Close stops the cleanup goroutine, if any. It is safe to call more
+// than once, calls after the first one do nothing.
+//
+// A closed rate limiter denies every request: Allow and its variants
+// return false, and AllowCtx returns ErrClosed, without adding keys no
+// goroutine would evict anymore. Those requests are not counted in Stats.
+// Keys tracked before Close can still be read, and evicted with Flush.
+func (r *rateLimiter[K]) Close() {
+	r.closeOnce.Do(func() {
+		r.closed.Store(true)
+		close(r.done)
+	})
+}
+
+// CloseContext is like Close, but also waits for the cleanup goroutine to
+// return, e.g. so that goroutine leak checks at the end of a test pass.
+// A cleanup pass under way is finished first. It returns ctx.Err() if ctx
+// is done before then, the rate limiter being closed regardless.
+//
+// CloseContext must not be called from a WithOnEvict callback run by the
+// cleanup goroutine, which would then wait for itself until ctx is done.
+func (r *rateLimiter[K]) CloseContext(ctx context.Context) error {
+	r.Close()
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func validate(tokenRate float64, burstSize uint, cfg config) error {
+
+	switch cfg.zeroBurst {
+	case ZeroBurstReject, ZeroBurstMinimal:
+	case ZeroBurstInvalid:
+		if burstSize == 0 {
+			return errors.New("burst size should be positive")
+		}
+	default:
+		return errors.New("unknown zero burst mode")
+	}
+
+	// NaN fails every comparison, so it would pass the checks below
+	if math.IsNaN(tokenRate) {
+		return errors.New("token rate should be a number")
+	}
 
 	if tokenRate < 0 {
-		return errors.New("token rate should not be negative")
+		return fmt.Errorf("%w, got %v", ErrNegativeRate, tokenRate)
 	}
 
-	// tokenRate * 5000 should not be over uint limit as it will overflow at line 105
-	// every 3600 seconds, cleanup goroutine cleanup keys which have lastactivity greater than
-	// 3600 seconds.
-	// there can be such case where cleanup activity takes more time, hence 5000 is used
-	if tokenRate*5000 > math.MaxUint {
-		return errors.New("token rate limit overflow")
+	if cfg.cleanupInterval <= 0 {
+		return errors.New("cleanup interval should be positive")
 	}
 
-	// check if a * 5000 + b <= 2 ^ maxIntSize
-	// => a * 5000 <= (2 ^ maxIntSize) - b
-	// -> a <= ((2 ^ maxIntSize) - b) / 5000
+	if cfg.idleTimeout <= 0 {
+		return errors.New("idle timeout should be positive")
+	}
+
+	if cfg.cleanupWorkers < 0 {
+		return errors.New("cleanup workers should not be negative")
+	}
+
+	if cfg.shards <= 0 {
+		return errors.New("shard count should be positive")
+	}
+
+	if cfg.shards&(cfg.shards-1) != 0 {
+		return errors.New("shard count should be a power of two")
+	}
+
+	if cfg.maxKeys < 0 {
+		return errors.New("max keys should not be negative")
+	}
+
+	if cfg.initialCapacity < 0 {
+		return errors.New("initial capacity should not be negative")
+	}
+
+	if cfg.maxRetries <= 0 {
+		return errors.New("max retries should be positive")
+	}
+
+	if cfg.retryBackoff != nil && *cfg.retryBackoff < 0 {
+		return errors.New("retry backoff should not be negative")
+	}
+
+	if cfg.queueDepth < 0 {
+		return errors.New("queue depth should not be negative")
+	}
+
+	// negated, so that NaN fails too
+	if !(cfg.jitter >= 0 && cfg.jitter <= 1) {
+		return errors.New("jitter should be between 0 and 1")
+	}
+
+	if err := validateAIMD(cfg); err != nil {
+		return err
+	}
+
+	if cfg.algorithm.impl() == nil {
+		return errors.New("unknown algorithm")
+	}
+
+	if cfg.tier != nil {
+		if err := validateTier(tokenRate, cfg); err != nil {
+			return err
+		}
+	}
+
+	if math.IsInf(tokenRate, 1) {
+		// buckets are filled on every refill, no count can overflow
+		return nil
+	}
+
+	// tokenRate * maxElapsed should not be over uint limit. refill saturates
+	// at burstSize so it cannot overflow, but a rate that fills more than
+	// the uint range within the cleanup window is almost surely a mistake.
+	// every cleanupInterval, cleanup goroutine cleanup keys which have lastactivity
+	// older than idleTimeout, so a key can remain for at most
+	// idleTimeout + cleanupInterval.
+	maxElapsed := maxElapsed(cfg)
+	if tokenRate*maxElapsed > math.MaxUint {
+		return fmt.Errorf("%w: %v tokens per second over the %v of idle timeout and cleanup interval, lower the token rate to at most %v or the idle timeout",
+			ErrRateOverflow, tokenRate, time.Duration(maxElapsed*float64(time.Second)), math.MaxUint/maxElapsed)
+	}
+
+	// check if a * maxElapsed + b <= 2 ^ maxIntSize
+	// => a * maxElapsed <= (2 ^ maxIntSize) - b
+	// -> a <= ((2 ^ maxIntSize) - b) / maxElapsed
 
 	var maxValue uint = math.MaxUint
 
-	if tokenRate > float64(maxValue-burstSize)/5000.0 {
-		return errors.New("limit overflow")
+	if maxRate := float64(maxValue-burstSize) / maxElapsed; tokenRate > maxRate {
+		return fmt.Errorf("%w: %v tokens per second with a burst size of %d, lower the token rate to at most %v or the burst size",
+			ErrBurstRateOverflow, tokenRate, burstSize, maxRate)
 	}
 	return nil
 }
+
+// maxElapsed returns the worst case time in seconds a bucket can go
+// without being refilled before the cleanup goroutine evicts it.
+func maxElapsed(cfg config) float64 {
+	// added as float seconds, as summing two large durations
+	// can overflow time.Duration.
+	return cfg.idleTimeout.Seconds() + cfg.cleanupInterval.Seconds()
+}
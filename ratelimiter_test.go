@@ -1,14 +1,43 @@
 package ratelimiter
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"math"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
 	"time"
 )
 
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
 func TestInput(t *testing.T) {
 	t.Parallel()
 
@@ -16,6 +45,7 @@ func TestInput(t *testing.T) {
 		name        string
 		tokenRate   float64
 		burstSize   uint
+		opts        []Option
 		shouldError bool
 	}{
 		{
@@ -31,15 +61,16 @@ func TestInput(t *testing.T) {
 			shouldError: true,
 		},
 		{
+			// 3900 seconds is default idle timeout(3600s) + cleanup interval(300s)
 			name:        "boundary condition for code to not panic",
-			tokenRate:   math.MaxUint / 5000,
+			tokenRate:   math.MaxUint / 3900,
 			burstSize:   0,
 			shouldError: false,
 		},
 		{
 
 			name:        "boundary condition for code to panic",
-			tokenRate:   (math.MaxUint / 5000) + 1,
+			tokenRate:   (math.MaxUint / 3900) + 1,
 			burstSize:   0,
 			shouldError: true,
 		},
@@ -55,12 +86,218 @@ func TestInput(t *testing.T) {
 			burstSize:   23,
 			shouldError: true,
 		},
+		{
+			name:        "cleanup interval is zero",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithCleanupInterval(0)},
+			shouldError: true,
+		},
+		{
+			name:        "idle timeout is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithIdleTimeout(-time.Second)},
+			shouldError: true,
+		},
+		{
+			name:        "shard count is zero",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithShards(0)},
+			shouldError: true,
+		},
+		{
+			name:        "shard count is not a power of two",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithShards(100)},
+			shouldError: true,
+		},
+		{
+			name:        "max retries is zero",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithMaxRetries(0)},
+			shouldError: true,
+		},
+		{
+			name:        "retry backoff is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithRetryBackoff(-time.Millisecond)},
+			shouldError: true,
+		},
+		{
+			name:        "queue depth is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithQueueDepth(-1)},
+			shouldError: true,
+		},
+		{
+			name:        "cleanup workers is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithCleanupWorkers(-1)},
+			shouldError: true,
+		},
+		{
+			name:        "retry backoff is zero",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithRetryBackoff(0)},
+			shouldError: false,
+		},
+		{
+			name:        "burst size is zero when invalid",
+			tokenRate:   10,
+			burstSize:   0,
+			opts:        []Option{WithZeroBurst(ZeroBurstInvalid)},
+			shouldError: true,
+		},
+		{
+			name:        "zero burst mode is unknown",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithZeroBurst(ZeroBurst(-1))},
+			shouldError: true,
+		},
+		{
+			name:        "initial capacity is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithInitialCapacity(-1)},
+			shouldError: true,
+		},
+		{
+			name:        "aimd decrease is 1",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithAIMD(1, 0.1, 0.01)},
+			shouldError: true,
+		},
+		{
+			name:        "aimd increase is zero",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithAIMD(0.5, 0, 0.01)},
+			shouldError: true,
+		},
+		{
+			name:        "aimd min factor is NaN",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithAIMD(0.5, 0.1, math.NaN())},
+			shouldError: true,
+		},
+		{
+			name:        "jitter is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithJitter(-0.1)},
+			shouldError: true,
+		},
+		{
+			name:        "jitter is above 1",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithJitter(1.5)},
+			shouldError: true,
+		},
+		{
+			name:        "jitter is NaN",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithJitter(math.NaN())},
+			shouldError: true,
+		},
+		{
+			name:        "initial tokens exceed burst size",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithInitialTokens(11)},
+			shouldError: true,
+		},
+		{
+			name:        "max keys is negative",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithMaxKeys(-1)},
+			shouldError: true,
+		},
+		{
+			// 110 seconds is idle timeout(100s) + cleanup interval(10s)
+			name:        "boundary condition with custom idle timeout",
+			tokenRate:   math.MaxUint / 110,
+			burstSize:   0,
+			opts:        []Option{WithIdleTimeout(100 * time.Second), WithCleanupInterval(10 * time.Second)},
+			shouldError: false,
+		},
+		{
+			// 86700 seconds is idle timeout(86400s) + default cleanup interval(300s)
+			name:        "boundary condition with long idle timeout",
+			tokenRate:   math.MaxUint / 86700,
+			burstSize:   0,
+			opts:        []Option{WithIdleTimeout(24 * time.Hour)},
+			shouldError: false,
+		},
+		{
+			name:        "boundary overflows with long idle timeout",
+			tokenRate:   (math.MaxUint / 86700) + 1,
+			burstSize:   0,
+			opts:        []Option{WithIdleTimeout(24 * time.Hour)},
+			shouldError: true,
+		},
+		{
+			// 7200 seconds is default idle timeout(3600s) + cleanup interval(3600s)
+			name:        "boundary overflows with long cleanup interval",
+			tokenRate:   (math.MaxUint / 7200) + 1,
+			burstSize:   0,
+			opts:        []Option{WithCleanupInterval(time.Hour)},
+			shouldError: true,
+		},
+		{
+			name:        "default boundary overflows with longer idle timeout",
+			tokenRate:   math.MaxUint / 3900,
+			burstSize:   0,
+			opts:        []Option{WithIdleTimeout(2 * time.Hour)},
+			shouldError: true,
+		},
+		{
+			name:        "algorithm is unknown",
+			tokenRate:   10,
+			burstSize:   10,
+			opts:        []Option{WithAlgorithm(Algorithm(-1))},
+			shouldError: true,
+		},
+		{
+			name:        "token rate is infinite",
+			tokenRate:   math.Inf(1),
+			burstSize:   math.MaxUint,
+			shouldError: false,
+		},
+		{
+			name:        "token rate is negative infinity",
+			tokenRate:   math.Inf(-1),
+			burstSize:   10,
+			shouldError: true,
+		},
+		{
+			name:        "token rate is NaN",
+			tokenRate:   math.NaN(),
+			burstSize:   10,
+			shouldError: true,
+		},
 	}
 
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			_, err := New(tc.tokenRate, tc.burstSize)
+			r, err := New(tc.tokenRate, tc.burstSize, tc.opts...)
+			if err == nil {
+				defer r.Close()
+			}
 
 			if tc.shouldError && err == nil {
 				t.Errorf("expected error, but got nil error")
@@ -73,6 +310,184 @@ func TestInput(t *testing.T) {
 	}
 }
 
+func TestInputErrors(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		tokenRate float64
+		burstSize uint
+		opts      []Option
+		err       error
+	}{
+		{
+			name:      "token rate is negative",
+			tokenRate: -1,
+			burstSize: 10,
+			err:       ErrNegativeRate,
+		},
+		{
+			name:      "token rate overflows over the idle timeout",
+			tokenRate: math.MaxUint,
+			burstSize: 10,
+			err:       ErrRateOverflow,
+		},
+		{
+			name:      "token rate overflows with the burst size",
+			tokenRate: math.MaxUint / 3900,
+			burstSize: math.MaxUint / 2,
+			err:       ErrBurstRateOverflow,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r, err := New(tc.tokenRate, tc.burstSize, tc.opts...)
+			if err == nil {
+				r.Close()
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	rateLimiter, _ := New(1, 10)
+	defer rateLimiter.Close()
+
+	if err := rateLimiter.SetRate(-1); !errors.Is(err, ErrNegativeRate) {
+		t.Errorf("expected error %v, got %v", ErrNegativeRate, err)
+	}
+}
+
+func TestNewWithInterval(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		new       func() (*rateLimiter[string], error)
+		tokenRate float64
+	}{
+		{
+			name:      "per second",
+			new:       func() (*rateLimiter[string], error) { return PerSecond(10, 20) },
+			tokenRate: 10,
+		},
+		{
+			name:      "per minute",
+			new:       func() (*rateLimiter[string], error) { return PerMinute(1, 1) },
+			tokenRate: 1.0 / 60,
+		},
+		{
+			name:      "per hour",
+			new:       func() (*rateLimiter[string], error) { return PerHour(90, 5) },
+			tokenRate: 90.0 / 3600,
+		},
+		{
+			name:      "per 100 milliseconds",
+			new:       func() (*rateLimiter[string], error) { return NewWithInterval(100*time.Millisecond, 3, 3) },
+			tokenRate: 30,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rateLimiter, err := tc.new()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			defer rateLimiter.Close()
+
+			if tokenRate := rateLimiter.limit.Load().TokenRate; tokenRate != tc.tokenRate {
+				t.Errorf("expected token rate %v, got %v", tc.tokenRate, tokenRate)
+			}
+		})
+	}
+
+	if _, err := NewWithInterval(0, 1, 1); err == nil {
+		t.Error("expected error for zero interval, but got nil error")
+	}
+}
+
+func TestNewEvery(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	every, err := NewEvery(time.Minute, 1, WithClock(clock))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer every.Close()
+	approx, _ := New(0.0167, 1, WithClock(clock))
+	defer approx.Close()
+
+	every.Allow("key")
+	approx.Allow("key")
+
+	if retryAfter := every.RetryAfter("key"); retryAfter != time.Minute {
+		t.Errorf("expected retry after %v, got %v", time.Minute, retryAfter)
+	}
+	// a rate rounded to a float per second drifts from the minute
+	if retryAfter := approx.RetryAfter("key"); retryAfter == time.Minute {
+		t.Errorf("expected retry after to drift from %v, got it exactly", time.Minute)
+	}
+
+	clock.Advance(time.Minute - time.Nanosecond)
+	if every.Allow("key") {
+		t.Fatal("expected request a nanosecond before the minute to be rejected, got allowed")
+	}
+	clock.Advance(time.Nanosecond)
+	if !every.Allow("key") {
+		t.Fatal("expected request on the minute to be allowed, got rejected")
+	}
+
+	expected := Config{TokenRate: 1.0 / 60, BurstSize: 1, RefillInterval: time.Minute, CleanupInterval: 5 * time.Minute, IdleTimeout: time.Hour}
+	if cfg := every.Config(); cfg != expected {
+		t.Errorf("expected config %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestRefillIntervalExact(t *testing.T) {
+	t.Parallel()
+
+	// 3 tokens at 1/0.007 tokens per second take 20.999999ms once
+	// converted back to a duration
+	clock := newFakeClock()
+	every, _ := New(0, 3, WithClock(clock), WithRefillInterval(7*time.Millisecond))
+	defer every.Close()
+	approx, _ := New(1/(7*time.Millisecond).Seconds(), 3, WithClock(clock))
+	defer approx.Close()
+
+	every.AllowN("key", 3)
+	approx.AllowN("key", 3)
+
+	if full := every.TimeToFull("key"); full != 21*time.Millisecond {
+		t.Errorf("expected time to full of 21ms, got %v", full)
+	}
+	if full := approx.TimeToFull("key"); full != 21*time.Millisecond-time.Nanosecond {
+		t.Errorf("expected time to full of 20.999999ms, got %v", full)
+	}
+
+	// SetBurst keeps the interval, SetRate replaces it
+	_ = every.SetBurst(6)
+	if interval := every.Config().RefillInterval; interval != 7*time.Millisecond {
+		t.Errorf("expected refill interval of 7ms, got %v", interval)
+	}
+	_ = every.SetRate(10)
+	if interval := every.Config().RefillInterval; interval != 0 {
+		t.Errorf("expected no refill interval, got %v", interval)
+	}
+
+	if _, err := NewEvery(0, 1); err == nil {
+		t.Error("expected error for zero interval, but got nil error")
+	}
+	if _, err := New(1, 1, WithRefillInterval(-time.Second)); err == nil {
+		t.Error("expected error for negative interval, but got nil error")
+	}
+}
+
 func TestAllow(t *testing.T) {
 	t.Parallel()
 
@@ -104,6 +519,20 @@ func TestAllow(t *testing.T) {
 			requests:  5,
 			allowed:   0,
 		},
+		{
+			name:      "when token rate is infinite",
+			tokenRate: math.Inf(1),
+			burstSize: 1,
+			requests:  100,
+			allowed:   100,
+		},
+		{
+			name:      "when token rate is infinite and burst size is 0",
+			tokenRate: math.Inf(1),
+			burstSize: 0,
+			requests:  5,
+			allowed:   0,
+		},
 	}
 
 	for _, tc := range tcs {
@@ -126,6 +555,78 @@ func TestAllow(t *testing.T) {
 	}
 }
 
+func TestAllowDisabled(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name      string
+		tokenRate float64
+		burstSize uint
+	}{
+		{
+			name:      "when burst size is 1",
+			tokenRate: 1,
+			burstSize: 1,
+		},
+		{
+			name:      "when burst size is 0",
+			tokenRate: 1,
+			burstSize: 0,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rateLimiter, _ := New(tc.tokenRate, tc.burstSize, WithDisabled(true))
+			defer rateLimiter.Close()
+
+			for range 100 {
+				if !rateLimiter.Allow("key") {
+					t.Fatal("expected allowed to be true, got false")
+				}
+			}
+
+			if n := rateLimiter.Len(); n != 0 {
+				t.Errorf("expected no keys to be tracked, got %d", n)
+			}
+			if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 0 {
+				t.Errorf("expected retry after of 0, got %v", retryAfter)
+			}
+			if allowed := rateLimiter.Stats().Allowed; allowed != 100 {
+				t.Errorf("expected 100 allowed requests, got %d", allowed)
+			}
+		})
+	}
+}
+
+func TestAllowE(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 1, WithClock(clock))
+
+	if err := rateLimiter.AllowE("a"); err != nil {
+		t.Errorf("expected allowed request to return nil, got %v", err)
+	}
+	if err := rateLimiter.AllowE("a"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected rate limited error, got %v", err)
+	}
+	if err := rateLimiter.AllowE("a"); errors.Is(err, ErrContention) {
+		t.Error("expected throttling not to be reported as contention, got contention")
+	}
+	noCapacity, _ := New(1, 0, WithClock(clock))
+	defer noCapacity.Close()
+	if err := noCapacity.AllowE("a"); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected no capacity error, got %v", err)
+	}
+
+	rateLimiter.Close()
+	if err := rateLimiter.AllowE("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
+
 func TestAllowWhenKeyIsEvictedFromCache(t *testing.T) {
 
 	synctest.Test(t, func(t *testing.T) {
@@ -145,25 +646,118 @@ func TestAllowWhenKeyIsEvictedFromCache(t *testing.T) {
 
 		synctest.Wait()
 
-		if allowed := rateLimiter.Allow("user1"); !allowed {
+		if rateLimiter.Has("user1") {
 			t.Fatal("expected key to be evicted, but it wasn't")
 		}
+		if allowed := rateLimiter.Allow("user1"); !allowed {
+			t.Fatal("expected evicted key to be allowed, got false")
+		}
 	})
 }
 
-func TestAllowTokenRateFill(t *testing.T) {
-
-	synctest.Test(t, func(t *testing.T) {
+func TestHas(t *testing.T) {
+	t.Parallel()
 
-		rateLimiter, _ := New(1, 10) // one token per second; burst size of 10
-		defer rateLimiter.Close()
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 1, WithClock(clock), WithIdleTimeout(time.Minute))
+	defer rateLimiter.Close()
 
-		for range 10 {
+	if rateLimiter.Has("key") {
+		t.Error("expected unknown key not to be tracked, got tracked")
+	}
+	if n := rateLimiter.Len(); n != 0 {
+		t.Errorf("expected Has not to track the key, got %d keys", n)
+	}
 
-			if allowed := rateLimiter.Allow("user1"); !allowed {
-				t.Fatal("expected allowed to be true, got false")
-			}
-		}
+	rateLimiter.Allow("key")
+	clock.Advance(time.Minute)
+
+	// idle, but not swept yet
+	if !rateLimiter.Has("key") {
+		t.Error("expected key to be tracked until the next sweep, got untracked")
+	}
+	if b, _ := rateLimiter.store.load("key"); b.Tokens != 0 {
+		t.Errorf("expected Has not to refill the bucket, got %d tokens", b.Tokens)
+	}
+
+	rateLimiter.Flush()
+	if rateLimiter.Has("key") {
+		t.Error("expected key to be evicted, got tracked")
+	}
+}
+
+func TestCreatedAt(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 1, WithClock(clock))
+	defer rateLimiter.Close()
+
+	if _, ok := rateLimiter.CreatedAt("key"); ok {
+		t.Error("expected unknown key to be reported missing, got found")
+	}
+
+	created := clock.Now()
+	rateLimiter.Allow("key")
+	clock.Advance(time.Minute)
+	rateLimiter.Allow("key")
+	// rejected requests do not change it either
+	rateLimiter.Allow("key")
+
+	if at, ok := rateLimiter.CreatedAt("key"); !ok || !at.Equal(created) {
+		t.Errorf("expected key created at %v, got %v, %v", created, at, ok)
+	}
+	if state := rateLimiter.Debug()["key"]; !state.CreatedAt.Equal(created) || !state.LastActivity.Equal(clock.Now()) {
+		t.Errorf("expected key created at %v and last active at %v, got %+v", created, clock.Now(), state)
+	}
+
+	// a key seen again after being removed starts over
+	rateLimiter.Remove("key")
+	clock.Advance(time.Minute)
+	rateLimiter.Allow("key")
+	if at, _ := rateLimiter.CreatedAt("key"); !at.Equal(clock.Now()) {
+		t.Errorf("expected key created at %v, got %v", clock.Now(), at)
+	}
+}
+
+func TestAllowWithCustomIdleTimeout(t *testing.T) {
+
+	synctest.Test(t, func(t *testing.T) {
+
+		rateLimiter, _ := New(0.0167, 1, WithCleanupInterval(time.Second), WithIdleTimeout(10*time.Second))
+		defer rateLimiter.Close()
+
+		if allowed := rateLimiter.Allow("user1"); !allowed {
+			t.Fatal("expected allowed to be true, got false")
+		}
+
+		if allowed := rateLimiter.Allow("user1"); allowed {
+			t.Fatal("expected allowed to be false, got true")
+		}
+
+		time.Sleep(11 * time.Second)
+
+		synctest.Wait()
+
+		if allowed := rateLimiter.Allow("user1"); !allowed {
+			t.Fatal("expected key to be evicted, but it wasn't")
+		}
+	})
+}
+
+func TestAllowTokenRateFill(t *testing.T) {
+
+	synctest.Test(t, func(t *testing.T) {
+
+		rateLimiter, _ := New(1, 10) // one token per second; burst size of 10
+		defer rateLimiter.Close()
+
+		for range 10 {
+
+			if allowed := rateLimiter.Allow("user1"); !allowed {
+				t.Fatal("expected allowed to be true, got false")
+			}
+		}
 
 		if allowed := rateLimiter.Allow("user1"); allowed {
 			t.Fatal("expected allowed to be false, got true")
@@ -179,41 +773,1678 @@ func TestAllowTokenRateFill(t *testing.T) {
 			}
 		}
 
-		if allowed := rateLimiter.Allow("user1"); allowed {
-			t.Fatal("expected allowed to be false, got true")
-		}
-	})
+		if allowed := rateLimiter.Allow("user1"); allowed {
+			t.Fatal("expected allowed to be false, got true")
+		}
+	})
+}
+
+func TestAllowSteadyTraffic(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(10, 10)
+		defer rateLimiter.Close()
+
+		for range 10 {
+			if !rateLimiter.Allow("key") {
+				t.Error("expected ratelimiter to allow, but not allowed")
+			}
+		}
+
+		if rateLimiter.Allow("key") {
+			t.Error("expected 11th request to not be allowed, but allowed")
+		}
+
+		time.Sleep(500 * time.Millisecond)
+		synctest.Wait()
+
+		for range 5 {
+			if !rateLimiter.Allow("key") {
+				t.Error("expected ratelimiter to allow, but not allowed")
+			}
+		}
+
+		if rateLimiter.Allow("key") {
+			t.Error("expected 6th request to be not allowed, but allowed")
+		}
+
+	})
+}
+
+func TestAllowRefillKeepsRemainder(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name     string
+		interval time.Duration
+		allowed  int
+	}{
+		{
+			name:     "request every 100ms",
+			interval: 100 * time.Millisecond,
+			allowed:  10,
+		},
+		{
+			name:     "request every 300ms",
+			interval: 300 * time.Millisecond,
+			allowed:  9,
+		},
+		{
+			name:     "request every 700ms",
+			interval: 700 * time.Millisecond,
+			allowed:  9,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			synctest.Test(t, func(t *testing.T) {
+				rateLimiter, _ := New(1, 5) // one token per second; burst size of 5
+				defer rateLimiter.Close()
+
+				// drain the initial burst so only refilled tokens are counted
+				for range 5 {
+					if !rateLimiter.Allow("key") {
+						t.Fatal("expected allowed to be true, got false")
+					}
+				}
+
+				allowed := 0
+				for range int(10 * time.Second / tc.interval) {
+					time.Sleep(tc.interval)
+					synctest.Wait()
+					if rateLimiter.Allow("key") {
+						allowed++
+					}
+				}
+
+				if allowed != tc.allowed {
+					t.Errorf("expected allowed requests: %d, got: %d", tc.allowed, allowed)
+				}
+			})
+		})
+	}
+}
+
+func TestAllowWithClock(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	for range 2 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	clock.Advance(time.Second)
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true after clock advanced, got false")
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+}
+
+func TestAllowClockGoingBackwards(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 3, WithClock(clock))
+	defer rateLimiter.Close()
+
+	for range 3 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	// the clock steps back an hour, which must not refill the bucket
+	clock.Advance(-time.Hour)
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false after clock went backwards, got true")
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 0 {
+		t.Errorf("expected 0 tokens, got %d", tokens)
+	}
+
+	// tokens are only granted again once the clock passes the last refill
+	clock.Advance(time.Hour + time.Second)
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true after clock caught up, got false")
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+}
+
+func TestAllowClockJumpingForward(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range allAlgorithms {
+		clock := newFakeClock()
+		rateLimiter, _ := New(1, 3, WithClock(clock), WithAlgorithm(algorithm))
+		defer rateLimiter.Close()
+
+		for range 3 {
+			rateLimiter.Allow("key")
+		}
+
+		// a wall clock jump, as seen by a clock without monotonic readings
+		clock.Advance(24 * 365 * time.Hour)
+
+		if tokens := rateLimiter.Tokens("key"); tokens != 3 {
+			t.Errorf("algorithm %d: expected refill to stop at 3 tokens, got %d", algorithm, tokens)
+		}
+		allowed := 0
+		for range 10 {
+			if rateLimiter.Allow("key") {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("algorithm %d: expected 3 requests allowed after the jump, got %d", algorithm, allowed)
+		}
+	}
+}
+
+func TestAllowAt(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 2)
+	defer rateLimiter.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if !rateLimiter.AllowAt("key", start) || !rateLimiter.AllowAt("key", start) {
+		t.Fatal("expected burst to be allowed, got false")
+	}
+	if rateLimiter.AllowAt("key", start.Add(999*time.Millisecond)) {
+		t.Error("expected request before a token is refilled to be rejected, got allowed")
+	}
+	if !rateLimiter.AllowAt("key", start.Add(time.Second)) {
+		t.Error("expected request once a token is refilled to be allowed, got rejected")
+	}
+
+	// a time before the last refill grants no tokens
+	if rateLimiter.AllowAt("key", start.Add(-time.Hour)) {
+		t.Error("expected request in the past to be rejected, got allowed")
+	}
+	if !rateLimiter.AllowAt("key", start.Add(10*time.Second)) {
+		t.Error("expected request after the next refill to be allowed, got rejected")
+	}
+
+	// the token left is consumed, but the last activity does not move back
+	if !rateLimiter.AllowAt("key", start.Add(5*time.Second)) {
+		t.Error("expected request using the token left to be allowed, got rejected")
+	}
+	if b, _ := rateLimiter.store.load("key"); !b.LastActivity.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("expected last activity %v, got %v", start.Add(10*time.Second), b.LastActivity)
+	}
+}
+
+func TestInitialTokens(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(2, 4, WithClock(clock), WithInitialTokens(0))
+	defer rateLimiter.Close()
+
+	if rateLimiter.Allow("key") {
+		t.Error("expected request of a fresh key to be rejected, got allowed")
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 500*time.Millisecond {
+		t.Errorf("expected retry after %v, got %v", 500*time.Millisecond, retryAfter)
+	}
+
+	clock.Advance(499 * time.Millisecond)
+	if rateLimiter.Allow("key") {
+		t.Error("expected request before 1/tokenRate seconds to be rejected, got allowed")
+	}
+
+	clock.Advance(time.Millisecond)
+	if !rateLimiter.Allow("key") {
+		t.Error("expected request after 1/tokenRate seconds to be allowed, got rejected")
+	}
+	if rateLimiter.Allow("key") {
+		t.Error("expected request to be rejected once the earned token is used, got allowed")
+	}
+
+	for _, algorithm := range allAlgorithms {
+		rateLimiter, _ := New(2, 4, WithClock(clock), WithAlgorithm(algorithm), WithInitialTokens(1))
+		defer rateLimiter.Close()
+
+		if tokens := rateLimiter.Tokens("key"); tokens != 1 {
+			t.Errorf("algorithm %d: expected 1 token for a fresh key, got %d", algorithm, tokens)
+		}
+		if !rateLimiter.Allow("key") {
+			t.Errorf("algorithm %d: expected first request to be allowed, got rejected", algorithm)
+		}
+		if rateLimiter.Allow("key") {
+			t.Errorf("algorithm %d: expected second request to be rejected, got allowed", algorithm)
+		}
+	}
+}
+
+func TestAllowRefillDoesNotOverflow(t *testing.T) {
+	t.Parallel()
+
+	// the highest rate validate accepts for this burst with the default
+	// timeouts, which fills the bucket within the 3900s cleanup window.
+	var burstSize uint = 1 << 63
+	tokenRate := float64(math.MaxUint-burstSize) / 3900
+
+	clock := newFakeClock()
+	rateLimiter, err := New(tokenRate, burstSize, WithClock(clock))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer rateLimiter.Close()
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+
+	// a gap longer than the cleanup window, as if the cleanup goroutine
+	// stalled. the tokens refilled in that time plus the tokens left in
+	// the bucket do not fit in a uint.
+	clock.Advance(5000 * time.Second)
+
+	if tokens := rateLimiter.Tokens("key"); tokens != burstSize {
+		t.Errorf("expected bucket to be capped at %d tokens, got %d", burstSize, tokens)
+	}
+}
+
+func TestWithoutBackgroundCleanup(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		// not closed on purpose, synctest fails the test if a goroutine
+		// started by New is left blocked
+		rateLimiter, _ := New(0, 1, WithoutBackgroundCleanup(), WithIdleTimeout(time.Minute))
+
+		rateLimiter.Allow("key")
+		time.Sleep(time.Minute + defaultCleanupInterval)
+		synctest.Wait()
+
+		if n := rateLimiter.Len(); n != 1 {
+			t.Errorf("expected idle key to be kept until Flush, got %d keys", n)
+		}
+		if evicted := rateLimiter.Flush(); evicted != 1 {
+			t.Errorf("expected 1 key to be evicted, got %d", evicted)
+		}
+		if interval := rateLimiter.Config().CleanupInterval; interval != 0 {
+			t.Errorf("expected cleanup interval 0, got %v", interval)
+		}
+	})
+}
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(0, 1, WithClock(clock), WithIdleTimeout(time.Minute))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("a")
+	clock.Advance(30 * time.Second)
+	rateLimiter.Allow("b")
+
+	if evicted := rateLimiter.Flush(); evicted != 0 {
+		t.Errorf("expected no key to be evicted, got %d", evicted)
+	}
+
+	clock.Advance(30 * time.Second)
+
+	// "a" has been idle for the idle timeout, "b" only for half of it
+	if evicted := rateLimiter.Flush(); evicted != 1 {
+		t.Errorf("expected 1 key to be evicted, got %d", evicted)
+	}
+	if n := rateLimiter.Len(); n != 1 {
+		t.Errorf("expected 1 key left, got %d", n)
+	}
+	if !rateLimiter.Allow("a") {
+		t.Error("expected evicted key to be allowed again, got false")
+	}
+	if rateLimiter.Allow("b") {
+		t.Error("expected remaining key to be rejected, got true")
+	}
+	if evicted := rateLimiter.Stats().Evicted; evicted != 1 {
+		t.Errorf("expected 1 eviction in stats, got %d", evicted)
+	}
+}
+
+func TestFlushAfterActivity(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 10, WithClock(clock), WithIdleTimeout(time.Minute))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("a")
+	rateLimiter.Allow("b")
+	rateLimiter.Allow("c")
+	clock.Advance(30 * time.Second)
+	// "a" is now the most recently active key, "c" is gone
+	rateLimiter.Allow("a")
+	rateLimiter.Remove("c")
+	clock.Advance(30 * time.Second)
+
+	if evicted := rateLimiter.Flush(); evicted != 1 {
+		t.Errorf("expected 1 key to be evicted, got %d", evicted)
+	}
+	if _, ok := rateLimiter.store.load("b"); ok {
+		t.Error("expected idle key to be evicted, got present")
+	}
+	if _, ok := rateLimiter.store.load("a"); !ok {
+		t.Error("expected active key to be kept, got evicted")
+	}
+
+	clock.Advance(30 * time.Second)
+
+	if evicted := rateLimiter.Flush(); evicted != 1 {
+		t.Errorf("expected 1 key to be evicted, got %d", evicted)
+	}
+	if n := rateLimiter.Len(); n != 0 {
+		t.Errorf("expected no key left, got %d", n)
+	}
+}
+
+func TestCleanupWorkers(t *testing.T) {
+	t.Parallel()
+
+	for _, workers := range []int{1, 3, 16, 64} {
+		clock := newFakeClock()
+		var (
+			mu      sync.Mutex
+			evicted = map[int]bool{}
+		)
+		rateLimiter, _ := NewKeyed[int](1, 10,
+			WithClock(clock),
+			WithIdleTimeout(time.Minute),
+			WithShards(16),
+			WithCleanupWorkers(workers),
+			WithOnEvict(func(key int) {
+				mu.Lock()
+				evicted[key] = true
+				mu.Unlock()
+			}),
+		)
+
+		for i := range 1000 {
+			rateLimiter.Allow(i)
+		}
+		clock.Advance(30 * time.Second)
+		rateLimiter.Allow(0)
+		clock.Advance(30 * time.Second)
+
+		// every key but 0 has been idle for the idle timeout
+		if n := rateLimiter.Flush(); n != 999 {
+			t.Errorf("expected 999 keys to be evicted by %d workers, got %d", workers, n)
+		}
+		if len(evicted) != 999 || evicted[0] {
+			t.Errorf("expected every key but 0 to be reported evicted by %d workers, got %d keys", workers, len(evicted))
+		}
+		if scanned := rateLimiter.Stats().LastSweepScanned; scanned != 1000 {
+			t.Errorf("expected the evicted keys and the shard of key 0 to be scanned by %d workers, got %d", workers, scanned)
+		}
+		rateLimiter.Close()
+	}
+
+	rateLimiter, _ := New(1, 10, WithShards(1))
+	defer rateLimiter.Close()
+
+	if sweepers := rateLimiter.store.(*shardedMap[string]).sweepers; sweepers != 1 {
+		t.Errorf("expected no more workers than shards by default, got %d", sweepers)
+	}
+}
+
+func TestAllowWithTTL(t *testing.T) {
+	t.Parallel()
+
+	for _, store := range []Store{nil, NewSyncMapStore()} {
+		clock := newFakeClock()
+		rateLimiter, _ := New(1, 10, WithClock(clock), WithIdleTimeout(time.Minute), WithStore(store))
+
+		rateLimiter.AllowWithTTL("anonymous", 10*time.Second)
+		rateLimiter.Allow("default")
+		rateLimiter.AllowWithTTL("premium", time.Hour)
+		clock.Advance(10 * time.Second)
+
+		// only the short lived key has been idle for its ttl
+		if evicted := rateLimiter.Flush(); evicted != 1 {
+			t.Errorf("expected 1 key to be evicted, got %d", evicted)
+		}
+		if _, ok := rateLimiter.store.load("anonymous"); ok {
+			t.Error("expected key with short ttl to be evicted, got present")
+		}
+
+		// plain Allow keeps the stored ttl
+		rateLimiter.Allow("premium")
+		clock.Advance(time.Minute)
+
+		if evicted := rateLimiter.Flush(); evicted != 1 {
+			t.Errorf("expected 1 key to be evicted, got %d", evicted)
+		}
+		if _, ok := rateLimiter.store.load("default"); ok {
+			t.Error("expected key with default idle timeout to be evicted, got present")
+		}
+		if _, ok := rateLimiter.store.load("premium"); !ok {
+			t.Error("expected key with long ttl to be kept past the default idle timeout, got evicted")
+		}
+
+		if rateLimiter.AllowWithTTL("invalid", 0) {
+			t.Error("expected request with zero ttl to be rejected, got allowed")
+		}
+		rateLimiter.Close()
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	var (
+		rateLimiter *rateLimiter[string]
+		evicted     []string
+	)
+	rateLimiter, _ = New(0, 1,
+		WithClock(clock),
+		WithIdleTimeout(time.Minute),
+		WithShards(1),
+		WithMaxKeys(2),
+		WithOnEvict(func(key string) {
+			// calling back into the rate limiter must not deadlock
+			rateLimiter.Tokens(key)
+			evicted = append(evicted, key)
+		}),
+	)
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("a")
+	clock.Advance(time.Second)
+	rateLimiter.Allow("b")
+	clock.Advance(time.Second)
+	// "a" is evicted to make room under max keys
+	rateLimiter.Allow("c")
+
+	clock.Advance(time.Minute)
+	rateLimiter.Flush()
+
+	// explicit removals are not reported
+	rateLimiter.Allow("d")
+	rateLimiter.Remove("d")
+
+	if len(evicted) != 3 || evicted[0] != "a" {
+		t.Fatalf("expected a, then b and c to be evicted, got %v", evicted)
+	}
+}
+
+func TestOnEvictKeyTypeMismatch(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewKeyed[int](1, 1, WithOnEvict(func(key string) {}))
+	if err == nil {
+		t.Error("expected error for a callback taking string keys, but got nil error")
+	}
+}
+
+func TestOnReject(t *testing.T) {
+	t.Parallel()
+
+	var rejected []string
+	rateLimiter, _ := New(0, 1, WithOnReject(func(key string) {
+		rejected = append(rejected, key)
+	}))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("a")
+	rateLimiter.Allow("a")
+	rateLimiter.AllowN("b", 2)
+	// "c" is allowed, then "a" is out of tokens
+	rateLimiter.AllowAll("c", "a")
+
+	expected := []string{"a", "b", "a"}
+	if !slices.Equal(rejected, expected) {
+		t.Errorf("expected rejected keys %v, got %v", expected, rejected)
+	}
+
+	rateLimiter.Close()
+	rateLimiter.Allow("a")
+	if len(rejected) != len(expected) {
+		t.Errorf("expected no callback once closed, got %v", rejected)
+	}
+
+	if _, err := NewKeyed[int](1, 1, WithOnReject(func(key string) {})); err == nil {
+		t.Error("expected error for a callback taking string keys, but got nil error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 3)
+	defer rateLimiter.Close()
+
+	// resetting an unknown key should not panic
+	rateLimiter.Reset("key")
+
+	for range 3 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	rateLimiter.Reset("key")
+
+	for range 3 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true after reset, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	if rateLimiter.Remove("key") {
+		t.Error("expected remove of unknown key to return false, got true")
+	}
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+
+	if !rateLimiter.Remove("key") {
+		t.Error("expected remove of tracked key to return true, got false")
+	}
+
+	if rateLimiter.Remove("key") {
+		t.Error("expected second remove to return false, got true")
+	}
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected removed key to be allowed, got false")
+	}
+}
+
+func TestSetRateAndBurst(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 10, WithClock(clock))
+	defer rateLimiter.Close()
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+
+	if err := rateLimiter.SetBurst(3); err != nil {
+		t.Fatalf("not expected error but got %v", err)
+	}
+
+	// bucket had 9 tokens, it should be capped to new burst size of 3
+	for range 3 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false after burst was lowered, got true")
+	}
+
+	if err := rateLimiter.SetRate(2); err != nil {
+		t.Fatalf("not expected error but got %v", err)
+	}
+
+	clock.Advance(time.Second)
+
+	for range 2 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	if err := rateLimiter.SetRate(-1); err == nil {
+		t.Error("expected error for negative rate, but got nil error")
+	}
+
+	if err := rateLimiter.SetRate(math.MaxUint); err == nil {
+		t.Error("expected error for overflowing rate, but got nil error")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("active")
+	rateLimiter.Drain()
+
+	if res := rateLimiter.AllowResult("new"); res.Allowed || res.RetryAfter != math.MaxInt64 {
+		t.Errorf("expected new key to be rejected with max retry after, got %+v", res)
+	}
+	if n := rateLimiter.Len(); n != 1 {
+		t.Errorf("expected rejected new key not to be tracked, got %d keys", n)
+	}
+
+	// the tracked key drains its tokens and keeps refilling
+	if !rateLimiter.Allow("active") {
+		t.Error("expected tracked key to be allowed, got rejected")
+	}
+	if rateLimiter.Allow("active") {
+		t.Error("expected tracked key out of tokens to be rejected, got allowed")
+	}
+	clock.Advance(time.Second)
+	if !rateLimiter.Allow("active") {
+		t.Error("expected tracked key to be allowed after refill, got rejected")
+	}
+
+	rateLimiter.Undrain()
+	if !rateLimiter.Allow("new") {
+		t.Error("expected new key to be allowed after undrain, got rejected")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(0, 1, WithIdleTimeout(time.Minute), WithCleanupInterval(time.Minute))
+		defer rateLimiter.Close()
+
+		rateLimiter.Allow("key")
+
+		rateLimiter.Close()
+		rateLimiter.Close()
+
+		// the cleanup goroutine has stopped, the key is only evicted by Flush
+		time.Sleep(2 * time.Minute)
+		synctest.Wait()
+		if n := rateLimiter.Len(); n != 1 {
+			t.Errorf("expected key to stay after close, got %d keys", n)
+		}
+		if evicted := rateLimiter.Flush(); evicted != 1 {
+			t.Errorf("expected 1 key to be flushed, got %d", evicted)
+		}
+	})
+}
+
+func TestCloseContext(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		release := make(chan struct{})
+		rateLimiter, _ := New(0, 1, WithIdleTimeout(time.Minute), WithCleanupInterval(time.Minute),
+			WithOnEvict(func(string) {
+				<-release
+			}))
+
+		// the cleanup goroutine is stuck in the middle of a pass
+		rateLimiter.Allow("key")
+		time.Sleep(2 * time.Minute)
+		synctest.Wait()
+
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		defer cancel()
+		if err := rateLimiter.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+		if rateLimiter.Allow("other") {
+			t.Error("expected rate limiter to be closed despite the error, got allowed")
+		}
+
+		close(release)
+		if err := rateLimiter.CloseContext(t.Context()); err != nil {
+			t.Errorf("expected cleanup goroutine to return, got %v", err)
+		}
+
+		noCleanup, _ := New(0, 1, WithoutBackgroundCleanup())
+		if err := noCleanup.CloseContext(t.Context()); err != nil {
+			t.Errorf("expected nothing to wait for without cleanup goroutine, got %v", err)
+		}
+	})
+}
+
+func TestAllowAfterClose(t *testing.T) {
+	t.Parallel()
+
+	for _, opts := range [][]Option{nil, {WithDisabled(true)}} {
+		rateLimiter, _ := New(1, 10, opts...)
+		rateLimiter.Close()
+
+		if rateLimiter.Allow("key") {
+			t.Error("expected allowed to be false after close, got true")
+		}
+		if rateLimiter.AllowN("key", 1) {
+			t.Error("expected AllowN to be false after close, got true")
+		}
+		if rateLimiter.AllowWithLimit("key", 1, 10) {
+			t.Error("expected AllowWithLimit to be false after close, got true")
+		}
+		if rateLimiter.AllowAll("key") {
+			t.Error("expected AllowAll to be false after close, got true")
+		}
+		if res := rateLimiter.AllowResult("key"); res.Allowed {
+			t.Error("expected AllowResult to be denied after close, got allowed")
+		}
+		if _, err := rateLimiter.AllowCtx(t.Context(), "key"); !errors.Is(err, ErrClosed) {
+			t.Errorf("expected error %v, got %v", ErrClosed, err)
+		}
+
+		if n := rateLimiter.Len(); n != 0 {
+			t.Errorf("expected no key to be added after close, got %d", n)
+		}
+		if stats := rateLimiter.Stats(); stats != (Stats{}) {
+			t.Errorf("expected requests after close not to be counted, got %+v", stats)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 10, WithIdleTimeout(time.Minute))
+	defer rateLimiter.Close()
+
+	expected := Config{TokenRate: 1, BurstSize: 10, CleanupInterval: 5 * time.Minute, IdleTimeout: time.Minute}
+	if cfg := rateLimiter.Config(); cfg != expected {
+		t.Errorf("expected config %+v, got %+v", expected, cfg)
+	}
+
+	_ = rateLimiter.SetRate(2)
+	_ = rateLimiter.SetBurst(20)
+	// a rejected change is not reflected
+	_ = rateLimiter.SetRate(-1)
+
+	expected.TokenRate, expected.BurstSize = 2, 20
+	if cfg := rateLimiter.Config(); cfg != expected {
+		t.Errorf("expected config %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestSetRateConcurrentWithAllow(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(10, 10)
+	defer rateLimiter.Close()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			for range 100 {
+				rateLimiter.Allow(fmt.Sprintf("user-%d", i))
+			}
+		})
+	}
+	wg.Go(func() {
+		for i := range 100 {
+			_ = rateLimiter.SetRate(float64(i))
+			_ = rateLimiter.SetBurst(uint(i))
+		}
+	})
+	wg.Wait()
+}
+
+func TestNonBlocking(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 10, WithShards(1), WithNonBlocking(true))
+	defer rateLimiter.Close()
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected request to be allowed, got rejected")
+	}
+
+	// another request holding the only shard
+	sh := &rateLimiter.store.(*shardedMap[string]).shards[0]
+	sh.mu.Lock()
+	if rateLimiter.Allow("key") {
+		t.Error("expected request to be denied while the shard is busy, got allowed")
+	}
+	if err := rateLimiter.AllowE("other"); !errors.Is(err, ErrBusy) || !errors.Is(err, ErrContention) {
+		t.Errorf("expected error %v, got %v", ErrBusy, err)
+	}
+	sh.mu.Unlock()
+
+	if !rateLimiter.Allow("key") {
+		t.Error("expected request to be allowed once the shard is free, got rejected")
+	}
+	expected := Stats{Allowed: 2, Busy: 2, Keys: 1}
+	if stats := rateLimiter.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 8 {
+		t.Errorf("expected busy requests to leave 8 tokens, got %d", tokens)
+	}
+}
+
+func TestHasher(t *testing.T) {
+	t.Parallel()
+
+	// keys are spread by their last byte, whatever their common prefix
+	hash := func(key string) uint64 {
+		return uint64(key[len(key)-1])
+	}
+	rateLimiter, _ := New(1, 1, WithShards(4), WithHasher(hash))
+	defer rateLimiter.Close()
+
+	for _, key := range []string{"tenant/a", "tenant/b", "tenant/c", "tenant/d", "tenant/e"} {
+		rateLimiter.Allow(key)
+	}
+
+	// 'a' is 97, so shard 1, and 'e' wraps around to it
+	expected := []int{1, 2, 1, 1}
+	shards := rateLimiter.store.(*shardedMap[string]).shards
+	for i := range shards {
+		if n := len(shards[i].m); n != expected[i] {
+			t.Errorf("shard %d: expected %d keys, got %d", i, expected[i], n)
+		}
+	}
+	if rateLimiter.Allow("tenant/e") {
+		t.Error("expected second request of a key to share its bucket, got allowed")
+	}
+
+	if _, err := NewKeyed[int](1, 1, WithHasher(hash)); err == nil {
+		t.Error("expected error for a hasher with int keys, but got nil error")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 2)
+	defer rateLimiter.Close()
+
+	if err := rateLimiter.Reconfigure(5, 10); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := rateLimiter.Reconfigure(-1, 20); err == nil {
+		t.Error("expected error for negative rate, got nil")
+	}
+	if err := rateLimiter.Reconfigure(math.MaxUint, 20); err == nil {
+		t.Error("expected error for rate overflowing the burst, got nil")
+	}
+
+	// a rejected change leaves both values untouched
+	if cfg := rateLimiter.Config(); cfg.TokenRate != 5 || cfg.BurstSize != 10 {
+		t.Errorf("expected rate 5 and burst 10, got %v and %d", cfg.TokenRate, cfg.BurstSize)
+	}
+}
+
+func TestReconfigureClampsIdleKeys(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 1000, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("idle")
+
+	if err := rateLimiter.Reconfigure(1, 100); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the stored bucket still holds 999 tokens, but every read brings it
+	// up to date first, which caps it, even without any time passing
+	if tokens := rateLimiter.Tokens("idle"); tokens != 100 {
+		t.Errorf("expected tokens to be capped to 100, got %d", tokens)
+	}
+	if state := rateLimiter.Debug()["idle"]; state.Tokens != 100 {
+		t.Errorf("expected debug tokens to be capped to 100, got %d", state.Tokens)
+	}
+	allowed := 0
+	for range 1000 {
+		if rateLimiter.Allow("idle") {
+			allowed++
+		}
+	}
+	if allowed != 100 {
+		t.Errorf("expected 100 requests allowed after lowering the burst size, got %d", allowed)
+	}
+}
+
+func TestReconfigureConcurrentWithAllow(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(10, 20, WithClock(clock))
+	defer rateLimiter.Close()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			for range 1000 {
+				rateLimiter.Allow(fmt.Sprintf("user-%d", i))
+				clock.Advance(time.Millisecond)
+			}
+		})
+	}
+	wg.Go(func() {
+		for i := range 1000 {
+			_ = rateLimiter.Reconfigure(float64(i%100+1), uint(2*(i%100+1)))
+		}
+	})
+	wg.Go(func() {
+		for range 1000 {
+			// the burst size is always twice the rate, unless a rate was
+			// observed with the burst size of another configuration
+			if cfg := rateLimiter.Config(); cfg.BurstSize != uint(2*cfg.TokenRate) {
+				t.Errorf("expected burst size twice the rate, got %v and %d", cfg.TokenRate, cfg.BurstSize)
+				return
+			}
+		}
+	})
+	wg.Wait()
+
+	if err := rateLimiter.Reconfigure(5, 10); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// keys are capped to the final burst size on their next refill, however
+	// many tokens they were left with by the earlier configurations
+	clock.Advance(time.Hour)
+	allowed := 0
+	for rateLimiter.Allow("user-0") {
+		allowed++
+	}
+	if allowed != 10 {
+		t.Errorf("expected 10 requests allowed by the final burst size, got %d", allowed)
+	}
+
+	// and refill at the final rate
+	allowed = 0
+	for range 100 {
+		clock.Advance(100 * time.Millisecond)
+		if rateLimiter.Allow("user-0") {
+			allowed++
+		}
+	}
+	if allowed < 49 || allowed > 50 {
+		t.Errorf("expected about 50 requests allowed over 10 seconds at 5 per second, got %d", allowed)
+	}
+}
+
+func TestAllowWithLimit(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	// premium key gets a burst of 5, free key uses the default burst of 2
+	for range 5 {
+		if !rateLimiter.AllowWithLimit("premium", 5, 5) {
+			t.Fatal("expected premium request to be allowed, got rejected")
+		}
+	}
+	if rateLimiter.AllowWithLimit("premium", 5, 5) {
+		t.Fatal("expected 6th premium request to be rejected, got allowed")
+	}
+
+	for range 2 {
+		if !rateLimiter.Allow("free") {
+			t.Fatal("expected free request to be allowed, got rejected")
+		}
+	}
+	if rateLimiter.Allow("free") {
+		t.Fatal("expected 3rd free request to be rejected, got allowed")
+	}
+
+	// plain Allow keeps using the stored per key limit
+	clock.Advance(time.Second)
+	for range 5 {
+		if !rateLimiter.Allow("premium") {
+			t.Fatal("expected premium request to be allowed with stored limit, got rejected")
+		}
+	}
+	if rateLimiter.Allow("premium") {
+		t.Fatal("expected premium request to be rejected, got allowed")
+	}
+
+	// lowering the per key limit clamps tokens on next refill
+	clock.Advance(time.Second)
+	if !rateLimiter.AllowWithLimit("premium", 1, 1) {
+		t.Fatal("expected request to be allowed, got rejected")
+	}
+	if rateLimiter.Allow("premium") {
+		t.Fatal("expected request to be rejected after limit was lowered, got allowed")
+	}
+
+	if rateLimiter.AllowWithLimit("invalid", -1, 10) {
+		t.Error("expected request with invalid limit to be rejected, got allowed")
+	}
+
+	if rateLimiter.AllowWithLimit("zero", 10, 0) {
+		t.Error("expected request with zero burst to be rejected, got allowed")
+	}
+}
+
+func TestAllowWithLimitZeroBurst(t *testing.T) {
+	t.Parallel()
+
+	for _, algo := range allAlgorithms {
+		clock := newFakeClock()
+		rateLimiter, _ := New(1, 5, WithClock(clock), WithAlgorithm(algo))
+
+		// a key created with a burst of 0 must not start with burst - 1
+		// tokens, wrapped around to a bucket that never runs out
+		for range 3 {
+			if rateLimiter.AllowWithLimit("fresh", 10, 0) {
+				t.Errorf("algorithm %d: expected request of a new key with zero burst to be rejected, got allowed", algo)
+			}
+		}
+		if rateLimiter.Has("fresh") {
+			t.Errorf("algorithm %d: expected new key with zero burst not to be tracked, got tracked", algo)
+		}
+
+		rateLimiter.Allow("used")
+		for range 3 {
+			if rateLimiter.AllowWithLimit("used", 10, 0) {
+				t.Errorf("algorithm %d: expected request with zero burst to be rejected, got allowed", algo)
+			}
+		}
+		// the bucket and its limit are left as they were
+		allowed := 0
+		for range 10 {
+			if rateLimiter.Allow("used") {
+				allowed++
+			}
+		}
+		if allowed != 4 {
+			t.Errorf("algorithm %d: expected 4 requests left, got %d", algo, allowed)
+		}
+		rateLimiter.Close()
+	}
+}
+
+func TestZeroBurst(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rejecting, _ := New(1, 0, WithClock(clock))
+	defer rejecting.Close()
+	minimal, _ := New(1, 0, WithClock(clock), WithZeroBurst(ZeroBurstMinimal))
+	defer minimal.Close()
+
+	if rejecting.Allow("key") {
+		t.Error("expected a burst size of 0 to reject by default, got allowed")
+	}
+
+	// no bursting, one request per second
+	if !minimal.Allow("key") {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	if minimal.Allow("key") {
+		t.Fatal("expected second request to be rejected, got allowed")
+	}
+	clock.Advance(time.Second)
+	if !minimal.Allow("key") {
+		t.Error("expected request to be allowed at the token rate, got rejected")
+	}
+	if !minimal.AllowWithLimit("other", 1, 0) {
+		t.Error("expected per key burst size of 0 to allow a request, got rejected")
+	}
+
+	invalid, _ := New(1, 1, WithZeroBurst(ZeroBurstInvalid))
+	defer invalid.Close()
+	if err := invalid.SetBurst(0); err == nil {
+		t.Error("expected setting a burst size of 0 to fail, got nil")
+	}
+	if invalid.AllowWithLimit("key", 1, 0) {
+		t.Error("expected per key burst size of 0 to be rejected, got allowed")
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	t.Parallel()
+
+	const maxKeys = 100
+
+	rateLimiter, _ := New(1, 1, WithMaxKeys(maxKeys))
+	defer rateLimiter.Close()
+
+	for i := range maxKeys + 1000 {
+		if !rateLimiter.Allow(fmt.Sprintf("key-%d", i)) {
+			t.Fatal("expected first request of a key to be allowed, got rejected")
+		}
+	}
+
+	if keys := rateLimiter.Len(); keys != maxKeys {
+		t.Errorf("expected %d keys, got %d", maxKeys, keys)
+	}
+
+	tracked := 0
+	for i := range rateLimiter.store.(*shardedMap[string]).shards {
+		tracked += len(rateLimiter.store.(*shardedMap[string]).shards[i].m)
+	}
+	if tracked != maxKeys {
+		t.Errorf("expected %d buckets in shards, got %d", maxKeys, tracked)
+	}
+}
+
+func TestMaxKeysEvictsLeastRecentlyActive(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(0, 2, WithClock(clock), WithShards(1), WithMaxKeys(3))
+	defer rateLimiter.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		rateLimiter.Allow(key)
+		clock.Advance(time.Second)
+	}
+
+	// "a" becomes the most recently active key, leaving "b" the oldest
+	rateLimiter.Allow("a")
+	clock.Advance(time.Second)
+
+	rateLimiter.Allow("d")
+
+	if rateLimiter.Remove("b") {
+		t.Error("expected least recently active key to be evicted, but it wasn't")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !rateLimiter.Remove(key) {
+			t.Errorf("expected key %q to be tracked, but it wasn't", key)
+		}
+	}
+}
+
+func TestInitialCapacity(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 1, WithShards(4), WithInitialCapacity(10))
+	defer rateLimiter.Close()
+
+	// 10 keys over 4 shards need room for 3 keys per shard
+	shards := rateLimiter.store.(*shardedMap[string]).shards
+	for i := range shards {
+		if c := cap(shards[i].idle); c != 3 {
+			t.Errorf("shard %d: expected room for 3 keys, got %d", i, c)
+		}
+	}
+
+	// capacity is only a hint, more keys are still tracked
+	for i := range 100 {
+		if !rateLimiter.Allow(fmt.Sprintf("key-%d", i)) {
+			t.Fatal("expected first request of a key to be allowed, got rejected")
+		}
+	}
+	if n := rateLimiter.Len(); n != 100 {
+		t.Errorf("expected 100 keys, got %d", n)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	t.Parallel()
+
+	for _, store := range []Store{nil, NewSyncMapStore()} {
+		clock := newFakeClock()
+		opts := []Option{WithClock(clock)}
+		if store != nil {
+			opts = append(opts, WithStore(store))
+		}
+		rateLimiter, _ := New(1, 5, opts...)
+		defer rateLimiter.Close()
+
+		start := clock.Now()
+		for range 5 {
+			rateLimiter.Allow("a")
+		}
+		rateLimiter.Allow("b")
+		clock.Advance(2 * time.Second)
+
+		type state struct {
+			tokens       uint
+			lastActivity time.Time
+		}
+		got := map[string]state{}
+		rateLimiter.ForEach(func(key string, tokens uint, lastActivity time.Time) bool {
+			// calling back into the rate limiter must not deadlock
+			rateLimiter.Tokens(key)
+			got[key] = state{tokens, lastActivity}
+			return true
+		})
+
+		// tokens include the 2 refilled since the last request
+		expected := map[string]state{
+			"a": {2, start},
+			"b": {5, start},
+		}
+		if !maps.Equal(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+		if tokens := rateLimiter.Tokens("a"); tokens != 2 {
+			t.Errorf("expected ForEach to consume no token, got %d tokens", tokens)
+		}
+
+		calls := 0
+		rateLimiter.ForEach(func(string, uint, time.Time) bool {
+			calls++
+			return false
+		})
+		if calls != 1 {
+			t.Errorf("expected ForEach to stop after 1 call, got %d", calls)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	t.Parallel()
+
+	for _, store := range []Store{nil, NewSyncMapStore()} {
+		opts := []Option{}
+		if store != nil {
+			opts = append(opts, WithStore(store))
+		}
+		rateLimiter, _ := New(0, 1, opts...)
+		defer rateLimiter.Close()
+
+		for _, key := range []string{"a", "b", "c"} {
+			rateLimiter.Allow(key)
+		}
+
+		rateLimiter.Clear()
+
+		if n := rateLimiter.Len(); n != 0 {
+			t.Errorf("expected no keys after clear, got %d", n)
+		}
+		if !rateLimiter.Allow("a") {
+			t.Error("expected cleared key to be allowed again, got false")
+		}
+		if n := rateLimiter.Len(); n != 1 {
+			t.Errorf("expected 1 key, got %d", n)
+		}
+	}
+}
+
+func TestDeleteFuncHeapIndices(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := NewKeyed[int](1, 1, WithClock(clock), WithShards(1))
+	defer rateLimiter.Close()
+
+	// keys expire one after the other, so the heap is not in key order
+	for i := range 50 {
+		rateLimiter.Allow(49 - i)
+		clock.Advance(time.Second)
+	}
+
+	m := rateLimiter.store.(*shardedMap[int])
+	m.deleteFunc(func(key int, _ *Bucket) bool { return key%2 == 0 })
+
+	idle := m.shards[0].idle
+	if len(idle) != 25 {
+		t.Fatalf("expected 25 keys left in the heap, got %d", len(idle))
+	}
+	for i, e := range idle {
+		if e.index != i {
+			t.Errorf("expected entry at %d of the heap to have index %d, got %d", i, i, e.index)
+		}
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	t.Parallel()
+
+	for _, store := range []Store{nil, NewSyncMapStore()} {
+		opts := []Option{}
+		if store != nil {
+			opts = append(opts, WithStore(store))
+		}
+		rateLimiter, _ := New(0, 1, opts...)
+		defer rateLimiter.Close()
+
+		for _, key := range []string{"acme:1", "acme:2", "globex:1"} {
+			rateLimiter.Allow(key)
+		}
+
+		deleted := rateLimiter.DeleteFunc(func(key string) bool {
+			return strings.HasPrefix(key, "acme:")
+		})
+		if deleted != 2 {
+			t.Errorf("expected 2 keys to be deleted, got %d", deleted)
+		}
+		if n := rateLimiter.Len(); n != 1 {
+			t.Errorf("expected 1 key left, got %d", n)
+		}
+		if !rateLimiter.Allow("acme:1") {
+			t.Error("expected deleted key to be allowed again, got false")
+		}
+		if rateLimiter.Allow("globex:1") {
+			t.Error("expected other key to keep its bucket, got allowed")
+		}
+		if evicted := rateLimiter.Stats().Evicted; evicted != 0 {
+			t.Errorf("expected deleted keys not to be counted as evicted, got %d", evicted)
+		}
+	}
+}
+
+func TestDeleteFuncThenUpdate(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := NewKeyed[int](1, 1, WithClock(clock), WithShards(1), WithIdleTimeout(time.Minute))
+	defer rateLimiter.Close()
+
+	for i := range 50 {
+		rateLimiter.Allow(49 - i)
+		clock.Advance(time.Second)
+	}
+	if deleted := rateLimiter.DeleteFunc(func(key int) bool { return key%2 == 0 }); deleted != 25 {
+		t.Fatalf("expected 25 keys to be deleted, got %d", deleted)
+	}
+
+	// a write to a surviving key moves it within the heap, then removal
+	// and eviction take entries out of it
+	clock.Advance(time.Second)
+	if !rateLimiter.Allow(1) {
+		t.Fatal("expected refilled key to be allowed, got rejected")
+	}
+	if !rateLimiter.Remove(3) {
+		t.Error("expected surviving key to be removed, but it wasn't")
+	}
+
+	clock.Advance(59 * time.Second)
+	if evicted := rateLimiter.Flush(); evicted != 23 {
+		t.Errorf("expected 23 idle keys to be evicted, got %d", evicted)
+	}
+	if !rateLimiter.Has(1) || rateLimiter.Len() != 1 {
+		t.Errorf("expected only the key written last to be left, got %d keys", rateLimiter.Len())
+	}
+}
+
+func TestClearConcurrentWithAllow(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1000)
+	defer rateLimiter.Close()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			for j := range 100 {
+				rateLimiter.Allow(fmt.Sprintf("key%d-%d", i, j%10))
+			}
+		})
+	}
+	wg.Go(func() {
+		for range 10 {
+			rateLimiter.Clear()
+		}
+	})
+	wg.Wait()
+
+	// the key counter matches the keys actually left in the store
+	rateLimiter.Clear()
+	if n := rateLimiter.Len(); n != 0 {
+		t.Errorf("expected no keys after clear, got %d", n)
+	}
+}
+
+func TestLen(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(1, 10)
+		defer rateLimiter.Close()
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Go(func() {
+				for i := range 50 {
+					rateLimiter.Allow(fmt.Sprintf("user-%d", i))
+				}
+			})
+		}
+		wg.Wait()
+
+		if keys := rateLimiter.Len(); keys != 50 {
+			t.Errorf("expected 50 keys, got %d", keys)
+		}
+
+		rateLimiter.Remove("user-0")
+		rateLimiter.Remove("user-0")
+		rateLimiter.Reset("user-1")
+
+		if keys := rateLimiter.Len(); keys != 48 {
+			t.Errorf("expected 48 keys after removal, got %d", keys)
+		}
+
+		time.Sleep(1*time.Hour + 5*time.Minute)
+		synctest.Wait()
+
+		if keys := rateLimiter.Len(); keys != 0 {
+			t.Errorf("expected 0 keys after idle eviction, got %d", keys)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(2, 2, WithClock(clock)) // one token every 500ms
+	defer rateLimiter.Close()
+
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 0 {
+		t.Errorf("expected retry after of unknown key to be 0, got %v", retryAfter)
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 2 {
+		t.Errorf("expected unknown key to report 2 tokens, got %d", tokens)
+	}
+
+	rateLimiter.Allow("key")
+	rateLimiter.Allow("key")
+
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 500*time.Millisecond {
+		t.Errorf("expected retry after to be 500ms, got %v", retryAfter)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 300*time.Millisecond {
+		t.Errorf("expected retry after to be 300ms after partial refill, got %v", retryAfter)
+	}
+
+	clock.Advance(300 * time.Millisecond)
+
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 0 {
+		t.Errorf("expected retry after to be 0 once a token is refilled, got %v", retryAfter)
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 1 {
+		t.Errorf("expected 1 token, got %d", tokens)
+	}
+	// peeking must not consume the token
+	if !rateLimiter.Allow("key") {
+		t.Error("expected allowed to be true, got false")
+	}
+}
+
+func TestRetryAfterWithoutRefill(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(0, 1, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	clock.Advance(10 * time.Minute)
+
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 50*time.Minute {
+		t.Errorf("expected retry after to be the rest of the idle timeout, got %v", retryAfter)
+	}
+
+	noCapacity, _ := New(1, 0)
+	defer noCapacity.Close()
+
+	if retryAfter := noCapacity.RetryAfter("key"); retryAfter != math.MaxInt64 {
+		t.Errorf("expected retry after to be max duration for zero burst, got %v", retryAfter)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 1, WithClock(clock), WithJitter(0.5))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("a")
+	res := rateLimiter.AllowResult("a")
+
+	// the base delay is 1 second, jitter adds up to half of it
+	delays := map[time.Duration]bool{res.RetryAfter: true}
+	for range 100 {
+		delays[rateLimiter.RetryAfter("a")] = true
+	}
+	for retryAfter := range delays {
+		if retryAfter < time.Second || retryAfter > 1500*time.Millisecond {
+			t.Errorf("expected retry after between 1s and 1.5s, got %v", retryAfter)
+		}
+	}
+	if len(delays) < 2 {
+		t.Error("expected retry after to vary, got the same delay every time")
+	}
+
+	// token accounting ignores the jitter
+	clock.Advance(time.Second)
+	if !rateLimiter.Allow("a") {
+		t.Error("expected request to be allowed once the base delay passed, got rejected")
+	}
+	if retryAfter := rateLimiter.RetryAfter("b"); retryAfter != 0 {
+		t.Errorf("expected no delay with a token available, got %v", retryAfter)
+	}
+}
+
+func TestTimeToFull(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(2, 4, WithClock(clock)) // one token every 500ms
+	defer rateLimiter.Close()
+
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 0 {
+		t.Errorf("expected time to full of unknown key to be 0, got %v", timeToFull)
+	}
+
+	for range 3 {
+		rateLimiter.Allow("key")
+	}
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 1500*time.Millisecond {
+		t.Errorf("expected time to full to be 1.5s, got %v", timeToFull)
+	}
+
+	clock.Advance(700 * time.Millisecond)
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 800*time.Millisecond {
+		t.Errorf("expected time to full to be 800ms after partial refill, got %v", timeToFull)
+	}
+
+	clock.Advance(800 * time.Millisecond)
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 0 {
+		t.Errorf("expected time to full of a full bucket to be 0, got %v", timeToFull)
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 4 {
+		t.Errorf("expected 4 tokens, got %d", tokens)
+	}
+
+	noRefill, _ := New(0, 2, WithClock(clock))
+	defer noRefill.Close()
+
+	noRefill.Allow("key")
+	clock.Advance(10 * time.Minute)
+	if timeToFull := noRefill.TimeToFull("key"); timeToFull != 50*time.Minute {
+		t.Errorf("expected time to full to be the rest of the idle timeout, got %v", timeToFull)
+	}
 }
 
-func TestAllowSteadyTraffic(t *testing.T) {
-	synctest.Test(t, func(t *testing.T) {
-		rateLimiter, _ := New(10, 10)
-		defer rateLimiter.Close()
+// TestGrantBound checks that however many goroutines spin on one key, the
+// requests allowed over a period of d never exceed the burst size plus
+// the tokens refilled in d.
+func TestGrantBound(t *testing.T) {
+	t.Parallel()
 
-		for range 10 {
-			if !rateLimiter.Allow("key") {
-				t.Error("expected ratelimiter to allow, but not allowed")
-			}
-		}
+	const (
+		rate     = 100
+		burst    = 10
+		duration = 2 * time.Second
+	)
+	tcs := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "token bucket"},
+		{name: "leaky bucket", opts: []Option{WithAlgorithm(AlgoLeakyBucket)}},
+		{name: "store", opts: []Option{WithStore(NewSyncMapStore())}},
+	}
 
-		if rateLimiter.Allow("key") {
-			t.Error("expected 11th request to not be allowed, but allowed")
-		}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-		time.Sleep(500 * time.Millisecond)
-		synctest.Wait()
+			clock := newFakeClock()
+			start := clock.Now()
+			end := start.Add(duration)
+			rateLimiter, _ := New(rate, burst, append([]Option{WithClock(clock)}, tc.opts...)...)
+			defer rateLimiter.Close()
 
-		for range 5 {
-			if !rateLimiter.Allow("key") {
-				t.Error("expected ratelimiter to allow, but not allowed")
+			var (
+				wg      sync.WaitGroup
+				granted atomic.Int64
+			)
+			for range 8 {
+				wg.Go(func() {
+					// every goroutine moves time on, so it passes end
+					// by a few steps at most
+					for clock.Now().Before(end) {
+						if rateLimiter.Allow("key") {
+							granted.Add(1)
+						}
+						clock.Advance(100 * time.Microsecond)
+					}
+				})
 			}
-		}
-
-		if rateLimiter.Allow("key") {
-			t.Error("expected 6th request to be not allowed, but allowed")
-		}
+			wg.Wait()
 
-	})
+			// the requests were made between start and the final time
+			elapsed := clock.Now().Sub(start)
+			bound := burst + int64(math.Floor(rate*elapsed.Seconds()))
+			if n := granted.Load(); n > bound || n < burst {
+				t.Errorf("expected between %d and %d requests allowed, got %d", burst, bound, n)
+			}
+		})
+	}
 }
 
 func TestConcurrentSafety(t *testing.T) {
@@ -268,6 +2499,269 @@ func TestConcurrentSafety(t *testing.T) {
 	})
 }
 
+func TestNewKeyed(t *testing.T) {
+	t.Parallel()
+
+	type key struct {
+		userID     int
+		endpointID int
+	}
+
+	clock := newFakeClock()
+	// a single shard, so that eviction is exactly least recently active
+	rateLimiter, err := NewKeyed[key](0, 2, WithClock(clock), WithShards(1), WithMaxKeys(2))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer rateLimiter.Close()
+
+	for range 2 {
+		if !rateLimiter.Allow(key{1, 1}) {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+	if rateLimiter.Allow(key{1, 1}) {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	clock.Advance(time.Second)
+
+	// same user on another endpoint has its own bucket
+	if !rateLimiter.Allow(key{1, 2}) {
+		t.Fatal("expected allowed to be true for another key, got false")
+	}
+
+	// a third key evicts the least recently active one, key{1, 1}
+	rateLimiter.Allow(key{2, 1})
+	if n := rateLimiter.Len(); n != 2 {
+		t.Errorf("expected 2 keys, got %d", n)
+	}
+	if tokens := rateLimiter.Tokens(key{1, 1}); tokens != 2 {
+		t.Errorf("expected evicted key to report a full bucket, got %d tokens", tokens)
+	}
+
+	if !rateLimiter.Remove(key{1, 2}) {
+		t.Error("expected key to be removed, but it wasn't")
+	}
+}
+
+func TestNewKeyedWithStore(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewKeyed[int](1, 1, WithStore(NewSyncMapStore())); err == nil {
+		t.Error("expected error for a store with int keys, but got nil error")
+	}
+
+	rateLimiter, err := NewKeyed[string](1, 1, WithStore(NewSyncMapStore()))
+	if err != nil {
+		t.Fatalf("expected no error for a store with string keys, got %v", err)
+	}
+	rateLimiter.Close()
+}
+
+func TestAllowAll(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range allAlgorithms {
+		rateLimiter, _ := New(0, 2, WithAlgorithm(algorithm))
+		defer rateLimiter.Close()
+
+		if !rateLimiter.Allow("org") {
+			t.Fatalf("algorithm %d: expected allowed to be true, got false", algorithm)
+		}
+		if !rateLimiter.AllowAll("user", "org") {
+			t.Fatalf("algorithm %d: expected allowed to be true, got false", algorithm)
+		}
+
+		// "org" is out of tokens, the token taken from "user" is refunded
+		if rateLimiter.AllowAll("user", "org") {
+			t.Fatalf("algorithm %d: expected allowed to be false, got true", algorithm)
+		}
+		if tokens := rateLimiter.Tokens("user"); tokens != 1 {
+			t.Errorf("algorithm %d: expected 1 token after refund, got %d", algorithm, tokens)
+		}
+
+		// a key passed twice needs two tokens
+		if rateLimiter.AllowAll("user", "user") {
+			t.Fatalf("algorithm %d: expected allowed to be false, got true", algorithm)
+		}
+		if tokens := rateLimiter.Tokens("user"); tokens != 1 {
+			t.Errorf("algorithm %d: expected 1 token after refund, got %d", algorithm, tokens)
+		}
+	}
+}
+
+func TestAllowBatch(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("b")
+	rateLimiter.Allow("b")
+
+	allowed := rateLimiter.AllowBatch([]string{"a", "b", "a", "c", "a"})
+	expected := []bool{true, false, true, true, false}
+	if !slices.Equal(allowed, expected) {
+		t.Errorf("expected %v, got %v", expected, allowed)
+	}
+
+	stats := rateLimiter.Stats()
+	if stats.Allowed != 5 || stats.Rejected != 2 {
+		t.Errorf("expected 5 allowed and 2 rejected, got %d and %d", stats.Allowed, stats.Rejected)
+	}
+
+	if allowed := rateLimiter.AllowBatch(nil); len(allowed) != 0 {
+		t.Errorf("expected no results for no keys, got %v", allowed)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range allAlgorithms {
+		rateLimiter, _ := New(0, 3, WithAlgorithm(algorithm))
+		defer rateLimiter.Close()
+
+		for range 3 {
+			rateLimiter.Allow("key")
+		}
+		rateLimiter.Refund("key", 2)
+		if tokens := rateLimiter.Tokens("key"); tokens != 2 {
+			t.Errorf("algorithm %d: expected 2 tokens after refund, got %d", algorithm, tokens)
+		}
+
+		// over refunding is clamped at burstSize
+		rateLimiter.Refund("key", 5)
+		if tokens := rateLimiter.Tokens("key"); tokens != 3 {
+			t.Errorf("algorithm %d: expected 3 tokens after refund, got %d", algorithm, tokens)
+		}
+
+		rateLimiter.Refund("unknown", 1)
+		if n := rateLimiter.Len(); n != 1 {
+			t.Errorf("algorithm %d: expected refund not to add a key, got %d keys", algorithm, n)
+		}
+	}
+}
+
+func TestRefundConcurrentSafety(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 10)
+	defer rateLimiter.Close()
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			for range 100 {
+				if rateLimiter.Allow("key") {
+					rateLimiter.Refund("key", 1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	// every consumed token was given back
+	if tokens := rateLimiter.Tokens("key"); tokens != 10 {
+		t.Errorf("expected 10 tokens, got %d", tokens)
+	}
+}
+
+func TestAllowAllConcurrentSafety(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 100)
+	defer rateLimiter.Close()
+
+	var (
+		wg          sync.WaitGroup
+		allAllowed  atomic.Int64
+		orgAllowed  atomic.Int64
+		userAllowed atomic.Int64
+	)
+	for range 50 {
+		wg.Go(func() {
+			for range 10 {
+				if rateLimiter.AllowAll("user", "org") {
+					allAllowed.Add(1)
+				}
+			}
+		})
+		wg.Go(func() {
+			for range 10 {
+				if rateLimiter.Allow("org") {
+					orgAllowed.Add(1)
+				}
+				if rateLimiter.Allow("user") {
+					userAllowed.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	// tokens are never refilled, so every token missing from a bucket
+	// was consumed by an allowed request and refunds returned the rest.
+	if used := allAllowed.Load() + orgAllowed.Load(); used != 100-int64(rateLimiter.Tokens("org")) {
+		t.Errorf("expected %d tokens consumed from org, got %d", used, 100-rateLimiter.Tokens("org"))
+	}
+	if used := allAllowed.Load() + userAllowed.Load(); used != 100-int64(rateLimiter.Tokens("user")) {
+		t.Errorf("expected %d tokens consumed from user, got %d", used, 100-rateLimiter.Tokens("user"))
+	}
+}
+
+func TestAllowBytes(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	defer rateLimiter.Close()
+
+	buf := []byte("key")
+	if !rateLimiter.AllowBytes(buf) {
+		t.Fatal("expected first request to be allowed, got rejected")
+	}
+	// the stored key does not share the buffer
+	copy(buf, "xyz")
+	if !rateLimiter.AllowBytes([]byte("key")) {
+		t.Fatal("expected second request to be allowed, got rejected")
+	}
+	if rateLimiter.Allow("key") {
+		t.Error("expected AllowBytes and Allow to share the bucket of a key, got a fresh bucket")
+	}
+	if n := rateLimiter.Len(); n != 1 {
+		t.Errorf("expected 1 key, got %d", n)
+	}
+	hashed, _ := New(0, 1, WithHasher(func(key string) uint64 { return uint64(len(key)) }))
+	defer hashed.Close()
+	hashed.AllowBytes([]byte("key"))
+	if hashed.Allow("key") || hashed.Len() != 1 {
+		t.Error("expected AllowBytes and Allow to share the bucket of a key with a hasher, got a fresh bucket")
+	}
+
+	keyed, _ := NewKeyed[int](0, 1)
+	defer keyed.Close()
+	defer func() {
+		if recover() == nil {
+			t.Error("expected AllowBytes to panic for int keys, but it didn't")
+		}
+	}()
+	keyed.AllowBytes(buf)
+}
+
+// TestAllowBytesAllocs is not parallel, AllocsPerRun counts the
+// allocations of every goroutine.
+func TestAllowBytesAllocs(t *testing.T) {
+	rateLimiter, _ := New(0, 1000)
+	defer rateLimiter.Close()
+
+	key := []byte("key")
+	rateLimiter.AllowBytes(key)
+	if allocs := testing.AllocsPerRun(10, func() { rateLimiter.AllowBytes(key) }); allocs != 0 {
+		t.Errorf("expected no allocation for a tracked key, got %v", allocs)
+	}
+}
+
 func BenchmarkAllow(b *testing.B) {
 	rateLimiter, _ := New(1000, 10000)
 	defer rateLimiter.Close()
@@ -282,17 +2776,286 @@ func BenchmarkAllow(b *testing.B) {
 }
 
 func BenchmarkAllowParallel(b *testing.B) {
-	rateLimiter, _ := New(1000, 10000)
-	defer rateLimiter.Close()
+	b.Run("keys=10", func(b *testing.B) {
+		rateLimiter, _ := New(1000, 10000)
+		defer rateLimiter.Close()
+
+		b.ResetTimer()
+
+		b.RunParallel(func(p *testing.PB) {
+			i := 0
+			for p.Next() {
+				rateLimiter.Allow(fmt.Sprintf("key%d", i))
+				i++
+				i = i % 10
+			}
+		})
+	})
+
+	// three in four goroutines hammer one hot key of a Store while the
+	// others spread over cold keys. The latency of cold key requests
+	// tells whether the hot key starves them.
+	backoffs := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "spin"},
+		{name: "yield", opts: []Option{WithRetryBackoff(0)}},
+		{name: "backoff=10us", opts: []Option{WithRetryBackoff(10 * time.Microsecond)}},
+	}
+	for _, backoff := range backoffs {
+		b.Run("hotkey/"+backoff.name, func(b *testing.B) {
+			opts := append([]Option{WithStore(NewSyncMapStore())}, backoff.opts...)
+			rateLimiter, _ := New(math.MaxInt32, math.MaxInt32, opts...)
+			defer rateLimiter.Close()
+
+			var (
+				next      atomic.Int64
+				mu        sync.Mutex
+				latencies []time.Duration
+			)
+			b.RunParallel(func(p *testing.PB) {
+				id := next.Add(1)
+				var cold []time.Duration
+				i := 0
+				for p.Next() {
+					if id%4 != 0 {
+						rateLimiter.Allow("hot")
+						continue
+					}
+					key := "cold" + strconv.Itoa(int(id)*1000+i%1000)
+					start := time.Now()
+					rateLimiter.Allow(key)
+					cold = append(cold, time.Since(start))
+					i++
+				}
+				mu.Lock()
+				latencies = append(latencies, cold...)
+				mu.Unlock()
+			})
+
+			reportLatencies(b, "cold", latencies)
+		})
+	}
+}
+
+// BenchmarkAllowFixedKeys is BenchmarkAllow and BenchmarkAllowParallel
+// with keys built upfront, so that ns/op and allocs/op are the ones of
+// Allow rather than of fmt.Sprintf.
+func BenchmarkAllowFixedKeys(b *testing.B) {
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		rateLimiter, _ := New(1000, 10000)
+		defer rateLimiter.Close()
+
+		b.ReportAllocs()
+		i := 0
+		for b.Loop() {
+			rateLimiter.Allow(keys[i])
+			i = (i + 1) % len(keys)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		rateLimiter, _ := New(1000, 10000)
+		defer rateLimiter.Close()
+
+		b.ReportAllocs()
+		b.RunParallel(func(p *testing.PB) {
+			i := 0
+			for p.Next() {
+				rateLimiter.Allow(keys[i])
+				i = (i + 1) % len(keys)
+			}
+		})
+	})
+}
+
+// BenchmarkAllowHotKey runs every goroutine on the same key, which spreading
+// requests over 10 keys hides: they all wait for the lock of one shard, or
+// retry their compare and swap on a Store. Every request is allowed, so
+// that each of them writes the bucket.
+func BenchmarkAllowHotKey(b *testing.B) {
+	stores := []struct {
+		name  string
+		store Store
+	}{
+		{name: "map"},
+		{name: "store", store: NewSyncMapStore()},
+	}
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			rateLimiter, _ := New(math.MaxInt32, math.MaxInt32, WithStore(s.store))
+			defer rateLimiter.Close()
+
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					rateLimiter.Allow("same")
+				}
+			})
+
+			b.ReportMetric(float64(rateLimiter.Stats().RetriesExhausted)/float64(b.N), "exhausted/op")
+		})
+	}
+}
+
+// BenchmarkAllowContended runs every goroutine on keys of a single shard,
+// blocking on its lock or giving up WithNonBlocking, and reports the tail
+// latency of Allow along with the share of requests given up.
+func BenchmarkAllowContended(b *testing.B) {
+	for _, nonBlocking := range []bool{false, true} {
+		b.Run(fmt.Sprintf("nonblocking=%t", nonBlocking), func(b *testing.B) {
+			rateLimiter, _ := New(1000, 10000, WithShards(1), WithNonBlocking(nonBlocking))
+			defer rateLimiter.Close()
+
+			var (
+				mu        sync.Mutex
+				latencies []time.Duration
+			)
+			b.RunParallel(func(p *testing.PB) {
+				var local []time.Duration
+				i := 0
+				for p.Next() {
+					start := time.Now()
+					rateLimiter.Allow("key" + strconv.Itoa(i%100))
+					local = append(local, time.Since(start))
+					i++
+				}
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+
+			reportLatencies(b, "allow", latencies)
+			if n := len(latencies); n > 0 {
+				b.ReportMetric(float64(rateLimiter.Stats().Busy)/float64(n), "busy/op")
+			}
+		})
+	}
+}
+
+// reportLatencies reports the p99 and max of latencies as metrics of b
+// named after name.
+func reportLatencies(b *testing.B, name string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), name+"-p99-ns")
+	b.ReportMetric(float64(latencies[len(latencies)-1].Nanoseconds()), name+"-max-ns")
+}
 
-	b.ResetTimer()
+// BenchmarkAllowBytes compares building keys with fmt.Sprintf and
+// passing them to Allow with appending them to a reused buffer passed to
+// AllowBytes, which allocates nothing for tracked keys.
+func BenchmarkAllowBytes(b *testing.B) {
+	b.Run("sprintf", func(b *testing.B) {
+		rateLimiter, _ := New(1000, 10000)
+		defer rateLimiter.Close()
 
-	b.RunParallel(func(p *testing.PB) {
+		b.ReportAllocs()
 		i := 0
-		for p.Next() {
+		for b.Loop() {
 			rateLimiter.Allow(fmt.Sprintf("key%d", i))
-			i++
-			i = i % 10
+			i = (i + 1) % 10
+		}
+	})
+
+	b.Run("bytes", func(b *testing.B) {
+		rateLimiter, _ := New(1000, 10000)
+		defer rateLimiter.Close()
+
+		b.ReportAllocs()
+		buf := make([]byte, 0, 32)
+		i := 0
+		for b.Loop() {
+			buf = strconv.AppendInt(append(buf[:0], "key"...), int64(i), 10)
+			rateLimiter.AllowBytes(buf)
+			i = (i + 1) % 10
+		}
+	})
+}
+
+func BenchmarkAllowStructKey(b *testing.B) {
+	type key struct {
+		userID     int
+		endpointID int
+	}
+
+	rateLimiter, _ := NewKeyed[key](1000, 10000)
+	defer rateLimiter.Close()
+
+	i := 0
+
+	for b.Loop() {
+		rateLimiter.Allow(key{userID: i, endpointID: i})
+		i++
+		i = i % 10
+	}
+}
+
+// BenchmarkFlush sweeps 1M keys of which none is idle, comparing the
+// per shard heaps of Flush with visiting every key.
+func BenchmarkFlush(b *testing.B) {
+	const keys = 1_000_000
+
+	clock := newFakeClock()
+	rateLimiter, _ := NewKeyed[int](1000, 10000, WithClock(clock), WithIdleTimeout(time.Hour))
+	defer rateLimiter.Close()
+
+	for i := range keys {
+		rateLimiter.Allow(i)
+	}
+	clock.Advance(time.Minute)
+
+	b.Run("heap", func(b *testing.B) {
+		for b.Loop() {
+			rateLimiter.Flush()
+		}
+	})
+
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			t := clock.Now()
+			rateLimiter.store.deleteFunc(func(_ int, buck *Bucket) bool {
+				return t.Sub(buck.LastActivity) >= rateLimiter.cfg.idleTimeout
+			})
 		}
 	})
 }
+
+// BenchmarkFlushWorkers measures a sweep evicting 5 million idle keys
+// with one cleanup goroutine and with GOMAXPROCS of them, e.g. with -cpu
+// 1,8.
+func BenchmarkFlushWorkers(b *testing.B) {
+	const keys = 5_000_000
+
+	for _, workers := range slices.Compact([]int{1, runtime.GOMAXPROCS(0)}) {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			clock := newFakeClock()
+			rateLimiter, _ := NewKeyed[int](1000, 10000,
+				WithClock(clock),
+				WithCleanupWorkers(workers),
+				WithoutBackgroundCleanup(),
+				WithInitialCapacity(keys),
+			)
+			defer rateLimiter.Close()
+
+			for b.Loop() {
+				b.StopTimer()
+				for i := range keys {
+					rateLimiter.Allow(i)
+				}
+				clock.Advance(time.Hour)
+				b.StartTimer()
+
+				rateLimiter.Flush()
+			}
+		})
+	}
+}
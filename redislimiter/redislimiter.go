@@ -0,0 +1,215 @@
+// Package redislimiter provides a token bucket rate limiter whose buckets
+// live in Redis, so that several application instances share one limit.
+//
+// Refill and consumption run atomically inside a Lua script executed with
+// EVALSHA. The script reads the current time with the Redis TIME command,
+// so clock skew between application servers does not affect the limit.
+// Idle buckets are evicted by Redis itself through a TTL instead of a
+// cleanup goroutine.
+package redislimiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultIdleTimeout = time.Hour
+
+// script refills and consumes tokens from the bucket stored in the hash
+// KEYS[1], mirroring the in-process limiter: tokens are whole
+// numbers and last_refill only advances by the time it took to produce
+// them, so the sub-token remainder is kept.
+//
+// ARGV[1] is the token rate per second, ARGV[2] the burst size, ARGV[3]
+// the idle timeout in milliseconds and ARGV[4] the number of tokens to
+// consume. It returns 1 if the request is allowed, 0 otherwise.
+var script = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+if burst == 0 or n > burst then
+	return 0
+end
+
+local now = redis.call('TIME')
+local t = tonumber(now[1]) * 1000000 + tonumber(now[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last_refill')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+	tokens = burst
+	last = t
+end
+
+local added = math.floor(rate * math.max(0, t - last) / 1000000)
+if tokens + added >= burst then
+	tokens = burst
+	last = t
+elseif added > 0 then
+	tokens = tokens + added
+	last = last + math.floor(added / rate * 1000000)
+end
+
+if tokens < n then
+	-- the bucket is left untouched, so rejected requests do not
+	-- extend the TTL of a rate limited key.
+	return 0
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens - n, 'last_refill', last)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// Limiter is a rate limiter keeping its buckets in Redis.
+type Limiter struct {
+	client    redis.Scripter
+	tokenRate float64
+	burstSize uint
+
+	idleTimeout time.Duration
+	prefix      string
+	fallback    ratelimiter.Limiter
+	failOpen    bool
+
+	// fallbacks is the number of requests decided without Redis.
+	fallbacks atomic.Uint64
+}
+
+// Stats holds the counters of a Limiter.
+type Stats struct {
+	// Fallbacks is the number of requests Redis failed to decide, which
+	// were decided by the limiter of WithFallback, or by WithFailOpen,
+	// instead. A rising count points at Redis being unreachable.
+	Fallbacks uint64
+}
+
+// Option configures a Limiter created by New.
+type Option func(*Limiter)
+
+// WithIdleTimeout sets the TTL of a bucket, refreshed on every allowed
+// request. Defaults to 1 hour.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(l *Limiter) {
+		l.idleTimeout = d
+	}
+}
+
+// WithKeyPrefix sets a prefix prepended to every key stored in Redis, to
+// keep several limiters apart in one database.
+func WithKeyPrefix(prefix string) Option {
+	return func(l *Limiter) {
+		l.prefix = prefix
+	}
+}
+
+// WithFallback makes requests Redis fails to decide, e.g. during an
+// outage, be decided by local instead, typically an in-process rate
+// limiter with the same limits. Every instance then enforces the limit on
+// its own until Redis is back, rather than rejecting every request.
+func WithFallback(local ratelimiter.Limiter) Option {
+	return func(l *Limiter) {
+		l.fallback = local
+	}
+}
+
+// WithFailOpen sets whether requests Redis fails to decide are allowed
+// rather than rejected, when no limiter was passed to WithFallback.
+// Defaults to false, failing closed.
+func WithFailOpen(open bool) Option {
+	return func(l *Limiter) {
+		l.failOpen = open
+	}
+}
+
+// New returns a Limiter allowing tokenRate requests per second with bursts
+// of up to burstSize, storing its buckets through client.
+func New(client redis.Scripter, tokenRate float64, burstSize uint, opts ...Option) (*Limiter, error) {
+	l := &Limiter{
+		client:      client,
+		tokenRate:   tokenRate,
+		burstSize:   burstSize,
+		idleTimeout: defaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if tokenRate < 0 || math.IsNaN(tokenRate) || math.IsInf(tokenRate, 0) {
+		return nil, errors.New("token rate should be a non negative finite number")
+	}
+	if l.idleTimeout < time.Millisecond {
+		return nil, errors.New("idle timeout should be at least one millisecond")
+	}
+	return l, nil
+}
+
+// Allow reports whether a request for key is allowed, consuming a token
+// if so. Requests are rejected when Redis cannot be reached, unless
+// WithFallback or WithFailOpen is set.
+func (l *Limiter) Allow(key string) bool {
+	allowed, err := l.AllowCtx(context.Background(), key)
+	return err == nil && allowed
+}
+
+// AllowCtx is like Allow, but bounds the Redis round trip with ctx and
+// returns the error of the script execution, if any. With WithFallback or
+// WithFailOpen, a failed script execution is decided like in Allow and no
+// error is returned, unless ctx was canceled.
+func (l *Limiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return l.allowN(ctx, key, 1)
+}
+
+// AllowN is like Allow, but consumes n tokens at once. Either all n are
+// consumed or none is, so a request for more than burstSize tokens is
+// never allowed.
+func (l *Limiter) AllowN(key string, n uint) bool {
+	allowed, err := l.allowN(context.Background(), key, n)
+	return err == nil && allowed
+}
+
+func (l *Limiter) allowN(ctx context.Context, key string, n uint) (bool, error) {
+	res, err := script.Run(ctx, l.client, []string{l.prefix + key},
+		l.tokenRate, l.burstSize, l.idleTimeout.Milliseconds(), n).Int()
+	if err != nil {
+		return l.fallbackN(key, n, err)
+	}
+	return res == 1, nil
+}
+
+// fallbackN decides a request for n tokens of key the script failed with
+// err, see WithFallback and WithFailOpen.
+func (l *Limiter) fallbackN(key string, n uint, err error) (bool, error) {
+	// a caller giving up on the request is not a Redis failure. A
+	// deadline is, as that is how a Redis stalling shows.
+	if errors.Is(err, context.Canceled) || l.fallback == nil && !l.failOpen {
+		return false, err
+	}
+	l.fallbacks.Add(1)
+	if l.fallback == nil {
+		return true, nil
+	}
+	// AllowN of the fallback does not take ctx, which may be past its
+	// deadline already.
+	return l.fallback.AllowN(key, n), nil
+}
+
+// Stats returns the counters of the limiter.
+func (l *Limiter) Stats() Stats {
+	return Stats{Fallbacks: l.fallbacks.Load()}
+}
+
+// Close does nothing, buckets are evicted by Redis and the client is
+// owned by the caller, like the limiter of WithFallback. It lets a
+// Limiter stand in for the in-process rate limiter behind
+// ratelimiter.Limiter.
+func (l *Limiter) Close() {}
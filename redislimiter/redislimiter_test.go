@@ -0,0 +1,203 @@
+package redislimiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ratelimiter "github.com/aditya1944/rate-limiter"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestLimiter(t *testing.T, tokenRate float64, burstSize uint, opts ...Option) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	server.SetTime(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// a closed server fails right away instead of after the retries
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	limiter, err := New(client, tokenRate, burstSize, opts...)
+	if err != nil {
+		t.Fatalf("not expected error but got %v", err)
+	}
+	return limiter, server
+}
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	limiter, server := newTestLimiter(t, 1, 3, WithKeyPrefix("rl:"))
+
+	for range 3 {
+		if !limiter.Allow("user1") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if limiter.Allow("user1") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	if !limiter.Allow("user2") {
+		t.Fatal("expected other key to be allowed, got false")
+	}
+
+	if !server.Exists("rl:user1") {
+		t.Error("expected bucket to be stored under prefixed key, but it wasn't")
+	}
+
+	server.SetTime(time.Date(2025, 1, 1, 0, 0, 1, 500_000_000, time.UTC))
+
+	if !limiter.Allow("user1") {
+		t.Fatal("expected allowed to be true after refill, got false")
+	}
+
+	if limiter.Allow("user1") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	// the remaining half token is kept
+	server.SetTime(time.Date(2025, 1, 1, 0, 0, 2, 0, time.UTC))
+
+	if !limiter.Allow("user1") {
+		t.Fatal("expected allowed to be true after refill, got false")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	limiter, server := newTestLimiter(t, 0, 1, WithIdleTimeout(time.Minute))
+
+	if !limiter.Allow("user1") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+
+	if ttl := server.TTL("user1"); ttl != time.Minute {
+		t.Errorf("expected ttl of %v, got %v", time.Minute, ttl)
+	}
+
+	if limiter.Allow("user1") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	server.FastForward(time.Minute)
+
+	if !limiter.Allow("user1") {
+		t.Fatal("expected expired key to be allowed, got false")
+	}
+}
+
+func TestAllowWhenRedisIsDown(t *testing.T) {
+	t.Parallel()
+
+	limiter, server := newTestLimiter(t, 1, 1)
+	server.Close()
+
+	if limiter.Allow("user1") {
+		t.Error("expected request to be rejected when redis is down, got allowed")
+	}
+	if stats := limiter.Stats(); stats.Fallbacks != 0 {
+		t.Errorf("expected no fallback when failing closed, got %d", stats.Fallbacks)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+
+	local, _ := ratelimiter.New(0, 1)
+	defer local.Close()
+
+	limiter, server := newTestLimiter(t, 0, 2, WithFallback(local))
+
+	if !limiter.Allow("user1") {
+		t.Fatal("expected allowed to be true, got false")
+	}
+	if local.Len() != 0 {
+		t.Error("expected fallback not to be used while redis is up, but it was")
+	}
+
+	server.Close()
+
+	if !limiter.Allow("user1") {
+		t.Error("expected fallback to allow the first request, got rejected")
+	}
+	if limiter.Allow("user1") {
+		t.Error("expected fallback to enforce its own limit, got allowed")
+	}
+	if allowed, err := limiter.AllowCtx(context.Background(), "user2"); err != nil || !allowed {
+		t.Errorf("expected AllowCtx to fall back without error, got %t and %v", allowed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.AllowCtx(ctx, "user3"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v for a canceled request, got %v", context.Canceled, err)
+	}
+
+	if stats := limiter.Stats(); stats.Fallbacks != 3 {
+		t.Errorf("expected 3 fallbacks, got %d", stats.Fallbacks)
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	t.Parallel()
+
+	limiter, server := newTestLimiter(t, 0, 1, WithFailOpen(true))
+	server.Close()
+
+	for range 2 {
+		if !limiter.Allow("user1") {
+			t.Error("expected request to be allowed when failing open, got rejected")
+		}
+	}
+	if stats := limiter.Stats(); stats.Fallbacks != 2 {
+		t.Errorf("expected 2 fallbacks, got %d", stats.Fallbacks)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	client := redis.NewClient(&redis.Options{})
+	defer client.Close()
+
+	if _, err := New(client, -1, 1); err == nil {
+		t.Error("expected error for negative rate, but got nil error")
+	}
+
+	if _, err := New(client, 1, 1, WithIdleTimeout(0)); err == nil {
+		t.Error("expected error for zero idle timeout, but got nil error")
+	}
+}
+
+var _ ratelimiter.Limiter = (*Limiter)(nil)
+
+func TestAllowN(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := newTestLimiter(t, 1, 5)
+
+	if limiter.AllowN("key", 6) {
+		t.Fatal("expected more than burst size to be rejected, got allowed")
+	}
+	if !limiter.AllowN("key", 3) {
+		t.Fatal("expected 3 tokens to be allowed, got rejected")
+	}
+	if limiter.AllowN("key", 3) {
+		t.Fatal("expected 3 tokens to be rejected with 2 left, got allowed")
+	}
+	if !limiter.AllowN("key", 2) {
+		t.Fatal("expected the 2 tokens left to be allowed, got rejected")
+	}
+	if limiter.Allow("key") {
+		t.Error("expected empty bucket to reject, got allowed")
+	}
+}
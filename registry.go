@@ -0,0 +1,69 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry holds rate limiters by name, so that they can be looked up
+// where needed instead of being passed through every layer. The zero
+// value is an empty registry ready to use. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	limiters map[string]registered
+}
+
+type registered struct {
+	limiter   *rateLimiter[string]
+	tokenRate float64
+	burstSize uint
+}
+
+// DefaultRegistry is the registry used by GetOrCreate.
+var DefaultRegistry = &Registry{}
+
+// GetOrCreate returns the rate limiter registered under name in
+// DefaultRegistry, creating it if there is none. See Registry.GetOrCreate.
+func GetOrCreate(name string, tokenRate float64, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	return DefaultRegistry.GetOrCreate(name, tokenRate, burstSize, opts...)
+}
+
+// GetOrCreate returns the rate limiter registered under name, creating it
+// with New if there is none. Asking for an existing name with a different
+// tokenRate or burstSize than it was created with returns an error rather
+// than a limiter behaving differently than asked for. opts only apply
+// when the rate limiter is created and are ignored otherwise. Limits
+// changed with SetRate or SetBurst since do not cause an error.
+func (reg *Registry) GetOrCreate(name string, tokenRate float64, burstSize uint, opts ...Option) (*rateLimiter[string], error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if e, ok := reg.limiters[name]; ok {
+		if e.tokenRate != tokenRate || e.burstSize != burstSize {
+			return nil, fmt.Errorf("rate limiter %q already exists with token rate %v and burst size %d", name, e.tokenRate, e.burstSize)
+		}
+		return e.limiter, nil
+	}
+
+	r, err := New(tokenRate, burstSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if reg.limiters == nil {
+		reg.limiters = make(map[string]registered)
+	}
+	reg.limiters[name] = registered{limiter: r, tokenRate: tokenRate, burstSize: burstSize}
+	return r, nil
+}
+
+// Close closes every registered rate limiter and empties the registry,
+// later GetOrCreate calls create new rate limiters.
+func (reg *Registry) Close() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, e := range reg.limiters {
+		e.limiter.Close()
+	}
+	clear(reg.limiters)
+}
@@ -0,0 +1,76 @@
+package ratelimiter
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestRegistryGetOrCreate(t *testing.T) {
+	t.Parallel()
+
+	var reg Registry
+	defer reg.Close()
+
+	login, err := reg.GetOrCreate("login", 1, 5)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if again, _ := reg.GetOrCreate("login", 1, 5); again != login {
+		t.Error("expected the existing rate limiter to be returned, got a new one")
+	}
+	if upload, _ := reg.GetOrCreate("upload", 1, 5); upload == login {
+		t.Error("expected a new rate limiter for another name, got the existing one")
+	}
+
+	if _, err := reg.GetOrCreate("login", 2, 5); err == nil {
+		t.Error("expected error for a different token rate, but got nil error")
+	}
+	if _, err := reg.GetOrCreate("login", 1, 10); err == nil {
+		t.Error("expected error for a different burst size, but got nil error")
+	}
+	if _, err := reg.GetOrCreate("invalid", -1, 5); err == nil {
+		t.Error("expected error for invalid limits, but got nil error")
+	}
+}
+
+func TestRegistryGetOrCreateConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var reg Registry
+	defer reg.Close()
+
+	limiters := make([]*rateLimiter[string], 10)
+	var wg sync.WaitGroup
+	for i := range limiters {
+		wg.Go(func() {
+			limiters[i], _ = reg.GetOrCreate("api", 1, 5)
+		})
+	}
+	wg.Wait()
+
+	for _, r := range limiters {
+		if r != limiters[0] {
+			t.Fatal("expected every caller to get the same rate limiter, got different ones")
+		}
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	t.Parallel()
+
+	var reg Registry
+
+	login, _ := reg.GetOrCreate("login", 1, 5)
+	reg.Close()
+
+	if _, err := login.AllowCtx(t.Context(), "key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected error %v, got %v", ErrClosed, err)
+	}
+
+	again, _ := reg.GetOrCreate("login", 1, 5)
+	defer reg.Close()
+	if again == login {
+		t.Error("expected a new rate limiter after Close, got the closed one")
+	}
+}
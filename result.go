@@ -0,0 +1,47 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+)
+
+// Result is the outcome of a request along with the state of its bucket
+// right after the request, all taken from the same refill.
+type Result struct {
+	// Allowed reports whether the request was let through.
+	Allowed bool
+	// Remaining is the number of tokens left in the bucket.
+	Remaining uint
+	// RetryAfter is how long until the next request of the same number
+	// of tokens would be allowed, 0 if enough tokens are left.
+	RetryAfter time.Duration
+	// Limit is the burst size applying to the key.
+	Limit uint
+}
+
+// AllowResult is like Allow, but also reports the tokens left and how
+// long until the next request would be allowed, computed in the same
+// update of the bucket as the decision. Calling Tokens and RetryAfter
+// after Allow instead may observe other requests made in between.
+func (r *rateLimiter[K]) AllowResult(key K) Result {
+	res, _ := r.allow(context.Background(), key, request{n: 1})
+	return res
+}
+
+// AllowResultCtx is like AllowResult, but returns the errors of AllowCtx,
+// e.g. ErrClosed or ctx.Err(), along with a zero Result, so that they are
+// told apart from a deny.
+func (r *rateLimiter[K]) AllowResultCtx(ctx context.Context, key K) (Result, error) {
+	return r.allow(ctx, key, request{n: 1})
+}
+
+// result builds the Result of a request for n tokens on b, brought up to
+// date at t.
+func (r *rateLimiter[K]) result(allowed bool, b *Bucket, lim *Limit, t time.Time, n uint) Result {
+	return Result{
+		Allowed:    allowed,
+		Remaining:  r.algo.available(b, lim, t),
+		RetryAfter: r.jitter(r.retryAfter(b, lim, t, n)),
+		Limit:      lim.BurstSize,
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAllowResult(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(2, 2, WithClock(clock)) // one token every 500ms; burst size of 2
+	defer rateLimiter.Close()
+
+	expected := []Result{
+		{Allowed: true, Remaining: 1, RetryAfter: 0, Limit: 2},
+		{Allowed: true, Remaining: 0, RetryAfter: 500 * time.Millisecond, Limit: 2},
+		{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, Limit: 2},
+	}
+	for i, want := range expected {
+		if res := rateLimiter.AllowResult("key"); res != want {
+			t.Errorf("request %d: expected result %+v, got %+v", i, want, res)
+		}
+	}
+
+	clock.Advance(300 * time.Millisecond)
+
+	want := Result{Allowed: false, Remaining: 0, RetryAfter: 200 * time.Millisecond, Limit: 2}
+	if res := rateLimiter.AllowResult("key"); res != want {
+		t.Errorf("expected result %+v, got %+v", want, res)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+
+	want = Result{Allowed: true, Remaining: 0, RetryAfter: 500 * time.Millisecond, Limit: 2}
+	if res := rateLimiter.AllowResult("key"); res != want {
+		t.Errorf("expected result %+v, got %+v", want, res)
+	}
+}
+
+func TestAllowResultWhenBurstSizeIsZero(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 0)
+	defer rateLimiter.Close()
+
+	want := Result{Allowed: false, RetryAfter: math.MaxInt64}
+	if res := rateLimiter.AllowResult("key"); res != want {
+		t.Errorf("expected result %+v, got %+v", want, res)
+	}
+}
@@ -0,0 +1,375 @@
+package ratelimiter
+
+import (
+	"container/heap"
+	"context"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultShards = 256
+
+// shard is one partition of the key space. A key always maps to the same
+// shard, so holding the shard lock serializes every update of that key.
+type shard[K comparable] struct {
+	mu sync.Mutex
+	m  map[K]*entry[K]
+	// idle orders the entries of m by expiry, so that idle keys are found
+	// without scanning the whole shard.
+	idle expiryHeap[K]
+
+	// pad the shard to a cache line so that locking one shard does not
+	// invalidate the cache line of its neighbours.
+	_ [24]byte
+}
+
+// entry is the bucket of a key along with its position in the shard heap.
+type entry[K comparable] struct {
+	key K
+	b   Bucket
+	// expires is when the key becomes idle, cached so that the heap does
+	// not need the idle timeout to compare entries.
+	expires time.Time
+	index   int
+}
+
+// expiryHeap is a min-heap of entries by expiry, implementing
+// heap.Interface. It keeps the index of every entry up to date so that
+// entries can be fixed or removed in place.
+type expiryHeap[K comparable] []*entry[K]
+
+func (h expiryHeap[K]) Len() int { return len(h) }
+
+func (h expiryHeap[K]) Less(i, j int) bool {
+	return h[i].expires.Before(h[j].expires)
+}
+
+func (h expiryHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K]) Push(x any) {
+	e := x.(*entry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// shardedMap is the default store of the rate limiter.
+type shardedMap[K comparable] struct {
+	seed maphash.Seed
+	// hash is the hash of WithHasher, nil means keys are hashed with
+	// maphash and seed.
+	hash        func(key K) uint64
+	shards      []shard[K]
+	mask        uint64
+	idleTimeout time.Duration
+	// sweepers is the number of goroutines deleteIdle sweeps shards
+	// with, see WithCleanupWorkers.
+	sweepers int
+}
+
+// newShardedMap returns a map of n shards with room for capacity keys. n
+// must be a power of two.
+func newShardedMap[K comparable](n int, idleTimeout time.Duration, capacity int) *shardedMap[K] {
+	s := &shardedMap[K]{
+		seed:        maphash.MakeSeed(),
+		shards:      make([]shard[K], n),
+		mask:        uint64(n - 1),
+		idleTimeout: idleTimeout,
+	}
+	// keys hash evenly over shards, round up so that capacity keys fit
+	per := (capacity + n - 1) / n
+	for i := range s.shards {
+		s.shards[i].m = make(map[K]*entry[K], per)
+		if per > 0 {
+			s.shards[i].idle = make(expiryHeap[K], 0, per)
+		}
+	}
+	return s
+}
+
+// get returns the shard owning key.
+func (s *shardedMap[K]) get(key K) *shard[K] {
+	return &s.shards[s.index(key)]
+}
+
+// index returns the position of the shard owning key.
+func (s *shardedMap[K]) index(key K) int {
+	if s.hash != nil {
+		return int(s.hash(key) & s.mask)
+	}
+	return int(maphash.Comparable(s.seed, key) & s.mask)
+}
+
+func (s *shardedMap[K]) update(ctx context.Context, key K, fn func(b *Bucket, ok bool) bool) (bool, error) {
+	// updates never wait for anything but the shard lock, so ctx is
+	// only checked once upfront.
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	sh := s.get(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.update(key, fn, s.idleTimeout), nil
+}
+
+func (s *shardedMap[K]) tryUpdate(ctx context.Context, key K, fn func(b *Bucket, ok bool) bool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	sh := s.get(key)
+	if !sh.mu.TryLock() {
+		return false, ErrBusy
+	}
+	defer sh.mu.Unlock()
+	return sh.update(key, fn, s.idleTimeout), nil
+}
+
+// update is the update of the store interface on the shard owning key,
+// idleTimeout being the limiter wide idle timeout. The caller must hold
+// the shard lock.
+func (sh *shard[K]) update(key K, fn func(b *Bucket, ok bool) bool, idleTimeout time.Duration) (created bool) {
+	// fn works on the bucket in place, a bucket handed to fn by address
+	// would escape to the heap on every update. It is restored from old
+	// if fn does not want it written.
+	e, ok := sh.m[key]
+	if ok {
+		old := e.b
+		if !fn(&e.b, true) {
+			e.b = old
+			return false
+		}
+		if expires := e.b.expiry(idleTimeout); !expires.Equal(e.expires) {
+			e.expires = expires
+			heap.Fix(&sh.idle, e.index)
+		}
+		return false
+	}
+	e = &entry[K]{key: key}
+	if !fn(&e.b, false) {
+		return false
+	}
+	e.expires = e.b.expiry(idleTimeout)
+	sh.m[key] = e
+	heap.Push(&sh.idle, e)
+	return true
+}
+
+func (s *shardedMap[K]) load(key K) (Bucket, bool) {
+	sh := s.get(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.m[key]
+	if !ok {
+		return Bucket{}, false
+	}
+	return e.b, true
+}
+
+func (s *shardedMap[K]) delete(key K) bool {
+	sh := s.get(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.m[key]
+	if !ok {
+		return false
+	}
+	sh.remove(e)
+	return true
+}
+
+// deleteFunc sweeps shards one at a time, so callers of update are only
+// blocked for keys of the shard currently being swept.
+func (s *shardedMap[K]) deleteFunc(fn func(key K, b *Bucket) bool) int {
+	deleted := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n := 0
+		for key, e := range sh.m {
+			if fn(key, &e.b) {
+				delete(sh.m, key)
+				n++
+			}
+		}
+		if n > 0 {
+			// rebuilding the heap once is cheaper than removing every
+			// deleted entry from it. every entry is given its new
+			// position, heap.Init only updates the ones it swaps.
+			sh.idle = sh.idle[:0]
+			for _, e := range sh.m {
+				e.index = len(sh.idle)
+				sh.idle = append(sh.idle, e)
+			}
+			clear(sh.idle[len(sh.idle):cap(sh.idle)])
+			heap.Init(&sh.idle)
+		}
+		sh.mu.Unlock()
+		deleted += n
+	}
+	return deleted
+}
+
+// deleteIdle pops the heap of every shard only as long as the key closest
+// to expiring is idle, so a sweep costs O(k log n) for k idle keys instead
+// of visiting every key. Only the idle keys and the root left in every
+// shard are scanned. Shards are split between sweepers goroutines, each
+// locking one shard at a time.
+func (s *shardedMap[K]) deleteIdle(now time.Time, fn func(key K)) (deleted, scanned int) {
+	// sweep sweeps every step-th shard from first, and returns the keys
+	// deleted and the number of shards left with keys.
+	sweep := func(first, step int) (deleted, live int) {
+		for i := first; i < len(s.shards); i += step {
+			d, ok := s.shards[i].deleteIdle(now, fn)
+			deleted += d
+			if ok {
+				live++
+			}
+		}
+		return deleted, live
+	}
+
+	workers := min(s.sweepers, len(s.shards))
+	if workers <= 1 {
+		deleted, live := sweep(0, 1)
+		return deleted, deleted + live
+	}
+
+	var (
+		wg             sync.WaitGroup
+		deletes, lives atomic.Int64
+	)
+	for w := range workers {
+		wg.Go(func() {
+			d, l := sweep(w, workers)
+			deletes.Add(int64(d))
+			lives.Add(int64(l))
+		})
+	}
+	wg.Wait()
+	deleted = int(deletes.Load())
+	return deleted, deleted + int(lives.Load())
+}
+
+// deleteIdle deletes the idle keys of the shard, calling fn with each of
+// them, and reports whether keys are left.
+func (sh *shard[K]) deleteIdle(now time.Time, fn func(key K)) (deleted int, live bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for len(sh.idle) > 0 && !sh.idle[0].expires.After(now) {
+		e := heap.Pop(&sh.idle).(*entry[K])
+		delete(sh.m, e.key)
+		fn(e.key)
+		deleted++
+	}
+	return deleted, len(sh.idle) > 0
+}
+
+// internKey returns key as a string, the one stored in s if s is a
+// shardedMap tracking key, so that no string is allocated.
+func internKey(s store[string], key []byte) string {
+	m, ok := s.(*shardedMap[string])
+	if !ok {
+		return string(key)
+	}
+	if m.hash != nil {
+		// a string handed to the hash of WithHasher escapes
+		return string(key)
+	}
+	// the conversions for hashing and indexing the map do not escape,
+	// so the compiler does not allocate them.
+	sh := &m.shards[maphash.Comparable(m.seed, string(key))&m.mask]
+	sh.mu.Lock()
+	e, ok := sh.m[string(key)]
+	sh.mu.Unlock()
+	if !ok {
+		return string(key)
+	}
+	return e.key
+}
+
+// rangeFunc copies the buckets of one shard at a time under its lock, and
+// calls fn once the lock is released.
+func (s *shardedMap[K]) rangeFunc(fn func(key K, b Bucket) bool) {
+	var entries []entry[K]
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		entries = entries[:0]
+		for _, e := range sh.m {
+			entries = append(entries, *e)
+		}
+		sh.mu.Unlock()
+
+		for _, e := range entries {
+			if !fn(e.key, e.b) {
+				return
+			}
+		}
+	}
+}
+
+// evictOldest only searches the shard owning key, so eviction is an
+// approximation of LRU across the whole map. Following shards are searched
+// only if that shard has no other key.
+func (s *shardedMap[K]) evictOldest(key K) (K, bool) {
+	idx := s.index(key)
+	for i := range s.shards {
+		sh := &s.shards[(idx+i)%len(s.shards)]
+		sh.mu.Lock()
+		evicted, ok := sh.evictOldest(key)
+		sh.mu.Unlock()
+		if ok {
+			return evicted, true
+		}
+	}
+	var zero K
+	return zero, false
+}
+
+// evictOldest deletes the key of the shard closest to expiring other than
+// skip, and returns it. ok is false if no key was deleted. The caller
+// must hold the shard lock.
+func (sh *shard[K]) evictOldest(skip K) (evicted K, ok bool) {
+	if len(sh.idle) == 0 {
+		return evicted, false
+	}
+	oldest := sh.idle[0]
+	if oldest.key == skip {
+		// skip is the root, the oldest of the other keys is one of
+		// its children.
+		switch {
+		case len(sh.idle) == 1:
+			return evicted, false
+		case len(sh.idle) == 2 || sh.idle.Less(1, 2):
+			oldest = sh.idle[1]
+		default:
+			oldest = sh.idle[2]
+		}
+	}
+	sh.remove(oldest)
+	return oldest.key, true
+}
+
+// remove deletes e from the shard. The caller must hold the shard lock.
+func (sh *shard[K]) remove(e *entry[K]) {
+	delete(sh.m, e.key)
+	heap.Remove(&sh.idle, e.index)
+}
@@ -0,0 +1,73 @@
+package ratelimiter
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// slidingLog keeps the times of the requests made within the rolling
+// window in Log, oldest first. Timestamps that left the window are only
+// dropped on the next request of the key.
+//
+// Buckets are copied by value, and a copy may be read while the store
+// updates the original, so Log is never written in place: dropping
+// timestamps reslices it and consume builds a new one. A ring buffer
+// would need the same copy, so Log is kept sorted instead, which also
+// copes with AllowAt going back in time.
+type slidingLog struct{}
+
+func (slidingLog) init(b *Bucket, _ *Limit, t time.Time) {
+	b.LastRefill = t
+	b.Log = nil
+}
+
+func (slidingLog) advance(b *Bucket, lim *Limit, t time.Time) {
+	w, ok := window(lim)
+	if !ok {
+		return
+	}
+	start := t.Add(-w)
+	i := sort.Search(len(b.Log), func(i int) bool {
+		return b.Log[i].After(start)
+	})
+	b.Log = b.Log[i:]
+}
+
+func (slidingLog) available(b *Bucket, lim *Limit, _ time.Time) uint {
+	used := uint(len(b.Log))
+	if used >= lim.BurstSize {
+		return 0
+	}
+	return lim.BurstSize - used
+}
+
+// consume copies Log with n timestamps of t inserted in order, so that
+// it never holds more than burst size timestamps.
+func (slidingLog) consume(b *Bucket, _ *Limit, t time.Time, n uint) {
+	i := sort.Search(len(b.Log), func(i int) bool {
+		return b.Log[i].After(t)
+	})
+	log := make([]time.Time, 0, len(b.Log)+int(n))
+	log = append(log, b.Log[:i]...)
+	for range n {
+		log = append(log, t)
+	}
+	b.Log = append(log, b.Log[i:]...)
+}
+
+// refund drops the n most recent timestamps.
+func (slidingLog) refund(b *Bucket, _ *Limit, n uint) {
+	b.Log = b.Log[:len(b.Log)-min(int(n), len(b.Log))]
+}
+
+func (slidingLog) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	w, ok := window(lim)
+	if !ok {
+		return math.MaxInt64
+	}
+	// n tokens are available once the requests over room have left the
+	// window, the last of them being the one to wait for.
+	over := len(b.Log) - int(lim.BurstSize-n)
+	return b.Log[over-1].Add(w).Sub(t)
+}
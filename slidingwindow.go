@@ -0,0 +1,90 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// slidingWindow keeps the start of the current window in LastRefill, the
+// requests made in it in Count and the requests of the previous window
+// in PrevCount.
+type slidingWindow struct{}
+
+func (slidingWindow) init(b *Bucket, _ *Limit, t time.Time) {
+	b.LastRefill = t
+	b.Count = 0
+	b.PrevCount = 0
+}
+
+func (slidingWindow) advance(b *Bucket, lim *Limit, t time.Time) {
+	w, ok := window(lim)
+	if !ok {
+		return
+	}
+	// a negative elapsed time, from a clock stepping backwards, stays in
+	// the current window.
+	elapsed := t.Sub(b.LastRefill)
+	if elapsed < w {
+		return
+	}
+	windows := elapsed / w
+	if windows == 1 {
+		b.PrevCount = b.Count
+	} else {
+		// the previous window had no requests
+		b.PrevCount = 0
+	}
+	b.Count = 0
+	b.LastRefill = b.LastRefill.Add(windows * w)
+}
+
+func (slidingWindow) available(b *Bucket, lim *Limit, t time.Time) uint {
+	used := math.Ceil(slidingWindowEstimate(b, lim, t))
+	if used >= float64(lim.BurstSize) {
+		return 0
+	}
+	return lim.BurstSize - uint(used)
+}
+
+func (slidingWindow) consume(b *Bucket, _ *Limit, _ time.Time, n uint) {
+	b.Count += n
+}
+
+// refund takes n requests off the current window. If the window has
+// moved on since they were made, requests of the new window are taken off
+// instead.
+func (slidingWindow) refund(b *Bucket, _ *Limit, n uint) {
+	b.Count -= min(n, b.Count)
+}
+
+func (slidingWindow) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	w, ok := window(lim)
+	if !ok {
+		return math.MaxInt64
+	}
+	// n tokens are available once the estimate drops to room. the
+	// weight of the previous window decreases linearly over the current
+	// one, so solve for the fraction of the window where that happens.
+	room := float64(lim.BurstSize - n)
+	start, prev, count := b.LastRefill, float64(b.PrevCount), float64(b.Count)
+	if count > room {
+		// the current window alone is over room, wait for it to become
+		// the previous window.
+		start, prev, count = start.Add(w), count, 0
+	}
+	frac := 1 - (room-count)/prev
+	next := start.Add(time.Duration(math.Ceil(frac * float64(w))))
+	return next.Sub(t)
+}
+
+// slidingWindowEstimate returns the requests made within the rolling
+// window ending at t, assuming those of the previous window were spread
+// evenly over it.
+func slidingWindowEstimate(b *Bucket, lim *Limit, t time.Time) float64 {
+	w, ok := window(lim)
+	if !ok {
+		return float64(b.Count)
+	}
+	frac := min(max(0, float64(t.Sub(b.LastRefill))/float64(w)), 1)
+	return float64(b.PrevCount)*(1-frac) + float64(b.Count)
+}
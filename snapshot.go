@@ -0,0 +1,204 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	_ io.WriterTo   = (*rateLimiter[string])(nil)
+	_ io.ReaderFrom = (*rateLimiter[string])(nil)
+)
+
+// snapshot is the gob encoded form of the buckets of a rate limiter.
+type snapshot[K comparable] struct {
+	Entries []snapshotEntry[K]
+}
+
+type snapshotEntry[K comparable] struct {
+	Key    K
+	Bucket Bucket
+}
+
+// Snapshot encodes the buckets of every tracked key with gob, e.g. to
+// keep throttle state across a restart with Restore. Like ForEach it is
+// safe to call concurrently with Allow, but keys are not read all at
+// once. K must be encodable by gob.
+//
+// The snapshot is built in memory and grows linearly with the number of
+// keys, roughly 40 bytes per key plus the encoded key, so a limiter
+// tracking tens of millions of keys produces a snapshot of gigabytes.
+// Use WithMaxKeys to bound it.
+func (r *rateLimiter[K]) Snapshot() ([]byte, error) {
+	var s snapshot[K]
+	r.store.rangeFunc(func(key K, b Bucket) bool {
+		s.Entries = append(s.Entries, snapshotEntry[K]{Key: key, Bucket: b})
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return nil, fmt.Errorf("encode snapshot: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore sets the buckets of the keys in data, a snapshot taken with
+// Snapshot, overwriting the buckets of keys already tracked. Buckets idle
+// for at least their idle timeout are dropped, as the cleanup goroutine
+// would have evicted them. Bucket times are absolute, so a key restored
+// after a long downtime is refilled for all of it on its next request.
+// It returns ErrClosed once the rate limiter is closed.
+func (r *rateLimiter[K]) Restore(data []byte) error {
+	if r.closed.Load() {
+		return ErrClosed
+	}
+
+	var s snapshot[K]
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	if r.cfg.disabled {
+		// nothing is ever stored
+		return nil
+	}
+
+	t := r.cfg.clock.Now()
+	for _, e := range s.Entries {
+		if err := r.restore(e, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore sets the bucket of e.Key to e.Bucket, unless the bucket is
+// idle at t.
+func (r *rateLimiter[K]) restore(e snapshotEntry[K], t time.Time) error {
+	if !e.Bucket.expiry(r.cfg.idleTimeout).After(t) {
+		return nil
+	}
+	created, err := r.store.update(context.Background(), e.Key, func(b *Bucket, _ bool) bool {
+		*b = e.Bucket
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if created {
+		r.added(e.Key)
+	}
+	return nil
+}
+
+// WriteTo streams the buckets of every tracked key to w, implementing
+// io.WriterTo. It is the streaming counterpart of Snapshot: each key is
+// written as a record of its own, the gob encoding of the key and its
+// bucket prefixed with its length as a 4 byte big endian integer, so
+// memory use does not grow with the number of keys. The records can
+// only be read back with ReadFrom, as type information is sent once,
+// in the first record. It returns the number of bytes written.
+func (r *rateLimiter[K]) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var (
+		buf bytes.Buffer
+		hdr [4]byte
+		err error
+	)
+	enc := gob.NewEncoder(&buf)
+	r.store.rangeFunc(func(key K, b Bucket) bool {
+		buf.Reset()
+		if err = enc.Encode(snapshotEntry[K]{Key: key, Bucket: b}); err != nil {
+			err = fmt.Errorf("encode record: %w", err)
+			return false
+		}
+		binary.BigEndian.PutUint32(hdr[:], uint32(buf.Len()))
+		if _, err = cw.Write(hdr[:]); err != nil {
+			return false
+		}
+		_, err = buf.WriteTo(cw)
+		return err == nil
+	})
+	return cw.n, err
+}
+
+// ReadFrom loads the records written by WriteTo from rd until EOF,
+// implementing io.ReaderFrom. Like Restore, it overwrites the buckets of
+// keys already tracked and drops buckets idle for at least their idle
+// timeout, one record at a time as they are read. Records read before
+// an error are kept. It returns the number of bytes read, and ErrClosed
+// once the rate limiter is closed.
+func (r *rateLimiter[K]) ReadFrom(rd io.Reader) (int64, error) {
+	if r.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	cr := &countingReader{r: rd}
+	var (
+		buf bytes.Buffer
+		hdr [4]byte
+	)
+	// the decoder reads one record at a time from buf, bytes.Buffer being
+	// an io.ByteReader the decoder does not read ahead of it.
+	dec := gob.NewDecoder(&buf)
+	t := r.cfg.clock.Now()
+	for {
+		if _, err := io.ReadFull(cr, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return cr.n, nil
+			}
+			return cr.n, fmt.Errorf("read record: %w", err)
+		}
+		// grown as the record is read rather than upfront, so a corrupt
+		// length does not allocate gigabytes.
+		size := int64(binary.BigEndian.Uint32(hdr[:]))
+		buf.Reset()
+		if n, err := buf.ReadFrom(io.LimitReader(cr, size)); err != nil {
+			return cr.n, fmt.Errorf("read record: %w", err)
+		} else if n != size {
+			return cr.n, fmt.Errorf("read record: %w", io.ErrUnexpectedEOF)
+		}
+
+		var e snapshotEntry[K]
+		if err := dec.Decode(&e); err != nil {
+			return cr.n, fmt.Errorf("decode record: %w", err)
+		}
+		if r.cfg.disabled {
+			// nothing is ever stored
+			continue
+		}
+		if err := r.restore(e, t); err != nil {
+			return cr.n, err
+		}
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,248 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 5, WithClock(clock), WithIdleTimeout(time.Hour))
+	defer rateLimiter.Close()
+
+	for range 5 {
+		rateLimiter.Allow("a")
+	}
+	rateLimiter.Allow("idle")
+	clock.Advance(30 * time.Minute)
+	rateLimiter.Allow("a")
+	rateLimiter.AllowWithLimit("b", 1, 2)
+
+	data, err := rateLimiter.Snapshot()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// restart after 30 more minutes of downtime, "idle" has then been
+	// idle for the idle timeout
+	clock.Advance(30 * time.Minute)
+	restored, _ := New(1, 5, WithClock(clock), WithIdleTimeout(time.Hour))
+	defer restored.Close()
+
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := restored.Len(); n != 2 {
+		t.Errorf("expected 2 keys restored, got %d", n)
+	}
+	if _, ok := restored.store.load("idle"); ok {
+		t.Error("expected idle key to be dropped, got restored")
+	}
+
+	// the downtime refills "a" like it does for the original limiter
+	if tokens, expected := restored.Tokens("a"), rateLimiter.Tokens("a"); tokens != expected {
+		t.Errorf("expected %d tokens, got %d", expected, tokens)
+	}
+	if b, _ := restored.store.load("b"); b.Limit == nil || b.Limit.BurstSize != 2 {
+		t.Errorf("expected per key limit to be restored, got %+v", b.Limit)
+	}
+}
+
+func TestSnapshotRestoreStructKey(t *testing.T) {
+	t.Parallel()
+
+	type key struct {
+		UserID     int
+		EndpointID int
+	}
+
+	clock := newFakeClock()
+	rateLimiter, _ := NewKeyed[key](0, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow(key{UserID: 1, EndpointID: 2})
+
+	data, err := rateLimiter.Snapshot()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	restored, _ := NewKeyed[key](0, 2, WithClock(clock))
+	defer restored.Close()
+
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tokens := restored.Tokens(key{UserID: 1, EndpointID: 2}); tokens != 1 {
+		t.Errorf("expected 1 token, got %d", tokens)
+	}
+}
+
+func TestRestoreOverwritesAndCountsKeys(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(0, 3, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	data, _ := rateLimiter.Snapshot()
+
+	rateLimiter.Allow("key")
+	rateLimiter.Allow("key")
+
+	if err := rateLimiter.Restore(data); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tokens := rateLimiter.Tokens("key"); tokens != 2 {
+		t.Errorf("expected 2 tokens after restore, got %d", tokens)
+	}
+	if n := rateLimiter.Len(); n != 1 {
+		t.Errorf("expected 1 key, got %d", n)
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(1, 1)
+
+	if err := rateLimiter.Restore([]byte("not a snapshot")); err == nil {
+		t.Error("expected error for malformed data, but got nil error")
+	}
+
+	data, _ := rateLimiter.Snapshot()
+	rateLimiter.Close()
+
+	if err := rateLimiter.Restore(data); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected error %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	rateLimiter, _ := New(1, 5, WithClock(clock), WithIdleTimeout(time.Hour))
+	defer rateLimiter.Close()
+
+	for i := range 1000 {
+		rateLimiter.Allow(strconv.Itoa(i))
+	}
+	rateLimiter.Allow("idle")
+	clock.Advance(30 * time.Minute)
+	for i := range 1000 {
+		rateLimiter.AllowN(strconv.Itoa(i), 3)
+	}
+	rateLimiter.AllowWithLimit("b", 1, 2)
+
+	var buf bytes.Buffer
+	written, err := rateLimiter.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if written != int64(buf.Len()) {
+		t.Errorf("expected %d bytes written, got %d", buf.Len(), written)
+	}
+	size := buf.Len()
+
+	// "idle" has been idle for the idle timeout once restored
+	clock.Advance(30 * time.Minute)
+	restored, _ := New(1, 5, WithClock(clock), WithIdleTimeout(time.Hour))
+	defer restored.Close()
+
+	read, err := restored.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if read != int64(size) {
+		t.Errorf("expected %d bytes read, got %d", size, read)
+	}
+	if n := restored.Len(); n != 1001 {
+		t.Errorf("expected 1001 keys restored, got %d", n)
+	}
+	if _, ok := restored.store.load("idle"); ok {
+		t.Error("expected idle key to be dropped, got restored")
+	}
+	if tokens, expected := restored.Tokens("42"), rateLimiter.Tokens("42"); tokens != expected {
+		t.Errorf("expected %d tokens, got %d", expected, tokens)
+	}
+	if b, _ := restored.store.load("b"); b.Limit == nil || b.Limit.BurstSize != 2 {
+		t.Errorf("expected per key limit to be restored, got %+v", b.Limit)
+	}
+}
+
+func TestReadFromStructKey(t *testing.T) {
+	t.Parallel()
+
+	type key struct {
+		UserID     int
+		EndpointID int
+	}
+
+	clock := newFakeClock()
+	rateLimiter, _ := NewKeyed[key](0, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow(key{UserID: 1, EndpointID: 2})
+	rateLimiter.Allow(key{UserID: 3, EndpointID: 4})
+
+	var buf bytes.Buffer
+	if _, err := rateLimiter.WriteTo(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	restored, _ := NewKeyed[key](0, 2, WithClock(clock))
+	defer restored.Close()
+
+	if _, err := restored.ReadFrom(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tokens := restored.Tokens(key{UserID: 3, EndpointID: 4}); tokens != 1 {
+		t.Errorf("expected 1 token, got %d", tokens)
+	}
+}
+
+func TestReadFromErrors(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+
+	rateLimiter.Allow("a")
+	rateLimiter.Allow("b")
+	var buf bytes.Buffer
+	if _, err := rateLimiter.WriteTo(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	data := buf.Bytes()
+
+	restored, _ := New(0, 2)
+	defer restored.Close()
+
+	// cut within the last record, the first one is kept
+	if _, err := restored.ReadFrom(bytes.NewReader(data[:len(data)-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected error %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if n := restored.Len(); n != 1 {
+		t.Errorf("expected 1 key read before the error, got %d", n)
+	}
+
+	if _, err := restored.ReadFrom(bytes.NewReader([]byte{0, 0, 0, 3, 'b', 'a', 'd'})); err == nil {
+		t.Error("expected error for malformed record, but got nil error")
+	}
+
+	if n, err := restored.ReadFrom(bytes.NewReader(nil)); n != 0 || err != nil {
+		t.Errorf("expected empty stream to read 0 bytes without error, got %d, %v", n, err)
+	}
+
+	rateLimiter.Close()
+	if _, err := rateLimiter.ReadFrom(bytes.NewReader(data)); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected error %v, got %v", ErrClosed, err)
+	}
+}
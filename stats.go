@@ -0,0 +1,75 @@
+package ratelimiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the rate limiter counters since it was created.
+type Stats struct {
+	// Allowed is the number of requests that were let through.
+	Allowed uint64
+	// Rejected is the number of requests that were denied.
+	Rejected uint64
+	// Evicted is the number of keys dropped because they were idle or
+	// to make room under WithMaxKeys. Explicit Remove and Reset calls
+	// are not counted.
+	Evicted uint64
+	// RetriesExhausted is the number of updates of a Store passed to
+	// WithStore that gave up after WithMaxRetries compare and swap
+	// attempts. Such requests are denied without being counted as
+	// Rejected, a rising count points at contended keys.
+	RetriesExhausted uint64
+	// Busy is the number of requests denied by WithNonBlocking because
+	// the shard of their key was locked. Such requests are not counted
+	// as Rejected either.
+	Busy uint64
+	// Sweeps is the number of idle key sweeps run, by the cleanup
+	// goroutine or by Flush.
+	Sweeps uint64
+	// LastSweepScanned is the number of keys the last sweep looked at.
+	// With the built in sharded maps only the idle keys and one live key
+	// per shard are, a Store passed to WithStore is scanned whole.
+	LastSweepScanned uint64
+	// LastSweepDuration is how long the last sweep took, as measured by
+	// the system clock. Along with LastSweepScanned and Evicted, it tells
+	// whether WithCleanupInterval is too short, sweeps scanning many live
+	// keys for few evictions, or too long, each sweep evicting a pile of
+	// keys that held memory since the previous one.
+	LastSweepDuration time.Duration
+	// Keys is the number of keys currently tracked.
+	Keys int
+	// Queued is the number of AllowOrQueue requests currently waiting
+	// for a token.
+	Queued int
+}
+
+type counters struct {
+	allowed          atomic.Uint64
+	rejected         atomic.Uint64
+	evicted          atomic.Uint64
+	retriesExhausted atomic.Uint64
+	busy             atomic.Uint64
+	sweeps           atomic.Uint64
+	lastSweepScanned atomic.Uint64
+	// lastSweepDuration is a time.Duration
+	lastSweepDuration atomic.Int64
+}
+
+// Stats returns the current counters. Each field is read atomically
+// without locking, so fields may be skewed by requests that complete
+// while Stats is reading them.
+func (r *rateLimiter[K]) Stats() Stats {
+	return Stats{
+		Allowed:           r.counters.allowed.Load(),
+		Rejected:          r.counters.rejected.Load(),
+		Evicted:           r.counters.evicted.Load(),
+		RetriesExhausted:  r.counters.retriesExhausted.Load(),
+		Busy:              r.counters.busy.Load(),
+		Sweeps:            r.counters.sweeps.Load(),
+		LastSweepScanned:  r.counters.lastSweepScanned.Load(),
+		LastSweepDuration: time.Duration(r.counters.lastSweepDuration.Load()),
+		Keys:              r.Len(),
+		Queued:            int(r.queued.Load()),
+	}
+}
@@ -0,0 +1,83 @@
+package ratelimiter
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		rateLimiter, _ := New(0, 2, WithMaxKeys(2))
+		defer rateLimiter.Close()
+
+		for range 3 {
+			rateLimiter.Allow("a")
+		}
+		rateLimiter.Allow("b")
+		// "c" evicts "a" to stay within max keys
+		rateLimiter.Allow("c")
+
+		expected := Stats{Allowed: 4, Rejected: 1, Evicted: 1, Keys: 2}
+		if stats := rateLimiter.Stats(); stats != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, stats)
+		}
+
+		time.Sleep(1*time.Hour + 5*time.Minute)
+		synctest.Wait()
+
+		// one sweep every 5 minutes
+		expected = Stats{Allowed: 4, Rejected: 1, Evicted: 3, Sweeps: 13, Keys: 0}
+		if stats := rateLimiter.Stats(); stats != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, stats)
+		}
+	})
+}
+
+func TestSweepStats(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name    string
+		opts    []Option
+		scanned uint64
+	}{
+		// the two idle keys and the live root of the shard heap
+		{name: "sharded", opts: []Option{WithShards(1)}, scanned: 3},
+		// every key of the store, idle or not
+		{name: "store", opts: []Option{WithStore(NewSyncMapStore())}, scanned: 5},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			clock := newFakeClock()
+			opts := append([]Option{WithClock(clock), WithIdleTimeout(time.Minute), WithoutBackgroundCleanup()}, tc.opts...)
+			rateLimiter, _ := New(1, 1, opts...)
+			defer rateLimiter.Close()
+
+			rateLimiter.Allow("idle-1")
+			rateLimiter.Allow("idle-2")
+			clock.Advance(time.Minute)
+			for _, key := range []string{"a", "b", "c"} {
+				rateLimiter.Allow(key)
+			}
+
+			if evicted := rateLimiter.Flush(); evicted != 2 {
+				t.Fatalf("expected 2 keys evicted, got %d", evicted)
+			}
+			stats := rateLimiter.Stats()
+			if stats.Sweeps != 1 || stats.LastSweepScanned != tc.scanned || stats.Evicted != 2 {
+				t.Errorf("expected 1 sweep scanning %d keys and evicting 2, got %+v", tc.scanned, stats)
+			}
+
+			rateLimiter.Flush()
+			if stats := rateLimiter.Stats(); stats.Sweeps != 2 {
+				t.Errorf("expected 2 sweeps, got %d", stats.Sweeps)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const defaultCASRetries = 100
+
+// ErrContention is the class of errors caused by concurrent updates of a
+// key rather than by its bucket, ErrRetriesExhausted being one of them.
+var ErrContention = errors.New("contention")
+
+// ErrRetriesExhausted is returned by AllowCtx and AllowE when a Store
+// update lost the compare and swap race more often than the retry limit
+// allows. It means the key is contended, not that the request is rate
+// limited, and it matches ErrContention with errors.Is.
+var ErrRetriesExhausted = fmt.Errorf("%w: compare and swap retry limit exhausted", ErrContention)
+
+// ErrBusy is returned by AllowCtx and AllowE, for rate limiters created
+// WithNonBlocking, when another request held the lock of the shard of the
+// key. It matches ErrContention with errors.Is.
+var ErrBusy = fmt.Errorf("%w: shard is busy", ErrContention)
+
+// Bucket is the state the rate limiter keeps for each key.
+type Bucket struct {
+	Tokens       uint
+	LastRefill   time.Time
+	LastActivity time.Time
+	// CreatedAt is when the first request of the key was made. It is
+	// never updated, a key evicted and seen again starts over.
+	CreatedAt time.Time
+	// Limit is set for keys created or updated through AllowWithLimit,
+	// nil means the limiter wide limit applies. It must not be modified,
+	// a new Limit is assigned instead.
+	Limit *Limit
+	// Count and PrevCount are the requests made in the current and the
+	// previous window, for algorithms counting requests per window. The
+	// current window starts at LastRefill.
+	Count     uint
+	PrevCount uint
+	// Log is the time of every request within the rolling window, oldest
+	// first, for AlgoSlidingLog. It must not be modified, a new slice is
+	// assigned instead.
+	Log []time.Time
+	// RateFactor scales the token rate of the key, lowered and raised
+	// by Report. 0 means the rate is not scaled.
+	RateFactor float64
+	// IdleTimeout is set for keys created or updated through
+	// AllowWithTTL, 0 means the limiter wide idle timeout applies.
+	IdleTimeout time.Duration
+	// BurstTokens and BurstLastRefill are the burst bucket of rate
+	// limiters created with NewTiered, Tokens and LastRefill being the
+	// sustained one.
+	BurstTokens     uint
+	BurstLastRefill time.Time
+	// Version is incremented every time the bucket is written through a
+	// Store, so that CompareAndSwap can detect concurrent updates.
+	Version uint64
+}
+
+// expiry returns when b becomes idle, def being the limiter wide idle
+// timeout.
+func (b *Bucket) expiry(def time.Duration) time.Time {
+	if b.IdleTimeout > 0 {
+		def = b.IdleTimeout
+	}
+	return b.LastActivity.Add(def)
+}
+
+// Store holds the buckets of a rate limiter, e.g. in an external system
+// shared by several instances. All methods must be safe for concurrent use.
+//
+// Buckets are compared by Version: CompareAndSwap and CompareAndDelete
+// must only succeed if the stored bucket has the same Version as old.
+type Store interface {
+	// Load returns the bucket stored for key, ok is false if there is none.
+	Load(key string) (b Bucket, ok bool)
+	// LoadOrStore returns the bucket stored for key if present, otherwise
+	// it stores and returns b. loaded reports whether key was present.
+	LoadOrStore(key string, b Bucket) (actual Bucket, loaded bool)
+	// Store sets the bucket for key, overwriting any existing one.
+	Store(key string, b Bucket)
+	// CompareAndSwap stores new for key if the stored bucket has the
+	// Version of old.
+	CompareAndSwap(key string, old, new Bucket) (swapped bool)
+	// CompareAndDelete deletes key if the stored bucket has the Version
+	// of old.
+	CompareAndDelete(key string, old Bucket) (deleted bool)
+	// Delete deletes key and reports whether it was present.
+	Delete(key string) (deleted bool)
+	// Range calls fn for every stored key until fn returns false.
+	Range(fn func(key string, b Bucket) bool)
+}
+
+// WithStore makes the rate limiter keep its buckets in s instead of its
+// built in sharded maps. Every update goes through s with a compare and
+// swap loop, retried up to 100 times before the request is rejected, see
+// WithMaxRetries.
+func WithStore(s Store) Option {
+	return func(cfg *config) {
+		cfg.store = s
+	}
+}
+
+// WithMaxRetries sets how many compare and swap attempts an update of a
+// Store passed to WithStore makes before giving up with
+// ErrRetriesExhausted. Defaults to 100. It has no effect on the built in
+// sharded maps, which never retry.
+func WithMaxRetries(n int) Option {
+	return func(cfg *config) {
+		cfg.maxRetries = n
+	}
+}
+
+// WithOnContention sets fn to be called with the key of every request
+// denied with ErrRetriesExhausted, its Store update having lost the
+// compare and swap race WithMaxRetries times in a row, e.g. to spot hot
+// keys to pre-aggregate or spread over several keys. Such a denial is not
+// a throttle, the key may well have tokens left, so fn is not called
+// along with WithOnReject but instead of it. K must be the key type of
+// the rate limiter, New fails otherwise.
+//
+// fn is called synchronously on the goroutine of the denied request,
+// outside of any lock. Exhausting the retries should be rare, but fn
+// still runs for every such request of a chronically contended key.
+func WithOnContention[K comparable](fn func(key K)) Option {
+	return func(cfg *config) {
+		cfg.onContention = fn
+	}
+}
+
+// WithRetryBackoff makes an update of a Store passed to WithStore pause
+// after losing a compare and swap race, before retrying. Goroutines
+// hammering a hot key then leave room to the others instead of spinning,
+// which bounds the latency of Allow on cold keys when the service is
+// saturated, at the cost of some latency on the hot key. A d of 0 yields
+// the processor with runtime.Gosched, a positive d sleeps a random
+// duration of up to d. d must not be negative, New fails otherwise. By
+// default updates retry immediately. Like WithMaxRetries, it has no effect
+// on the built in sharded maps.
+func WithRetryBackoff(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.retryBackoff = &d
+	}
+}
+
+// store is what the rate limiter runs its algorithm on. It is implemented
+// by shardedMap, which updates buckets under a shard lock, and by casStore,
+// which adapts a Store.
+type store[K comparable] interface {
+	// update calls fn with the bucket of key, zero valued and ok false if
+	// key is not present, and writes the bucket back if fn returns true.
+	// fn may be called more than once. created reports whether key was
+	// added. It gives up with ctx.Err() once ctx is done.
+	update(ctx context.Context, key K, fn func(b *Bucket, ok bool) bool) (created bool, err error)
+	// tryUpdate is like update, but gives up with ErrBusy rather than
+	// wait for another update to complete. Stores that never wait for
+	// one another update as usual.
+	tryUpdate(ctx context.Context, key K, fn func(b *Bucket, ok bool) bool) (created bool, err error)
+	load(key K) (Bucket, bool)
+	delete(key K) bool
+	// deleteFunc deletes every key for which fn returns true and returns
+	// how many keys were deleted.
+	deleteFunc(fn func(key K, b *Bucket) bool) int
+	// deleteIdle deletes every key whose expiry is not after now, calls
+	// fn with each deleted key and returns how many keys were deleted,
+	// and how many were looked at to find them. fn may be called while
+	// holding a lock, and concurrently from several goroutines.
+	deleteIdle(now time.Time, fn func(key K)) (deleted, scanned int)
+	// rangeFunc calls fn with a copy of the bucket of every key until fn
+	// returns false. fn is called without holding any lock, so it may
+	// call back into the store.
+	rangeFunc(fn func(key K, b Bucket) bool)
+	// evictOldest deletes the key closest to expiring other than key,
+	// starting the search from the part of the store owning key. It
+	// returns the deleted key, ok is false if no key was deleted.
+	evictOldest(key K) (evicted K, ok bool)
+}
+
+// casStore runs the rate limiter on a Store with compare and swap loops.
+type casStore struct {
+	s           Store
+	retries     int
+	idleTimeout time.Duration
+	// backoff is the duration passed to WithRetryBackoff, nil means
+	// retries are immediate.
+	backoff *time.Duration
+}
+
+func (c casStore) update(ctx context.Context, key string, fn func(b *Bucket, ok bool) bool) (bool, error) {
+	for attempt := range c.retries {
+		if attempt > 0 {
+			// the previous attempt lost the race
+			c.pause(ctx)
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		old, ok := c.s.Load(key)
+		b := old
+		if !fn(&b, ok) {
+			return false, nil
+		}
+		if !ok {
+			b.Version = 0
+			if _, loaded := c.s.LoadOrStore(key, b); !loaded {
+				// this means, this was the first time `key` is inserted
+				return true, nil
+			}
+			// some other goroutine created entry with `key`, retry
+			continue
+		}
+		b.Version = old.Version + 1
+		if c.s.CompareAndSwap(key, old, b) {
+			return false, nil
+		}
+		// some other goroutine modified the entry with that key
+		// retry again
+	}
+	return false, ErrRetriesExhausted
+}
+
+// pause waits before retrying an update as set by WithRetryBackoff. It
+// returns early once ctx is done.
+func (c casStore) pause(ctx context.Context) {
+	switch {
+	case c.backoff == nil:
+	case *c.backoff == 0:
+		runtime.Gosched()
+	default:
+		t := time.NewTimer(rand.N(*c.backoff) + 1)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// tryUpdate is update, compare and swap loops hold no lock to wait for.
+func (c casStore) tryUpdate(ctx context.Context, key string, fn func(b *Bucket, ok bool) bool) (bool, error) {
+	return c.update(ctx, key, fn)
+}
+
+func (c casStore) load(key string) (Bucket, bool) {
+	return c.s.Load(key)
+}
+
+func (c casStore) delete(key string) bool {
+	return c.s.Delete(key)
+}
+
+func (c casStore) deleteFunc(fn func(key string, b *Bucket) bool) int {
+	deleted := 0
+	c.s.Range(func(key string, b Bucket) bool {
+		// CompareAndDelete, so a bucket updated since Range read it
+		// is left alone.
+		if fn(key, &b) && c.s.CompareAndDelete(key, b) {
+			deleted++
+		}
+		return true
+	})
+	return deleted
+}
+
+// deleteIdle scans the whole store, a Store is not ordered by expiry.
+func (c casStore) deleteIdle(now time.Time, fn func(key string)) (deleted, scanned int) {
+	c.s.Range(func(key string, b Bucket) bool {
+		scanned++
+		if !b.expiry(c.idleTimeout).After(now) && c.s.CompareAndDelete(key, b) {
+			fn(key)
+			deleted++
+		}
+		return true
+	})
+	return deleted, scanned
+}
+
+func (c casStore) rangeFunc(fn func(key string, b Bucket) bool) {
+	c.s.Range(fn)
+}
+
+// evictOldest scans the whole store, a Store has no cheaper way to find
+// the key closest to expiring.
+func (c casStore) evictOldest(skip string) (string, bool) {
+	var (
+		oldestKey string
+		oldest    Bucket
+		found     bool
+	)
+	c.s.Range(func(key string, b Bucket) bool {
+		if key == skip {
+			return true
+		}
+		if !found || b.expiry(c.idleTimeout).Before(oldest.expiry(c.idleTimeout)) {
+			oldestKey, oldest, found = key, b, true
+		}
+		return true
+	})
+	return oldestKey, found && c.s.CompareAndDelete(oldestKey, oldest)
+}
+
+// syncMapStore is a Store backed by a sync.Map. Buckets are stored by
+// pointer and never mutated, so swapping the pointer is enough for
+// CompareAndSwap once the versions match.
+type syncMapStore struct {
+	m sync.Map
+}
+
+// NewSyncMapStore returns an in memory Store backed by a sync.Map. It
+// serves as a reference implementation of Store.
+func NewSyncMapStore() Store {
+	return &syncMapStore{}
+}
+
+// bucketOf returns the bucket held by a sync.Map value. Anything but a
+// *Bucket is treated as missing rather than panicking, so a malformed
+// entry is overwritten by the next update of its key.
+func bucketOf(val any) (*Bucket, bool) {
+	buck, ok := val.(*Bucket)
+	return buck, ok && buck != nil
+}
+
+func (s *syncMapStore) Load(key string) (Bucket, bool) {
+	val, ok := s.m.Load(key)
+	if !ok {
+		return Bucket{}, false
+	}
+	buck, ok := bucketOf(val)
+	if !ok {
+		return Bucket{}, false
+	}
+	return *buck, true
+}
+
+func (s *syncMapStore) LoadOrStore(key string, b Bucket) (Bucket, bool) {
+	for {
+		actual, loaded := s.m.LoadOrStore(key, &b)
+		if !loaded {
+			return b, false
+		}
+		if buck, ok := bucketOf(actual); ok {
+			return *buck, true
+		}
+		// malformed entry, replace it as if key was not present
+		if s.m.CompareAndSwap(key, actual, &b) {
+			return b, false
+		}
+	}
+}
+
+func (s *syncMapStore) Store(key string, b Bucket) {
+	s.m.Store(key, &b)
+}
+
+func (s *syncMapStore) CompareAndSwap(key string, old, new Bucket) bool {
+	val, ok := s.m.Load(key)
+	if !ok {
+		return false
+	}
+	buck, ok := bucketOf(val)
+	if !ok || buck.Version != old.Version {
+		return false
+	}
+	return s.m.CompareAndSwap(key, val, &new)
+}
+
+func (s *syncMapStore) CompareAndDelete(key string, old Bucket) bool {
+	val, ok := s.m.Load(key)
+	if !ok {
+		return false
+	}
+	buck, ok := bucketOf(val)
+	if !ok || buck.Version != old.Version {
+		return false
+	}
+	return s.m.CompareAndDelete(key, val)
+}
+
+func (s *syncMapStore) Delete(key string) bool {
+	_, loaded := s.m.LoadAndDelete(key)
+	return loaded
+}
+
+// Range skips malformed entries.
+func (s *syncMapStore) Range(fn func(key string, b Bucket) bool) {
+	s.m.Range(func(key, val any) bool {
+		k, ok := key.(string)
+		if !ok {
+			return true
+		}
+		buck, ok := bucketOf(val)
+		if !ok {
+			return true
+		}
+		return fn(k, *buck)
+	})
+}
@@ -0,0 +1,411 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestAllowWithStore(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	store := NewSyncMapStore()
+	rateLimiter, _ := New(1, 2, WithClock(clock), WithStore(store))
+	defer rateLimiter.Close()
+
+	for range 2 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+
+	b, ok := store.Load("key")
+	if !ok {
+		t.Fatal("expected bucket to be kept in the store, but it wasn't")
+	}
+	if b.Tokens != 0 || b.Version != 1 {
+		t.Errorf("expected bucket with 0 tokens at version 1, got %+v", b)
+	}
+
+	clock.Advance(time.Second)
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be true after refill, got false")
+	}
+
+	if !rateLimiter.Remove("key") {
+		t.Error("expected key to be removed from the store, but it wasn't")
+	}
+	if _, ok := store.Load("key"); ok {
+		t.Error("expected key to be deleted from the store, but it wasn't")
+	}
+}
+
+func TestStoreConcurrentSafety(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 100, WithStore(NewSyncMapStore()))
+	defer rateLimiter.Close()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for range 20 {
+		wg.Go(func() {
+			for i := range 100 {
+				if rateLimiter.Allow(fmt.Sprintf("user-%d", i%5)) {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	// every key receives 400 requests but has only 100 tokens
+	if allowed != 5*100 {
+		t.Errorf("expected allowed count to be 500, got %d", allowed)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		store := NewSyncMapStore()
+		rateLimiter, _ := New(1, 1, WithStore(store), WithMaxKeys(2))
+		defer rateLimiter.Close()
+
+		rateLimiter.Allow("a")
+		time.Sleep(time.Second)
+		rateLimiter.Allow("b")
+		rateLimiter.Allow("c")
+
+		if _, ok := store.Load("a"); ok {
+			t.Error("expected least recently active key to be evicted, but it wasn't")
+		}
+		if keys := rateLimiter.Len(); keys != 2 {
+			t.Errorf("expected 2 keys, got %d", keys)
+		}
+
+		time.Sleep(1*time.Hour + 5*time.Minute)
+		synctest.Wait()
+
+		if keys := rateLimiter.Len(); keys != 0 {
+			t.Errorf("expected 0 keys after idle eviction, got %d", keys)
+		}
+		store.Range(func(key string, _ Bucket) bool {
+			t.Errorf("expected store to be empty, found %q", key)
+			return true
+		})
+	})
+}
+
+// contendedStore simulates another writer winning every compare and swap.
+type contendedStore struct {
+	*syncMapStore
+	attempts int
+	onSwap   func(attempt int)
+}
+
+func (s *contendedStore) CompareAndSwap(key string, old, new Bucket) bool {
+	s.attempts++
+	if s.onSwap != nil {
+		s.onSwap(s.attempts)
+	}
+	return false
+}
+
+func TestAllowCtx(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	if allowed, err := rateLimiter.AllowCtx(t.Context(), "key"); !allowed || err != nil {
+		t.Errorf("expected request to be allowed without error, got %v, %v", allowed, err)
+	}
+
+	if allowed, err := rateLimiter.AllowCtx(t.Context(), "key"); allowed || err != nil {
+		t.Errorf("expected request to be rejected without error, got %v, %v", allowed, err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if _, err := rateLimiter.AllowCtx(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestAllowCtxCancelledDuringRetries(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	store := &contendedStore{
+		syncMapStore: &syncMapStore{},
+		onSwap: func(attempt int) {
+			if attempt == 3 {
+				cancel()
+			}
+		},
+	}
+	rateLimiter, _ := New(0, 10, WithStore(store))
+	defer rateLimiter.Close()
+
+	// first request creates the key, which does not need a swap
+	rateLimiter.Allow("key")
+
+	if _, err := rateLimiter.AllowCtx(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	if store.attempts != 3 {
+		t.Errorf("expected retries to stop after 3 attempts, got %d", store.attempts)
+	}
+
+	store.attempts = 0
+	if allowed, err := rateLimiter.AllowCtx(t.Context(), "key"); allowed || !errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("expected error %v, got %v, %v", ErrRetriesExhausted, allowed, err)
+	}
+	if store.attempts != defaultCASRetries {
+		t.Errorf("expected %d attempts, got %d", defaultCASRetries, store.attempts)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	t.Parallel()
+
+	store := &contendedStore{syncMapStore: &syncMapStore{}}
+	rateLimiter, _ := New(0, 10, WithStore(store), WithMaxRetries(5))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+
+	store.attempts = 0
+	if rateLimiter.Allow("key") {
+		t.Error("expected request to be denied once retries are exhausted, got allowed")
+	}
+	if store.attempts != 5 {
+		t.Errorf("expected 5 attempts, got %d", store.attempts)
+	}
+
+	expected := Stats{Allowed: 1, RetriesExhausted: 1, Keys: 1}
+	if stats := rateLimiter.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	if err := rateLimiter.AllowE("key"); !errors.Is(err, ErrContention) {
+		t.Errorf("expected contention error, got %v", err)
+	}
+}
+
+func TestOnContention(t *testing.T) {
+	t.Parallel()
+
+	var contended, rejected []string
+	store := &contendedStore{syncMapStore: &syncMapStore{}}
+	rateLimiter, _ := New(0, 10,
+		WithStore(store),
+		WithMaxRetries(3),
+		WithOnContention(func(key string) {
+			contended = append(contended, key)
+		}),
+		WithOnReject(func(key string) {
+			rejected = append(rejected, key)
+		}),
+	)
+	defer rateLimiter.Close()
+
+	// creating a key does not need a swap, the next requests lose every one
+	rateLimiter.Allow("a")
+	rateLimiter.Allow("b")
+	rateLimiter.Allow("a")
+	rateLimiter.AllowN("b", 2)
+
+	if expected := []string{"a", "b"}; !slices.Equal(contended, expected) {
+		t.Errorf("expected contended keys %v, got %v", expected, contended)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("expected no rejection to be reported, got %v", rejected)
+	}
+
+	if _, err := NewKeyed[int](1, 1, WithOnContention(func(key string) {})); err == nil {
+		t.Error("expected error for a callback taking string keys, but got nil error")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		store := &contendedStore{syncMapStore: &syncMapStore{}}
+		rateLimiter, _ := New(0, 10, WithStore(store), WithMaxRetries(5), WithRetryBackoff(time.Millisecond))
+		defer rateLimiter.Close()
+
+		rateLimiter.Allow("key")
+
+		store.attempts = 0
+		start := time.Now()
+		if allowed, err := rateLimiter.AllowCtx(t.Context(), "key"); allowed || !errors.Is(err, ErrRetriesExhausted) {
+			t.Errorf("expected error %v, got %v, %v", ErrRetriesExhausted, allowed, err)
+		}
+		if store.attempts != 5 {
+			t.Errorf("expected 5 attempts, got %d", store.attempts)
+		}
+		// one pause between every two attempts
+		if elapsed := time.Since(start); elapsed <= 0 || elapsed > 4*time.Millisecond {
+			t.Errorf("expected retries to back off for up to 4ms, got %v", elapsed)
+		}
+
+		// a cancelled request does not wait out its pause
+		ctx, cancel := context.WithCancel(t.Context())
+		store.attempts = 0
+		store.onSwap = func(int) { cancel() }
+		start = time.Now()
+		if _, err := rateLimiter.AllowCtx(ctx, "key"); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected error %v, got %v", context.Canceled, err)
+		}
+		if store.attempts != 1 || time.Since(start) != 0 {
+			t.Errorf("expected 1 attempt without backing off, got %d in %v", store.attempts, time.Since(start))
+		}
+	})
+}
+
+func TestRetryYield(t *testing.T) {
+	t.Parallel()
+
+	store := &contendedStore{syncMapStore: &syncMapStore{}}
+	rateLimiter, _ := New(0, 10, WithStore(store), WithMaxRetries(5), WithRetryBackoff(0))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+
+	store.attempts = 0
+	if rateLimiter.Allow("key") {
+		t.Error("expected request to be denied once retries are exhausted, got allowed")
+	}
+	if store.attempts != 5 {
+		t.Errorf("expected 5 attempts, got %d", store.attempts)
+	}
+}
+
+// racingStore simulates another request creating every key right
+// before LoadOrStore.
+type racingStore struct {
+	*syncMapStore
+	winner Bucket
+}
+
+func (s *racingStore) LoadOrStore(key string, b Bucket) (Bucket, bool) {
+	s.syncMapStore.LoadOrStore(key, s.winner)
+	return s.syncMapStore.LoadOrStore(key, b)
+}
+
+func TestCreatedAtLosingRace(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	won := clock.Now().Add(-time.Second)
+	store := &racingStore{
+		syncMapStore: &syncMapStore{},
+		winner:       Bucket{Tokens: 1, LastRefill: won, LastActivity: won, CreatedAt: won},
+	}
+	rateLimiter, _ := New(0, 2, WithClock(clock), WithStore(store))
+	defer rateLimiter.Close()
+
+	if !rateLimiter.Allow("key") {
+		t.Fatal("expected request to be allowed with the token of the winner, got rejected")
+	}
+	if at, ok := rateLimiter.CreatedAt("key"); !ok || !at.Equal(won) {
+		t.Errorf("expected the creation time of the winner %v, got %v, %v", won, at, ok)
+	}
+}
+
+func TestSyncMapStoreMalformedEntry(t *testing.T) {
+	t.Parallel()
+
+	store := &syncMapStore{}
+	store.m.Store("key", "not a bucket")
+	store.m.Store("nil", (*Bucket)(nil))
+
+	rateLimiter, _ := New(0, 2, WithStore(store))
+	defer rateLimiter.Close()
+
+	if _, ok := store.Load("key"); ok {
+		t.Error("expected malformed entry to be treated as missing, but it wasn't")
+	}
+	store.Range(func(key string, b Bucket) bool {
+		t.Errorf("expected malformed entries to be skipped, got %q", key)
+		return true
+	})
+
+	for _, key := range []string{"key", "nil"} {
+		if !rateLimiter.Allow(key) {
+			t.Fatalf("expected allowed to be true for %q, got false", key)
+		}
+		b, ok := store.Load(key)
+		if !ok || b.Tokens != 1 {
+			t.Errorf("expected malformed entry of %q to be overwritten with 1 token, got %+v", key, b)
+		}
+	}
+}
+
+// BenchmarkAllowStore compares the default sharded maps with a sync.Map
+// Store at several key cardinalities. Every Allow is a read, modify and
+// write of its bucket, the worst case of sync.Map.
+func BenchmarkAllowStore(b *testing.B) {
+	stores := []struct {
+		name string
+		opts func() []Option
+	}{
+		{name: "sharded", opts: func() []Option { return nil }},
+		{name: "syncmap", opts: func() []Option { return []Option{WithStore(NewSyncMapStore())} }},
+	}
+
+	for _, cardinality := range []int{1, 100, 10_000, 1_000_000} {
+		keys := make([]string, cardinality)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key%d", i)
+		}
+
+		for _, s := range stores {
+			b.Run(fmt.Sprintf("%s/keys=%d", s.name, cardinality), func(b *testing.B) {
+				rateLimiter, _ := New(1000, 10000, s.opts()...)
+				defer rateLimiter.Close()
+
+				i := 0
+				for b.Loop() {
+					rateLimiter.Allow(keys[i])
+					i = (i + 1) % len(keys)
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/keys=%d/parallel", s.name, cardinality), func(b *testing.B) {
+				rateLimiter, _ := New(1000, 10000, s.opts()...)
+				defer rateLimiter.Close()
+
+				var next atomic.Int64
+				b.RunParallel(func(p *testing.PB) {
+					// goroutines start at different keys
+					i := int(next.Add(7919)) % len(keys)
+					for p.Next() {
+						rateLimiter.Allow(keys[i])
+						i = (i + 1) % len(keys)
+					}
+				})
+			})
+		}
+	}
+}
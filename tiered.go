@@ -0,0 +1,108 @@
+package ratelimiter
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// NewTiered returns a rate limiter checking every key against two token
+// buckets, and allowing a request only if both have a token, consuming
+// one from each. The sustained bucket enforces a long term rate, like
+// 5000 requests per hour, and the burst bucket a short term one, like
+// 10 requests per second, so the sustained burst cannot be spent at once.
+//
+// sustainedRate and sustainedBurst act as the tokenRate and burstSize of
+// New: SetRate, SetBurst and AllowWithLimit change the sustained bucket
+// only. burstRate must be positive, and neither rate may be infinite.
+// Only AlgoTokenBucket is supported.
+//
+// Both buckets are dropped together when the key is evicted, so they
+// restart full after the idle timeout, even if the sustained bucket
+// takes longer to refill.
+func NewTiered(sustainedRate float64, sustainedBurst uint, burstRate float64, burstBurst uint, opts ...Option) (*rateLimiter[string], error) {
+	return New(sustainedRate, sustainedBurst, append(opts, func(cfg *config) {
+		cfg.tier = &Limit{TokenRate: burstRate, BurstSize: burstBurst}
+	})...)
+}
+
+// validateTier checks the burst tier set by NewTiered, tokenRate being
+// the rate of the sustained tier.
+func validateTier(tokenRate float64, cfg config) error {
+	if cfg.algorithm != AlgoTokenBucket {
+		return errors.New("tiered limits only support the token bucket algorithm")
+	}
+	if math.IsInf(tokenRate, 1) || math.IsInf(cfg.tier.TokenRate, 1) {
+		return errors.New("tiered limits do not support an infinite token rate")
+	}
+	if cfg.tier.TokenRate <= 0 {
+		return errors.New("burst token rate should be positive")
+	}
+	tierCfg := cfg
+	tierCfg.tier = nil
+	return validate(cfg.tier.TokenRate, cfg.tier.BurstSize, tierCfg)
+}
+
+// tiered is a token bucket, the sustained tier, along with the burst tier
+// keeping its tokens in BurstTokens and BurstLastRefill.
+type tiered struct {
+	burst Limit
+}
+
+func (a tiered) init(b *Bucket, lim *Limit, t time.Time) {
+	tokenBucket{}.init(b, lim, t)
+	b.BurstTokens = a.burst.BurstSize
+	b.BurstLastRefill = t
+}
+
+func (a tiered) advance(b *Bucket, lim *Limit, t time.Time) {
+	b.refill(lim, t)
+	burst := a.burstBucket(b)
+	burst.refill(&a.burst, t)
+	b.BurstTokens, b.BurstLastRefill = burst.Tokens, burst.LastRefill
+}
+
+func (tiered) available(b *Bucket, _ *Limit, _ time.Time) uint {
+	return min(b.Tokens, b.BurstTokens)
+}
+
+func (tiered) consume(b *Bucket, _ *Limit, _ time.Time, n uint) {
+	b.Tokens -= n
+	b.BurstTokens -= n
+}
+
+func (a tiered) refund(b *Bucket, lim *Limit, n uint) {
+	tokenBucket{}.refund(b, lim, n)
+	b.BurstTokens = min(b.BurstTokens+min(n, a.burst.BurstSize), a.burst.BurstSize)
+}
+
+// retryAfter waits for the tier lacking tokens the longest.
+func (a tiered) retryAfter(b *Bucket, lim *Limit, t time.Time, n uint) time.Duration {
+	var wait time.Duration
+	if b.Tokens < n {
+		wait = tokenBucket{}.retryAfter(b, lim, t, n)
+	}
+	if b.BurstTokens < n {
+		if n > a.burst.BurstSize {
+			return math.MaxInt64
+		}
+		burst := a.burstBucket(b)
+		wait = max(wait, tokenBucket{}.retryAfter(&burst, &a.burst, t, n))
+	}
+	return wait
+}
+
+// burstTimeToFull returns how long until the burst tier of b, brought up
+// to date at t, is full.
+func (a tiered) burstTimeToFull(b *Bucket, t time.Time) time.Duration {
+	burst := a.burstBucket(b)
+	if burst.Tokens >= a.burst.BurstSize {
+		return 0
+	}
+	return max(0, tokenBucket{}.retryAfter(&burst, &a.burst, t, a.burst.BurstSize))
+}
+
+// burstBucket returns the burst tier of b as a bucket of its own.
+func (tiered) burstBucket(b *Bucket) Bucket {
+	return Bucket{Tokens: b.BurstTokens, LastRefill: b.BurstLastRefill}
+}
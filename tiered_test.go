@@ -0,0 +1,180 @@
+package ratelimiter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewTiered(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name           string
+		sustainedRate  float64
+		sustainedBurst uint
+		burstRate      float64
+		burstBurst     uint
+		opts           []Option
+		shouldError    bool
+	}{
+		{
+			name:           "valid tiers",
+			sustainedRate:  5000.0 / 3600,
+			sustainedBurst: 5000,
+			burstRate:      10,
+			burstBurst:     10,
+		},
+		{
+			name:           "burst rate is zero",
+			sustainedRate:  1,
+			sustainedBurst: 10,
+			burstRate:      0,
+			burstBurst:     2,
+			shouldError:    true,
+		},
+		{
+			name:           "sustained rate is infinite",
+			sustainedRate:  math.Inf(1),
+			sustainedBurst: 10,
+			burstRate:      1,
+			burstBurst:     2,
+			shouldError:    true,
+		},
+		{
+			name:           "burst rate is NaN",
+			sustainedRate:  1,
+			sustainedBurst: 10,
+			burstRate:      math.NaN(),
+			burstBurst:     2,
+			shouldError:    true,
+		},
+		{
+			name:           "burst rate overflows",
+			sustainedRate:  1,
+			sustainedBurst: 10,
+			burstRate:      math.MaxUint,
+			burstBurst:     2,
+			shouldError:    true,
+		},
+		{
+			name:           "algorithm other than token bucket",
+			sustainedRate:  1,
+			sustainedBurst: 10,
+			burstRate:      1,
+			burstBurst:     2,
+			opts:           []Option{WithAlgorithm(AlgoSlidingWindow)},
+			shouldError:    true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r, err := NewTiered(tc.sustainedRate, tc.sustainedBurst, tc.burstRate, tc.burstBurst, tc.opts...)
+			if err == nil {
+				defer r.Close()
+			}
+
+			if tc.shouldError && err == nil {
+				t.Errorf("expected error, but got nil error")
+			}
+
+			if !tc.shouldError && err != nil {
+				t.Errorf("not expected error but got error")
+			}
+		})
+	}
+}
+
+func TestAllowTiered(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	// sustained: one token per second, burst size of 5
+	// burst: one token every 100ms, burst size of 2
+	rateLimiter, _ := NewTiered(1, 5, 10, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	// the burst bucket only lets 2 requests through at once
+	for range 2 {
+		if !rateLimiter.Allow("key") {
+			t.Fatal("expected allowed to be true, got false")
+		}
+	}
+	if rateLimiter.Allow("key") {
+		t.Fatal("expected allowed to be false, got true")
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 100*time.Millisecond {
+		t.Errorf("expected retry after of %v, got %v", 100*time.Millisecond, retryAfter)
+	}
+
+	// a request every 100ms drains the sustained bucket after 3 more
+	allowed := 0
+	for range 5 {
+		clock.Advance(100 * time.Millisecond)
+		if rateLimiter.Allow("key") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("expected allowed requests: %d, got: %d", 3, allowed)
+	}
+
+	// the burst bucket is full again, but the sustained one refills a
+	// token at 1s only.
+	if tokens := rateLimiter.Tokens("key"); tokens != 0 {
+		t.Errorf("expected 0 tokens, got %d", tokens)
+	}
+	if retryAfter := rateLimiter.RetryAfter("key"); retryAfter != 500*time.Millisecond {
+		t.Errorf("expected retry after of %v, got %v", 500*time.Millisecond, retryAfter)
+	}
+
+	// AllowN needs n tokens in both buckets
+	clock.Advance(5 * time.Second)
+	if rateLimiter.AllowN("key", 3) {
+		t.Error("expected AllowN above the burst bucket size to be rejected, got allowed")
+	}
+	if !rateLimiter.AllowN("key", 2) {
+		t.Error("expected AllowN to be allowed, got rejected")
+	}
+}
+
+func TestTimeToFullTiered(t *testing.T) {
+	t.Parallel()
+
+	clock := newFakeClock()
+	// sustained: one token per second, burst size of 10
+	// burst: one token every 200ms, burst size of 2
+	rateLimiter, _ := NewTiered(1, 10, 5, 2, WithClock(clock))
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("key")
+	rateLimiter.Allow("key")
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 2*time.Second {
+		t.Errorf("expected time to full of the sustained bucket, 2s, got %v", timeToFull)
+	}
+
+	// the burst bucket is full again, the sustained one still misses
+	// 2 tokens
+	clock.Advance(400 * time.Millisecond)
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 1600*time.Millisecond {
+		t.Errorf("expected time to full of 1.6s while the sustained bucket refills, got %v", timeToFull)
+	}
+
+	clock.Advance(1600 * time.Millisecond)
+	if timeToFull := rateLimiter.TimeToFull("key"); timeToFull != 0 {
+		t.Errorf("expected time to full of full buckets to be 0, got %v", timeToFull)
+	}
+
+	// the burst bucket is the last one to refill
+	slow, _ := NewTiered(10, 2, 1, 2, WithClock(clock))
+	defer slow.Close()
+
+	slow.Allow("key")
+	slow.Allow("key")
+	clock.Advance(200 * time.Millisecond)
+	if timeToFull := slow.TimeToFull("key"); timeToFull != 1800*time.Millisecond {
+		t.Errorf("expected time to full of the burst bucket, 1.8s, got %v", timeToFull)
+	}
+}
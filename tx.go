@@ -0,0 +1,64 @@
+package ratelimiter
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+)
+
+// Tx holds the tokens consumed by Begin until they are kept with Commit or
+// given back with Rollback, e.g. when the work they were taken for fails
+// downstream.
+//
+// A Tx is only a record of the keys it consumed from, the rate limiter
+// keeps no reference to it. A Tx neither committed nor rolled back is
+// collected like any other value, its tokens staying consumed as if it
+// was committed, to refill at the usual rate.
+type Tx[K comparable] struct {
+	r    *rateLimiter[K]
+	keys []K
+	// done is set by the first Commit or Rollback.
+	done atomic.Bool
+}
+
+// Begin takes a token from every key, like AllowAll, and returns the
+// transaction holding them. ok reports whether every key had a token: if
+// not, the tokens already taken are refunded right away and the returned
+// Tx holds none, so Commit and Rollback do nothing. Stats count the call
+// as a single request, whatever becomes of the transaction.
+//
+// It is safe to defer Rollback right after Begin, it does nothing once
+// the transaction is committed.
+func (r *rateLimiter[K]) Begin(keys ...K) (tx *Tx[K], ok bool) {
+	tx = &Tx[K]{r: r}
+	if !r.allowAll(keys) {
+		tx.done.Store(true)
+		return tx, false
+	}
+	// keys may be reused by the caller before the transaction ends
+	tx.keys = slices.Clone(keys)
+	return tx, true
+}
+
+// Commit keeps the tokens of the transaction consumed. It does nothing
+// if the transaction was already committed or rolled back.
+func (tx *Tx[K]) Commit() {
+	tx.done.Store(true)
+}
+
+// Rollback gives back the tokens of the transaction with Refund, unless it
+// was already committed or rolled back: it is idempotent, and safe to
+// call concurrently with Commit, only the first of them taking effect.
+// Like Refund, it does not fill a bucket beyond burstSize, nor give a
+// token back to a key evicted in the meantime.
+func (tx *Tx[K]) Rollback() {
+	if !tx.done.CompareAndSwap(false, true) {
+		return
+	}
+	if tx.r.cfg.disabled {
+		return
+	}
+	for _, key := range tx.keys {
+		tx.r.refund(context.Background(), key, 1)
+	}
+}
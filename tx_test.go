@@ -0,0 +1,108 @@
+package ratelimiter
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTxRollback(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	defer rateLimiter.Close()
+
+	keys := []string{"user", "org"}
+	tx, ok := rateLimiter.Begin(keys...)
+	if !ok {
+		t.Fatal("expected transaction to take a token from every key, got rejected")
+	}
+	// the caller reusing its slice does not change the transaction
+	keys[0] = "other"
+
+	for _, key := range []string{"user", "org"} {
+		if tokens := rateLimiter.Tokens(key); tokens != 1 {
+			t.Errorf("%s: expected 1 token while the transaction is open, got %d", key, tokens)
+		}
+	}
+
+	tx.Rollback()
+	tx.Rollback()
+	tx.Commit()
+	for _, key := range []string{"user", "org"} {
+		if tokens := rateLimiter.Tokens(key); tokens != 2 {
+			t.Errorf("%s: expected 2 tokens after rolling back once, got %d", key, tokens)
+		}
+	}
+	if _, ok := rateLimiter.store.load("other"); ok {
+		t.Error("expected rollback to leave keys outside the transaction alone, got other tracked")
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 2)
+	defer rateLimiter.Close()
+
+	tx, ok := rateLimiter.Begin("user", "org")
+	if !ok {
+		t.Fatal("expected transaction to take a token from every key, got rejected")
+	}
+	tx.Commit()
+	// deferred rollbacks of committed transactions do nothing
+	tx.Rollback()
+
+	for _, key := range []string{"user", "org"} {
+		if tokens := rateLimiter.Tokens(key); tokens != 1 {
+			t.Errorf("%s: expected 1 token after commit, got %d", key, tokens)
+		}
+	}
+}
+
+func TestTxRejected(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 1)
+	defer rateLimiter.Close()
+
+	rateLimiter.Allow("org")
+
+	tx, ok := rateLimiter.Begin("user", "org")
+	if ok {
+		t.Fatal("expected transaction to be rejected without a token for org, got ok")
+	}
+	if tokens := rateLimiter.Tokens("user"); tokens != 1 {
+		t.Errorf("expected token of user to be refunded, got %d tokens", tokens)
+	}
+
+	// nothing is held, a rollback does not refund again
+	tx.Rollback()
+	if tokens := rateLimiter.Tokens("org"); tokens != 0 {
+		t.Errorf("expected org to stay empty, got %d tokens", tokens)
+	}
+
+	expected := Stats{Allowed: 1, Rejected: 1, Keys: 2}
+	if stats := rateLimiter.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestTxConcurrentEnd(t *testing.T) {
+	t.Parallel()
+
+	rateLimiter, _ := New(0, 10)
+	defer rateLimiter.Close()
+
+	tx, _ := rateLimiter.Begin("key")
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(tx.Rollback)
+		wg.Go(tx.Commit)
+	}
+	wg.Wait()
+
+	// refunded at most once, whichever came first
+	if tokens := rateLimiter.Tokens("key"); tokens != 9 && tokens != 10 {
+		t.Errorf("expected 9 or 10 tokens, got %d", tokens)
+	}
+}